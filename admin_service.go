@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidRole   = errors.New("role must be user, admin or auditor")
+	ErrAdminSelfEdit = errors.New("administrators cannot change their own role or disable themselves")
+)
+
+// AdminService backs the admin API: managing accounts and inspecting or
+// removing anyone's files
+type AdminService struct {
+	db          *sql.DB
+	userRepo    *UserRepository
+	refreshRepo *RefreshTokenRepository
+	fileService *FileService
+}
+
+func NewAdminService(db *sql.DB, userRepo *UserRepository, refreshRepo *RefreshTokenRepository, fileService *FileService) *AdminService {
+	return &AdminService{
+		db:          db,
+		userRepo:    userRepo,
+		refreshRepo: refreshRepo,
+		fileService: fileService,
+	}
+}
+
+// ListUsers returns a page of users and the total number of users
+func (s *AdminService) ListUsers(limit, offset int) ([]*User, int, error) {
+	users, err := s.userRepo.List(limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := s.userRepo.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// SetRole changes a user's role. The user's current access token stops
+// working and the next one carries the new role.
+func (s *AdminService) SetRole(adminID, userID int, role string) (*User, error) {
+	if !validRole(role) {
+		return nil, ErrInvalidRole
+	}
+	if adminID == userID {
+		return nil, ErrAdminSelfEdit
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepo.SetRole(userID, role); err != nil {
+		return nil, err
+	}
+
+	user.Role = role
+	return user, nil
+}
+
+// DisableUser stops a user from logging in and signs out all their sessions
+func (s *AdminService) DisableUser(adminID, userID int) (*User, error) {
+	if adminID == userID {
+		return nil, ErrAdminSelfEdit
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsDisabled() {
+		return user, nil
+	}
+
+	now := time.Now()
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.userRepo.WithTx(tx).SetDisabled(userID, &now); err != nil {
+			return err
+		}
+		return s.refreshRepo.WithTx(tx).RevokeAllForUser(userID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user.DisabledAt = &now
+	return user, nil
+}
+
+// EnableUser lets a disabled user log in again
+func (s *AdminService) EnableUser(userID int) (*User, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepo.SetDisabled(userID, nil); err != nil {
+		return nil, err
+	}
+
+	user.DisabledAt = nil
+	return user, nil
+}
+
+// GetFile returns any file's metadata, including files in the trash
+func (s *AdminService) GetFile(fileID int) (*File, error) {
+	return s.fileService.GetAnyFile(fileID)
+}
+
+// ForceDeleteFile permanently deletes any file, skipping the trash
+func (s *AdminService) ForceDeleteFile(fileID int) error {
+	return s.fileService.ForceDeleteFile(fileID)
+}
+
+// PromoteAdmins makes the users with the given email addresses
+// administrators, so a new installation can get its first one
+func (s *AdminService) PromoteAdmins(emails []string) error {
+	return s.userRepo.PromoteByEmail(emails, RoleAdmin)
+}
+
+func validRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin || role == RoleAuditor
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		switch role := c.GetHeader("X-Test-Role"); role {
+		case "api-key":
+			c.Set("api_key", &APIKey{Scopes: []string{ScopeFilesRead, ScopeFilesWrite}})
+		default:
+			c.Set("claims", &JWTClaims{UserID: 1, Role: role})
+		}
+	})
+	admin := router.Group("/admin", requireRole(RoleAdmin, RoleAuditor))
+	admin.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	admin.POST("/users/2/disable", requireRole(RoleAdmin), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(method, path, role string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("X-Test-Role", role)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/admin/users", RoleAdmin))
+	assert.Equal(t, http.StatusOK, request("GET", "/admin/users", RoleAuditor))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/admin/users", RoleUser))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/admin/users", ""))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/admin/users", "api-key"))
+
+	assert.Equal(t, http.StatusOK, request("POST", "/admin/users/2/disable", RoleAdmin))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/admin/users/2/disable", RoleAuditor), "auditors are read-only")
+}
+
+func TestAdminServiceRejectsSelfEdits(t *testing.T) {
+	service := &AdminService{}
+
+	_, err := service.SetRole(1, 2, "owner")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+
+	_, err = service.SetRole(1, 1, RoleUser)
+	assert.ErrorIs(t, err, ErrAdminSelfEdit)
+
+	_, err = service.DisableUser(1, 1)
+	assert.ErrorIs(t, err, ErrAdminSelfEdit)
+}
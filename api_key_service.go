@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+	ErrInvalidAPIKey      = errors.New("invalid or expired API key")
+	ErrInvalidAPIKeyScope = errors.New("unknown API key scope")
+)
+
+// API key scopes
+const (
+	ScopeFilesRead  = "files:read"
+	ScopeFilesWrite = "files:write"
+)
+
+// apiKeyPrefix starts every API key so they are easy to recognise, for
+// example by secret scanners
+const apiKeyPrefix = "fsp_"
+
+// APIKeyService manages personal API keys. A key looks like
+// fsp_<prefix>_<secret>: the prefix identifies it and the secret is only
+// stored hashed.
+type APIKeyService struct {
+	apiKeyRepo *APIKeyRepository
+	userRepo   *UserRepository
+}
+
+func NewAPIKeyService(apiKeyRepo *APIKeyRepository, userRepo *UserRepository) *APIKeyService {
+	return &APIKeyService{apiKeyRepo: apiKeyRepo, userRepo: userRepo}
+}
+
+// CreateAPIKey creates a key with the given scopes and returns it together
+// with the full key, which is not retrievable later. A zero expiresIn
+// creates a key that never expires.
+func (s *APIKeyService) CreateAPIKey(userID int, name string, scopes []string, expiresIn time.Duration) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, "", errors.New("name must be between 1 and 100 characters")
+	}
+
+	scopes, err := cleanScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix, err := randomHex(6)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := generateSecretToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		UserID:     userID,
+		Name:       name,
+		Prefix:     prefix,
+		SecretHash: hashToken(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
+	}
+	if expiresIn > 0 {
+		expiresAt := key.CreatedAt.Add(expiresIn)
+		key.ExpiresAt = &expiresAt
+	}
+
+	key.ID, err = s.apiKeyRepo.Create(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, apiKeyPrefix + prefix + "_" + secret, nil
+}
+
+// GetAPIKeys lists a user's keys without their secrets
+func (s *APIKeyService) GetAPIKeys(userID int) ([]*APIKey, error) {
+	return s.apiKeyRepo.GetByUserID(userID)
+}
+
+// DeleteAPIKey revokes one of the user's keys
+func (s *APIKeyService) DeleteAPIKey(id, userID int) error {
+	return s.apiKeyRepo.Delete(id, userID)
+}
+
+// Authenticate checks a full API key and returns it, recording its use
+func (s *APIKeyService) Authenticate(rawKey string) (*APIKey, error) {
+	prefix, secret, ok := parseAPIKey(rawKey)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := s.apiKeyRepo.GetByPrefix(prefix)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// Keys stop working while their owner's account is disabled
+	user, err := s.userRepo.GetByID(key.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	if err := s.apiKeyRepo.Touch(key.ID, now); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// IsAPIKey reports whether a credential looks like an API key rather than
+// a JWT
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// parseAPIKey splits a key into its prefix and secret
+func parseAPIKey(rawKey string) (prefix, secret string, ok bool) {
+	if !IsAPIKey(rawKey) {
+		return "", "", false
+	}
+
+	prefix, secret, ok = strings.Cut(strings.TrimPrefix(rawKey, apiKeyPrefix), "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", "", false
+	}
+
+	return prefix, secret, true
+}
+
+// cleanScopes validates scopes and removes duplicates
+func cleanScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	var cleaned []string
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope != ScopeFilesRead && scope != ScopeFilesWrite {
+			return nil, ErrInvalidAPIKeyScope
+		}
+		if !contains(cleaned, scope) {
+			cleaned = append(cleaned, scope)
+		}
+	}
+
+	return cleaned, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIKey(t *testing.T) {
+	prefix, secret, ok := parseAPIKey("fsp_0a1b2c3d4e5f_c2VjcmV0_with-dashes")
+	assert.True(t, ok)
+	assert.Equal(t, "0a1b2c3d4e5f", prefix)
+	assert.Equal(t, "c2VjcmV0_with-dashes", secret, "secrets may contain underscores")
+
+	for _, key := range []string{"", "fsp_", "fsp_prefixonly", "fsp__secret", "eyJhbGciOiJIUzI1NiJ9.e30.sig"} {
+		_, _, ok := parseAPIKey(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestCleanScopes(t *testing.T) {
+	scopes, err := cleanScopes([]string{"files:read", " files:write", "files:read"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ScopeFilesRead, ScopeFilesWrite}, scopes)
+
+	_, err = cleanScopes(nil)
+	assert.Error(t, err)
+
+	_, err = cleanScopes([]string{"admin"})
+	assert.ErrorIs(t, err, ErrInvalidAPIKeyScope)
+}
+
+func TestRequireFileScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	readOnly := &APIKey{Scopes: []string{ScopeFilesRead}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("X-Test-Key") != "" {
+			c.Set("api_key", readOnly)
+		}
+	})
+	files := router.Group("/", requireFileScope())
+	files.GET("/files", func(c *gin.Context) { c.Status(http.StatusOK) })
+	files.DELETE("/files/1", func(c *gin.Context) { c.Status(http.StatusOK) })
+	files.GET("/share/1", requireScope(ScopeFilesWrite), func(c *gin.Context) { c.Status(http.StatusOK) })
+	files.POST("/share/1", requireScope(ScopeFilesWrite), func(c *gin.Context) { c.Status(http.StatusOK) })
+	files.GET("/files/1/verify", requireScope(ScopeFilesWrite), func(c *gin.Context) { c.Status(http.StatusOK) })
+	account := router.Group("/", requireSession())
+	account.GET("/me/api-keys", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(method, path string, withKey bool) int {
+		req, _ := http.NewRequest(method, path, nil)
+		if withKey {
+			req.Header.Set("X-Test-Key", "1")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/files", true))
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/files/1", true))
+	assert.Equal(t, http.StatusOK, request("DELETE", "/files/1", false), "login sessions are not limited")
+
+	// Share links are public, so minting one is a write whichever verb asks
+	assert.Equal(t, http.StatusForbidden, request("GET", "/share/1", true))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/share/1", true))
+	assert.Equal(t, http.StatusOK, request("GET", "/share/1", false))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/files/1/verify", true))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/me/api-keys", true))
+	assert.Equal(t, http.StatusOK, request("GET", "/me/api-keys", false))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Audited actions
+const (
+	AuditLogin        = "login"
+	AuditLoginFailed  = "login.failed"
+	AuditLockout      = "login.lockout"
+	AuditUnlock       = "login.unlock"
+	AuditShareLockout = "share.lockout"
+	AuditUpload       = "file.upload"
+	AuditDownload     = "file.download"
+	AuditShare        = "file.share"
+	AuditUnshare      = "file.unshare"
+	AuditDelete       = "file.delete"
+)
+
+// auditExportBatch is how many events an export reads at a time
+const auditExportBatch = 500
+
+// AuditFilter narrows down audit events; zero fields match everything
+type AuditFilter struct {
+	Action   string
+	UserID   *int
+	FileID   *int
+	IP       string
+	Since    *time.Time // Inclusive
+	Until    *time.Time // Exclusive
+	BeforeID int64      // Only events older than this one
+}
+
+// AuditLog is the append-only record of logins, file access and sharing,
+// answering who did what and when. A nil AuditLog records nothing.
+type AuditLog struct {
+	repo *AuditRepository
+	now  func() time.Time
+}
+
+func NewAuditLog(repo *AuditRepository) *AuditLog {
+	return &AuditLog{repo: repo, now: time.Now}
+}
+
+// Record appends an event. Failing to record is logged rather than returned,
+// so that the audited request itself still succeeds.
+func (a *AuditLog) Record(event *AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = a.now()
+	}
+	event.Email = truncate(event.Email, 255)
+	event.UserAgent = truncate(event.UserAgent, 512)
+	event.Detail = truncate(event.Detail, 255)
+
+	if err := a.repo.Append(event); err != nil {
+		log.Printf("Failed to record %s audit event: %v", event.Action, err)
+	}
+}
+
+// RecordLockout records a LoginLimiter locking out an account, an IP address
+// or guessing at a share link's password, or an administrator lifting a
+// lockout
+func (a *AuditLog) RecordLockout(event LockoutEvent) {
+	entry := &AuditEvent{Action: AuditLockout, CreatedAt: event.Time}
+	switch {
+	case strings.HasPrefix(event.Key, attemptKeyAccount):
+		entry.Email = strings.TrimPrefix(event.Key, attemptKeyAccount)
+	case strings.HasPrefix(event.Key, attemptKeyIP):
+		entry.IP = strings.TrimPrefix(event.Key, attemptKeyIP)
+	case strings.HasPrefix(event.Key, attemptKeyShare):
+		entry.Action = AuditShareLockout
+		entry.Detail = "share link " + strings.TrimPrefix(event.Key, attemptKeyShare) + ", "
+	case strings.HasPrefix(event.Key, attemptKeyShareIP):
+		entry.Action = AuditShareLockout
+		entry.IP = strings.TrimPrefix(event.Key, attemptKeyShareIP)
+	}
+
+	if event.LockedUntil == nil {
+		unlockedBy := event.UnlockedBy
+		entry.Action = AuditUnlock
+		entry.UserID = &unlockedBy
+	} else {
+		entry.Detail += fmt.Sprintf("%d failed attempts, locked until %s", event.Failures, event.LockedUntil.UTC().Format(time.RFC3339))
+	}
+
+	a.Record(entry)
+}
+
+// Find returns a page of events matching filter, newest first
+func (a *AuditLog) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, error) {
+	return a.repo.Find(filter, limit, offset)
+}
+
+// Export calls fn with every event matching filter, newest first, reading
+// them in batches so that large exports do not hold everything in memory
+func (a *AuditLog) Export(filter AuditFilter, fn func(*AuditEvent) error) error {
+	for {
+		events, err := a.repo.Find(filter, auditExportBatch, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < auditExportBatch {
+			return nil
+		}
+		filter.BeforeID = events[len(events)-1].ID
+	}
+}
+
+// auditEncoder writes audit events as CSV or JSON Lines
+type auditEncoder struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// auditExportFormats maps the supported export formats to their content
+// types
+var auditExportFormats = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+}
+
+// auditCSVHeader names the CSV columns, in auditEncoder.Encode order
+var auditCSVHeader = []string{"id", "created_at", "action", "user_id", "email", "ip", "user_agent", "file_id", "detail"}
+
+// newAuditEncoder returns an encoder for format, writing the CSV header
+// straight away
+func newAuditEncoder(w io.Writer, format string) (*auditEncoder, error) {
+	switch format {
+	case "csv":
+		encoder := &auditEncoder{csv: csv.NewWriter(w)}
+		return encoder, encoder.csv.Write(auditCSVHeader)
+	case "jsonl":
+		return &auditEncoder{json: json.NewEncoder(w)}, nil
+	default:
+		return nil, errors.New("format must be json, csv or jsonl")
+	}
+}
+
+func (e *auditEncoder) Encode(event *AuditEvent) error {
+	if e.json != nil {
+		return e.json.Encode(event)
+	}
+
+	return e.csv.Write([]string{
+		strconv.FormatInt(event.ID, 10),
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		event.Action,
+		optionalID(event.UserID),
+		csvSafe(event.Email),
+		event.IP,
+		csvSafe(event.UserAgent),
+		optionalID(event.FileID),
+		csvSafe(event.Detail),
+	})
+}
+
+// Flush writes out anything buffered
+func (e *auditEncoder) Flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+func optionalID(id *int) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.Itoa(*id)
+}
+
+// csvSafe keeps client-supplied values from being read as formulas when an
+// export is opened in a spreadsheet
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// truncate cuts value to at most limit bytes without splitting a character
+func truncate(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	for limit > 0 && !utf8.RuneStart(value[limit]) {
+		limit--
+	}
+	return value[:limit]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditEncoder(t *testing.T) {
+	userID, fileID := 3, 42
+	event := &AuditEvent{
+		ID:        7,
+		Action:    AuditDownload,
+		UserID:    &userID,
+		IP:        "203.0.113.9",
+		UserAgent: "=HYPERLINK(\"http://evil\")",
+		FileID:    &fileID,
+		Detail:    "report, final.pdf",
+		CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	// CSV starts with a header and defuses values a spreadsheet would evaluate
+	var out bytes.Buffer
+	encoder, err := newAuditEncoder(&out, "csv")
+	require.NoError(t, err)
+	require.NoError(t, encoder.Encode(event))
+	require.NoError(t, encoder.Encode(&AuditEvent{ID: 6, Action: AuditLoginFailed, Email: "a@example.com", CreatedAt: event.CreatedAt}))
+	require.NoError(t, encoder.Flush())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, strings.Join(auditCSVHeader, ","), lines[0])
+	assert.Equal(t, `7,2024-05-01T12:00:00Z,file.download,3,,203.0.113.9,"'=HYPERLINK(""http://evil"")",42,"report, final.pdf"`, lines[1])
+	assert.Equal(t, `6,2024-05-01T12:00:00Z,login.failed,,a@example.com,,,,`, lines[2])
+
+	// JSON Lines has one object per event
+	out.Reset()
+	encoder, err = newAuditEncoder(&out, "jsonl")
+	require.NoError(t, err)
+	require.NoError(t, encoder.Encode(event))
+	require.NoError(t, encoder.Flush())
+
+	var decoded AuditEvent
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, event.Action, decoded.Action)
+	assert.Equal(t, fileID, *decoded.FileID)
+
+	_, err = newAuditEncoder(&out, "xml")
+	assert.Error(t, err)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 10))
+	assert.Equal(t, "abc", truncate("abcdef", 3))
+	assert.Equal(t, "a", truncate("aé", 2), "characters are not split")
+}
+
+func TestNilAuditLogRecordsNothing(t *testing.T) {
+	var auditLog *AuditLog
+	assert.NotPanics(t, func() {
+		auditLog.Record(&AuditEvent{Action: AuditLogin})
+	})
+}
+
+func TestRecordLockout(t *testing.T) {
+	var recorded [][]driver.Value
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		require.True(t, strings.HasPrefix(query, "INSERT INTO audit_events"), query)
+		recorded = append(recorded, args)
+		return fakeReply{LastInsertID: 1, RowsAffected: 1}, nil
+	})
+	auditLog := NewAuditLog(NewAuditRepository(db))
+
+	until := time.Date(2024, 5, 1, 12, 15, 0, 0, time.UTC)
+	for _, key := range []string{"ip:198.51.100.7", "share:4", "share-ip:198.51.100.7"} {
+		auditLog.RecordLockout(LockoutEvent{Key: key, Failures: 5, LockedUntil: &until, Time: until})
+	}
+
+	// Share link lockouts are not reported as login lockouts
+	require.Len(t, recorded, 3)
+	assert.Equal(t, []driver.Value{AuditLockout, "198.51.100.7"}, []driver.Value{recorded[0][0], recorded[0][3]})
+	assert.Equal(t, AuditShareLockout, recorded[1][0])
+	assert.Contains(t, recorded[1][6], "share link 4")
+	assert.Equal(t, []driver.Value{AuditShareLockout, "198.51.100.7"}, []driver.Value{recorded[2][0], recorded[2][3]})
+}
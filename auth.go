@@ -1,29 +1,119 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
 
+	ErrInvalidUserToken     = errors.New("invalid or expired token")
+	ErrEmailAlreadyVerified = errors.New("email address is already verified")
 
-// JWTClaims represents the claims in the JWT
+	ErrInvalidMFAToken   = errors.New("invalid or expired MFA token; log in again")
+	ErrInvalidMFACode    = errors.New("invalid authentication code")
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two-factor authentication is not set up")
+
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; its session has been signed out")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+
+	ErrAccountDisabled = errors.New("account is disabled")
+)
+
+// JWTClaims represents the claims in the JWT. The standard jti claim (Id)
+// identifies the token so it can be revoked.
 type JWTClaims struct {
-	UserID int `json:"user_id"`
+	UserID     int    `json:"user_id"`
+	Role       string `json:"role,omitempty"`
+	Generation int    `json:"gen,omitempty"`     // The user's token generation when issued
+	Purpose    string `json:"purpose,omitempty"` // Empty for access tokens
 	jwt.StandardClaims
 }
 
+// TokenPair is what a client receives on login and on each refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // Seconds until the access token expires
+	UserID       int    `json:"-"`          // Whom the tokens were issued to
+}
+
+// LoginResult holds either tokens or, when the user has a second factor, an
+// MFA challenge token
+type LoginResult struct {
+	Tokens   *TokenPair
+	MFAToken string
+}
+
+// TOTPEnrollment is what a user needs to set up an authenticator app
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Roles a user can have
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor" // Read-only access to the admin API
+)
+
+// mfaTokenPurpose marks challenge tokens issued between password and
+// second factor
+const mfaTokenPurpose = "mfa"
+
+// recoveryCodeCount is how many recovery codes each enrollment creates
+const recoveryCodeCount = 10
+
+// Purposes of the single-use tokens emailed to users
+const (
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposeResetPassword = "reset_password"
+)
+
 // AuthService handles authentication logic
 type AuthService struct {
-	userRepo *UserRepository
+	db            *sql.DB
+	userRepo      *UserRepository
+	refreshRepo   *RefreshTokenRepository
+	revokedRepo   *RevokedTokenRepository
+	userTokenRepo *UserTokenRepository
+	recoveryRepo  *RecoveryCodeRepository
+	identityRepo  *UserIdentityRepository
+	keys          *KeyRing
+	limiter       *LoginLimiter
+	mailer        Mailer
 }
 
-func NewAuthService(userRepo *UserRepository) *AuthService {
-	return &AuthService{userRepo: userRepo}
+func NewAuthService(db *sql.DB, userRepo *UserRepository, refreshRepo *RefreshTokenRepository, revokedRepo *RevokedTokenRepository, userTokenRepo *UserTokenRepository, recoveryRepo *RecoveryCodeRepository, identityRepo *UserIdentityRepository, keys *KeyRing, limiter *LoginLimiter, mailer Mailer) *AuthService {
+	return &AuthService{
+		db:            db,
+		userRepo:      userRepo,
+		refreshRepo:   refreshRepo,
+		revokedRepo:   revokedRepo,
+		userTokenRepo: userTokenRepo,
+		recoveryRepo:  recoveryRepo,
+		identityRepo:  identityRepo,
+		keys:          keys,
+		limiter:       limiter,
+		mailer:        mailer,
+	}
 }
 
 // Register registers a new user
@@ -41,71 +131,711 @@ func (s *AuthService) Register(email, password string) (int, error) {
 	}
 
 	// Create user
-	return s.userRepo.Create(email, string(hashedPassword))
+	id, err := s.userRepo.Create(email, string(hashedPassword))
+	if err != nil {
+		return 0, err
+	}
+
+	// The account works without verification, so a failed email is only logged
+	if err := s.sendVerificationEmail(id, email); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", id, err)
+	}
+
+	return id, nil
+}
+
+// VerifyEmail marks the address a verification token was sent to as verified
+func (s *AuthService) VerifyEmail(token string) error {
+	return withTx(s.db, func(tx *sql.Tx) error {
+		userToken, err := s.useToken(tx, tokenPurposeVerifyEmail, token)
+		if err != nil {
+			return err
+		}
+
+		return s.userRepo.WithTx(tx).MarkEmailVerified(userToken.UserID, time.Now())
+	})
+}
+
+// ResendVerification emails a new verification link to a user whose
+// address is not verified yet
+func (s *AuthService) ResendVerification(userID int) error {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	return s.sendVerificationEmail(user.ID, user.Email)
+}
+
+// ForgotPassword emails a password reset link. Unknown addresses are
+// silently ignored so the endpoint does not reveal who has an account.
+func (s *AuthService) ForgotPassword(email string) error {
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := s.issueUserToken(user.ID, tokenPurposeResetPassword, passwordResetTTL())
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account.\n\n" +
+			"To choose a new password, open this link within " + passwordResetTTL().String() + ":\n\n" +
+			appBaseURL() + "/password/reset?token=" + token + "\n\n" +
+			"If it was not you, you can ignore this email.\n",
+	})
+}
+
+// ResetPassword sets a new password using a reset token. Every session of
+// the user is signed out, and since the token arrived by email the address
+// counts as verified.
+func (s *AuthService) ResetPassword(token, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return withTx(s.db, func(tx *sql.Tx) error {
+		userToken, err := s.useToken(tx, tokenPurposeResetPassword, token)
+		if err != nil {
+			return err
+		}
+
+		users := s.userRepo.WithTx(tx)
+		now := time.Now()
+		if err := users.UpdatePassword(userToken.UserID, string(hashedPassword)); err != nil {
+			return err
+		}
+		if err := users.MarkEmailVerified(userToken.UserID, now); err != nil {
+			return err
+		}
+		if err := users.BumpTokenGeneration(userToken.UserID); err != nil {
+			return err
+		}
+
+		return s.refreshRepo.WithTx(tx).RevokeAllForUser(userToken.UserID, now)
+	})
+}
+
+// sendVerificationEmail emails a link that verifies the user's address
+func (s *AuthService) sendVerificationEmail(userID int, email string) error {
+	token, err := s.issueUserToken(userID, tokenPurposeVerifyEmail, emailVerificationTTL())
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Welcome! Please confirm your email address by opening this link within " +
+			emailVerificationTTL().String() + ":\n\n" +
+			appBaseURL() + "/email/verify?token=" + token + "\n",
+	})
 }
 
-// Login authenticates a user and returns a JWT token
-func (s *AuthService) Login(email, password string) (string, error) {
+// issueUserToken stores a new single-use token for purpose and returns it
+func (s *AuthService) issueUserToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = s.userTokenRepo.Create(&UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// useToken checks a single-use token and uses it up, along with any other
+// token the user holds for the same purpose
+func (s *AuthService) useToken(tx *sql.Tx, purpose, token string) (*UserToken, error) {
+	tokens := s.userTokenRepo.WithTx(tx)
+	now := time.Now()
+
+	userToken, err := tokens.GetByHashForUpdate(purpose, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if userToken.UsedAt != nil || now.After(userToken.ExpiresAt) {
+		return nil, ErrInvalidUserToken
+	}
+
+	if err := tokens.UseAll(userToken.UserID, purpose, now); err != nil {
+		return nil, err
+	}
+
+	return userToken, nil
+}
+
+// Login authenticates a user. Users without a second factor get an access
+// token together with the first refresh token of a new family; users with
+// one get an MFA challenge token to exchange through LoginMFA. Failures are
+// counted per account and per client IP address, and too many of them block
+// further attempts for a while.
+func (s *AuthService) Login(email, password, ip string) (*LoginResult, error) {
+	// Refuse to check passwords while the account or address is blocked
+	if err := s.limiter.Check(email, ip); err != nil {
+		return nil, err
+	}
+
 	// Get user by email
 	user, err := s.userRepo.GetByEmail(email)
 	if err != nil {
-		return "", errors.New("invalid email or password")
+		return nil, s.loginFailed(email, ip)
 	}
 
 	// Compare passwords
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
-		return "", errors.New("invalid email or password")
+		return nil, s.loginFailed(email, ip)
 	}
 
-	// Generate JWT token
-	return GenerateToken(user.ID)
+	return s.completeLogin(user)
 }
 
-// GenerateToken generates a new JWT token for a user
-func GenerateToken(userID int) (string, error) {
-	// Get JWT secret from environment variable
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default_jwt_secret" // Default secret for development
+// LoginWithIdentity logs in the user linked to a single sign-on identity.
+// An identity seen for the first time is linked to the account with the
+// same verified email address, or to a new account when there is none.
+func (s *AuthService) LoginWithIdentity(identity *OIDCIdentity) (*LoginResult, error) {
+	userID, err := s.identityRepo.GetUserID(identity.Issuer, identity.Subject)
+	if errors.Is(err, ErrUserNotFound) {
+		userID, err = s.linkIdentity(identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create claims
-	claims := JWTClaims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(), // Token expires in 24 hours
-			IssuedAt:  time.Now().Unix(),
-		},
+	return s.completeLogin(user)
+}
+
+// linkIdentity links an identity to the account for its email address,
+// creating the account if needed, and returns the user ID
+func (s *AuthService) linkIdentity(identity *OIDCIdentity) (int, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return 0, ErrOIDCEmailRequired
 	}
 
-	// Generate token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	var userID int
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		users := s.userRepo.WithTx(tx)
+		now := time.Now()
+
+		user, err := users.GetByEmail(identity.Email)
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			// Accounts created by single sign-on have no usable password
+			// until the user sets one through a password reset
+			hashedPassword, err := unusablePassword()
+			if err != nil {
+				return err
+			}
+			if userID, err = users.Create(identity.Email, hashedPassword); err != nil {
+				return err
+			}
+			if err := users.MarkEmailVerified(userID, now); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			userID = user.ID
+
+			// Whoever registered an unverified address never proved they own
+			// it, so their password and sessions must not outlive the owner
+			// logging in
+			if user.EmailVerifiedAt == nil {
+				hashedPassword, err := unusablePassword()
+				if err != nil {
+					return err
+				}
+				if err := users.UpdatePassword(userID, hashedPassword); err != nil {
+					return err
+				}
+				if err := users.MarkEmailVerified(userID, now); err != nil {
+					return err
+				}
+				if err := users.BumpTokenGeneration(userID); err != nil {
+					return err
+				}
+				if err := s.refreshRepo.WithTx(tx).RevokeAllForUser(userID, now); err != nil {
+					return err
+				}
+			}
+		}
+
+		return s.identityRepo.WithTx(tx).Create(&UserIdentity{
+			UserID:    userID,
+			Issuer:    identity.Issuer,
+			Subject:   identity.Subject,
+			CreatedAt: now,
+		})
+	})
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
-	return tokenString, nil
+	return userID, nil
 }
 
-// ValidateToken validates a JWT token and returns the claims
-func ValidateToken(tokenString string) (*JWTClaims, error) {
-	// Get JWT secret from environment variable
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default_jwt_secret" // Default secret for development
+// completeLogin finishes a login whose first factor has been checked,
+// asking for the second factor when the user has one
+func (s *AuthService) completeLogin(user *User) (*LoginResult, error) {
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	// Ask for the second factor before handing out real tokens
+	if user.HasTOTP() {
+		mfaToken, err := s.keys.generateToken(JWTClaims{UserID: user.ID, Purpose: mfaTokenPurpose}, mfaChallengeTTL())
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{MFAToken: mfaToken}, nil
+	}
+
+	// The login succeeded, so earlier failures no longer count
+	if err := s.limiter.RecordSuccess(user.Email); err != nil {
+		return nil, err
+	}
+
+	// Generate tokens
+	tokens, err := s.issueTokens(s.refreshRepo, user, "")
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Tokens: tokens}, nil
+}
+
+// loginFailed counts a failed login and returns the error to report
+func (s *AuthService) loginFailed(email, ip string) error {
+	if err := s.limiter.RecordFailure(email, ip); err != nil {
+		return err
+	}
+	return errors.New("invalid email or password")
+}
+
+// LoginMFA completes a login by exchanging an MFA challenge token and a TOTP
+// or recovery code for real tokens. A wrong code uses up the challenge, so
+// every guess costs a password check.
+func (s *AuthService) LoginMFA(mfaToken, code, ip string) (*TokenPair, error) {
+	claims, err := s.keys.ValidateToken(mfaToken)
+	if err != nil || claims.Purpose != mfaTokenPurpose || claims.Id == "" {
+		return nil, ErrInvalidMFAToken
+	}
+
+	revoked, err := s.revokedRepo.Exists(claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidMFAToken
+	}
+
+	user, err := s.userRepo.GetByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	// Wrong codes count against the account like wrong passwords
+	if err := s.limiter.Check(user.Email, ip); err != nil {
+		return nil, err
+	}
+
+	// The challenge works once, whether or not the code is right
+	if err := s.revokedRepo.Add(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSecondFactor(user, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			if err := s.limiter.RecordFailure(user.Email, ip); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+
+	if err := s.limiter.RecordSuccess(user.Email); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(s.refreshRepo, user, "")
+}
+
+// EnrollTOTP starts setting up an authenticator app. The new secret only
+// takes effect once ConfirmTOTP accepts a code generated from it, and the
+// recovery codes are shown this one time.
+func (s *AuthService) EnrollTOTP(userID int) (*TOTPEnrollment, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.HasTOTP() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.userRepo.WithTx(tx).SetTOTPSecret(userID, secret); err != nil {
+			return err
+		}
+		return s.recoveryRepo.WithTx(tx).Replace(userID, hashes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URI:           totpURI(totpIssuer(), user.Email, secret),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// ConfirmTOTP turns on the second factor once the user proves their
+// authenticator app produces valid codes
+func (s *AuthService) ConfirmTOTP(userID int, code string) error {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.HasTOTP() {
+		return ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return ErrMFANotEnrolled
+	}
+
+	step, ok := matchTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	if _, err := s.userRepo.UseTOTPStep(userID, step); err != nil {
+		return err
+	}
+
+	return s.userRepo.EnableTOTP(userID, time.Now())
+}
+
+// DisableTOTP removes the second factor after checking a current TOTP or
+// recovery code
+func (s *AuthService) DisableTOTP(userID int, code string) error {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if !user.HasTOTP() {
+		return ErrMFANotEnrolled
+	}
+
+	if err := s.checkSecondFactor(user, code); err != nil {
+		return err
+	}
+
+	return withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.userRepo.WithTx(tx).DisableTOTP(userID); err != nil {
+			return err
+		}
+		return s.recoveryRepo.WithTx(tx).DeleteAll(userID)
+	})
+}
+
+// checkSecondFactor accepts a TOTP code not used before or an unused
+// recovery code
+func (s *AuthService) checkSecondFactor(user *User, code string) error {
+	if step, ok := matchTOTP(user.TOTPSecret, code, time.Now()); ok {
+		fresh, err := s.userRepo.UseTOTPStep(user.ID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	used, err := s.recoveryRepo.Use(user.ID, hashToken(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. Each refresh token
+// works once; presenting a used one means it leaked, so its whole family is
+// revoked.
+func (s *AuthService) Refresh(refreshToken string) (*TokenPair, error) {
+	var pair *TokenPair
+	reused := false
+
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		tokens := s.refreshRepo.WithTx(tx)
+		now := time.Now()
+
+		token, err := tokens.GetByHashForUpdate(hashToken(refreshToken))
+		if err != nil {
+			return err
+		}
+
+		if token.RevokedAt != nil {
+			return ErrInvalidRefreshToken
+		}
+
+		// Commit the revocation rather than rolling it back with the error
+		if token.UsedAt != nil {
+			reused = true
+			return tokens.RevokeFamily(token.FamilyID, now)
+		}
+
+		if now.After(token.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tokens.MarkUsed(token.ID, now); err != nil {
+			return err
+		}
+
+		// Read the user again so a changed role reaches the new access token
+		user, err := s.userRepo.WithTx(tx).GetByID(token.UserID)
+		if err != nil {
+			return err
+		}
+		if user.IsDisabled() {
+			return ErrAccountDisabled
+		}
+
+		pair, err = s.issueTokens(tokens, user, token.FamilyID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reused {
+		return nil, ErrRefreshTokenReused
 	}
 
-	// Parse token
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
+	return pair, nil
+}
+
+// Logout revokes the access token described by claims and, when given, the
+// family of refreshToken
+func (s *AuthService) Logout(claims *JWTClaims, refreshToken string) error {
+	if err := s.revokedRepo.Add(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return err
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+
+	return withTx(s.db, func(tx *sql.Tx) error {
+		tokens := s.refreshRepo.WithTx(tx)
+
+		token, err := tokens.GetByHashForUpdate(hashToken(refreshToken))
+		if err != nil {
+			return err
 		}
-		return []byte(jwtSecret), nil
+
+		// Users can only sign out their own sessions
+		if token.UserID != claims.UserID {
+			return ErrInvalidRefreshToken
+		}
+
+		return tokens.RevokeFamily(token.FamilyID, time.Now())
 	})
+}
 
+// Authenticate validates an access token and checks it has not been revoked
+func (s *AuthService) Authenticate(tokenString string) (*JWTClaims, error) {
+	claims, err := s.keys.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens without a jti cannot be revoked, and tokens with a purpose such
+	// as MFA challenges grant no access, so neither is accepted
+	if claims.Id == "" || claims.Purpose != "" {
+		return nil, errors.New("invalid token")
+	}
+
+	revoked, err := s.revokedRepo.Exists(claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	// Disabling an account or changing its role ends its access tokens
+	// early; a client holding one with an old role refreshes it. Resetting
+	// the password moves the user to a new token generation, ending them
+	// for good along with the refresh tokens.
+	user, err := s.userRepo.GetByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+	if user.Role != claims.Role || user.TokenGeneration != claims.Generation {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
+// PurgeExpiredTokens forgets refresh tokens, emailed tokens and denylist
+// entries that have expired anyway
+func (s *AuthService) PurgeExpiredTokens() error {
+	now := time.Now()
+	if err := s.refreshRepo.DeleteExpired(now); err != nil {
+		return err
+	}
+	if err := s.userTokenRepo.DeleteExpired(now); err != nil {
+		return err
+	}
+	return s.revokedRepo.DeleteExpired(now)
+}
+
+// RunTokenPurger purges expired tokens every interval until stop is closed
+func (s *AuthService) RunTokenPurger(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.PurgeExpiredTokens(); err != nil {
+			log.Printf("Failed to purge expired tokens: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// issueTokens creates an access token and a refresh token in familyID,
+// starting a new family when it is empty
+func (s *AuthService) issueTokens(tokens *RefreshTokenRepository, user *User, familyID string) (*TokenPair, error) {
+	accessToken, err := s.keys.GenerateToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if familyID == "" {
+		if familyID, err = randomHex(16); err != nil {
+			return nil, err
+		}
+	}
+
+	refreshToken, err := generateSecretToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = tokens.Create(&RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(refreshTokenTTL()),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenTTL().Seconds()),
+		UserID:       user.ID,
+	}, nil
+}
+
+// GenerateToken generates a new JWT access token for a user, carrying the
+// role and token generation that Authenticate compares with the user's
+func (r *KeyRing) GenerateToken(user *User) (string, error) {
+	return r.generateToken(JWTClaims{UserID: user.ID, Role: user.Role, Generation: user.TokenGeneration}, accessTokenTTL())
+}
+
+// generateToken generates a JWT with claims that lasts ttl. Tokens with a
+// purpose are only accepted for that purpose and never as access tokens.
+func (r *KeyRing) generateToken(claims JWTClaims, ttl time.Duration) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        jti,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		IssuedAt:  time.Now().Unix(),
+	}
+
+	// Sign with the active key
+	return r.sign(claims)
+}
+
+// ValidateToken validates a JWT token and returns the claims
+func (r *KeyRing) ValidateToken(tokenString string) (*JWTClaims, error) {
+	// Parse token, verifying it with the key its kid names
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, r.verificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -116,4 +846,99 @@ func ValidateToken(tokenString string) (*JWTClaims, error) {
 	}
 
 	return nil, errors.New("invalid token")
-}
\ No newline at end of file
+}
+
+// accessTokenTTL returns how long access tokens live (ACCESS_TOKEN_TTL,
+// 15 minutes by default)
+func accessTokenTTL() time.Duration {
+	return durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// refreshTokenTTL returns how long refresh tokens live (REFRESH_TOKEN_TTL,
+// 30 days by default)
+func refreshTokenTTL() time.Duration {
+	return durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// emailVerificationTTL returns how long verification links work
+// (EMAIL_VERIFICATION_TTL, 48 hours by default)
+func emailVerificationTTL() time.Duration {
+	return durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+}
+
+// passwordResetTTL returns how long password reset links work
+// (PASSWORD_RESET_TTL, 1 hour by default)
+func passwordResetTTL() time.Duration {
+	return durationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+}
+
+// mfaChallengeTTL returns how long a user has to enter their second factor
+// after their password (MFA_CHALLENGE_TTL, 5 minutes by default)
+func mfaChallengeTTL() time.Duration {
+	return durationFromEnv("MFA_CHALLENGE_TTL", 5*time.Minute)
+}
+
+// totpIssuer names the service in authenticator apps (TOTP_ISSUER)
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "File Sharing Platform"
+}
+
+// appBaseURL returns the public address used in emailed links (APP_BASE_URL)
+func appBaseURL() string {
+	if url := os.Getenv("APP_BASE_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// generateSecretToken generates an opaque token for refresh tokens and
+// emailed links
+func generateSecretToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// unusablePassword returns the hash of a random password nobody knows
+func unusablePassword() (string, error) {
+	password, err := generateSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashedPassword), nil
+}
+
+// hashToken returns the hex SHA-256 of a token. Tokens carry 256 random
+// bits, so a fast hash is enough to make a leaked table useless.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
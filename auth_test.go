@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateToken(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_TTL", "5m")
+	keys := newTestKeyRing(t)
+
+	first, err := keys.GenerateToken(&User{ID: 7, Role: RoleUser})
+	require.NoError(t, err)
+	second, err := keys.GenerateToken(&User{ID: 7, Role: RoleUser})
+	require.NoError(t, err)
+
+	claims, err := keys.ValidateToken(first)
+	require.NoError(t, err)
+	assert.Equal(t, 7, claims.UserID)
+	assert.Equal(t, RoleUser, claims.Role)
+	assert.NotEmpty(t, claims.Id, "access tokens carry a jti so they can be revoked")
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), time.Unix(claims.ExpiresAt, 0), 5*time.Second)
+
+	other, err := keys.ValidateToken(second)
+	require.NoError(t, err)
+	assert.NotEqual(t, claims.Id, other.Id)
+}
+
+func TestResetPasswordEndsAccessTokens(t *testing.T) {
+	user := &User{ID: 4, Email: "alice@example.com", Role: RoleUser, CreatedAt: time.Now()}
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT "+userColumns+" FROM users WHERE id = ?"):
+			return fakeRow(userColumns, int64(user.ID), user.Email, "", nil, "", nil, int64(0), user.Role, nil,
+				int64(user.TokenGeneration), user.CreatedAt), nil
+		case strings.HasPrefix(query, "SELECT COUNT(*) FROM revoked_tokens"):
+			return fakeRow("COUNT(*)", int64(0)), nil
+		case strings.HasPrefix(query, "SELECT id, user_id, purpose, token_hash"):
+			return fakeRow("id, user_id, purpose, token_hash, expires_at, used_at, created_at",
+				int64(1), int64(user.ID), tokenPurposeResetPassword, args[1], time.Now().Add(time.Hour), nil, time.Now()), nil
+		case strings.HasPrefix(query, "UPDATE users SET token_generation"):
+			user.TokenGeneration++
+		case query == "BEGIN", query == "COMMIT",
+			strings.HasPrefix(query, "UPDATE user_tokens"),
+			strings.HasPrefix(query, "UPDATE users SET"),
+			strings.HasPrefix(query, "UPDATE refresh_tokens"):
+		default:
+			t.Fatalf("unexpected query %q", query)
+		}
+		return fakeReply{RowsAffected: 1}, nil
+	})
+	keys := newTestKeyRing(t)
+	service := NewAuthService(db, NewUserRepository(db), NewRefreshTokenRepository(db), NewRevokedTokenRepository(db), NewUserTokenRepository(db), nil, nil, keys, nil, nil)
+
+	token, err := keys.GenerateToken(user)
+	require.NoError(t, err)
+	_, err = service.Authenticate(token)
+	require.NoError(t, err)
+
+	// Whoever held the old password also held its access tokens
+	require.NoError(t, service.ResetPassword("reset token", "a new password"))
+	_, err = service.Authenticate(token)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+
+	token, err = keys.GenerateToken(user)
+	require.NoError(t, err)
+	_, err = service.Authenticate(token)
+	assert.NoError(t, err)
+}
+
+func TestTokenTTLs(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_TTL", "")
+	t.Setenv("REFRESH_TOKEN_TTL", "not a duration")
+	assert.Equal(t, 15*time.Minute, accessTokenTTL())
+	assert.Equal(t, 30*24*time.Hour, refreshTokenTTL())
+
+	t.Setenv("REFRESH_TOKEN_TTL", "48h")
+	assert.Equal(t, 48*time.Hour, refreshTokenTTL())
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := generateSecretToken()
+	require.NoError(t, err)
+	assert.Len(t, token, 43)
+
+	assert.Len(t, hashToken(token), 64)
+	assert.Equal(t, hashToken(token), hashToken(token))
+	assert.NotEqual(t, token, hashToken(token))
+}
@@ -1,19 +1,44 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Authenticator is the subset of AuthService used by AuthController
+type Authenticator interface {
+	Register(email, password string) (int, error)
+	Login(email, password, ip string) (*LoginResult, error)
+	LoginMFA(mfaToken, code, ip string) (*TokenPair, error)
+	Refresh(refreshToken string) (*TokenPair, error)
+	Logout(claims *JWTClaims, refreshToken string) error
+	VerifyEmail(token string) error
+	ResendVerification(userID int) error
+	ForgotPassword(email string) error
+	ResetPassword(token, password string) error
+	EnrollTOTP(userID int) (*TOTPEnrollment, error)
+	ConfirmTOTP(userID int, code string) error
+	DisableTOTP(userID int, code string) error
+}
+
 // AuthController handles authentication-related requests
 type AuthController struct {
-	authService *AuthService
+	authService Authenticator
+	auditLog    *AuditLog
 }
 
-func NewAuthController(authService *AuthService) *AuthController {
-	return &AuthController{authService: authService}
+func NewAuthController(authService Authenticator, auditLog *AuditLog) *AuthController {
+	return &AuthController{authService: authService, auditLog: auditLog}
 }
 
 // Register handles user registration
@@ -49,58 +74,185 @@ func (c *AuthController) Login(ctx *gin.Context) {
 		return
 	}
 
-	token, err := c.authService.Login(request.Email, request.Password)
+	result, err := c.authService.Login(request.Email, request.Password, ctx.ClientIP())
 	if err != nil {
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLoginFailed, Email: request.Email, Detail: err.Error()})
+		if respondTooManyAttempts(ctx, err) {
+			return
+		}
 		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"token": token})
+	// Logins waiting for a second factor are recorded once it is given
+	if result.Tokens != nil {
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLogin, UserID: &result.Tokens.UserID, Email: request.Email})
+	}
+
+	respondLogin(ctx, result)
 }
 
-// FileController handles file-related requests
-type FileController struct {
-	fileService *FileService
+// respondTooManyAttempts answers 429 with a Retry-After header when err is a
+// lockout, and reports whether it did
+func respondTooManyAttempts(ctx *gin.Context, err error) bool {
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) {
+		return false
+	}
+
+	seconds := int64(math.Ceil(lockout.RetryAfter.Seconds()))
+	ctx.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "retry_after": seconds})
+	return true
 }
 
-func NewFileController(fileService *FileService) *FileController {
-	return &FileController{fileService: fileService}
+// respondLogin sends the tokens of a completed login, or the challenge of
+// one waiting for a second factor
+func respondLogin(ctx *gin.Context, result *LoginResult) {
+	// Users with a second factor continue at POST /login/mfa
+	if result.MFAToken != "" {
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":     "mfa_required",
+			"mfa_token":  result.MFAToken,
+			"expires_in": int64(mfaChallengeTTL().Seconds()),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, result.Tokens)
 }
 
-// UploadFile handles file upload
-func (c *FileController) UploadFile(ctx *gin.Context) {
-	// Get user ID from context
-	userID, exists := ctx.Get("user_id")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+// recordAudit adds the client's IP address and user agent to event, and the
+// authenticated user unless the event names one, and records it
+func recordAudit(auditLog *AuditLog, ctx *gin.Context, event AuditEvent) {
+	if event.UserID == nil {
+		if userID, ok := ctx.Get("user_id"); ok {
+			id := userID.(int)
+			event.UserID = &id
+		}
+	}
+	event.IP = ctx.ClientIP()
+	event.UserAgent = ctx.Request.UserAgent()
+
+	auditLog.Record(&event)
+}
+
+// LoginMFA handles the second step of logging in with two-factor
+// authentication
+func (c *AuthController) LoginMFA(ctx *gin.Context) {
+	var request struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get file
-	file, err := ctx.FormFile("file")
+	tokens, err := c.authService.LoginMFA(request.MFAToken, request.Code, ctx.ClientIP())
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLoginFailed, Detail: "second factor: " + err.Error()})
+		if respondTooManyAttempts(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrInvalidMFAToken) || errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrAccountDisabled) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Upload file
-	uploadedFile, err := c.fileService.UploadFile(userID.(int), file)
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLogin, UserID: &tokens.UserID, Detail: "second factor"})
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// Refresh handles exchanging a refresh token for a new token pair
+func (c *AuthController) Refresh(ctx *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := c.authService.Refresh(request.RefreshToken)
 	if err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) || errors.Is(err, ErrAccountDisabled) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Return file metadata
-	ctx.JSON(http.StatusCreated, gin.H{
-		"id": uploadedFile.ID,
-		"filename": uploadedFile.OriginalFilename,
-		"size": uploadedFile.FileSize,
-		"url": "/files/" + strconv.Itoa(uploadedFile.ID),
-	})
+	ctx.JSON(http.StatusOK, tokens)
 }
 
-// GetUserFiles handles retrieval of user files
-func (c *FileController) GetUserFiles(ctx *gin.Context) {
+// Logout handles revoking the current access token and, when given, the
+// refresh token family it was issued with
+func (c *AuthController) Logout(ctx *gin.Context) {
+	// Get token claims from context
+	claims, exists := ctx.Get("claims")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// The refresh token is optional, so an empty body is fine
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.authService.Logout(claims.(*JWTClaims), request.RefreshToken); err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// VerifyEmail handles verification links, taking the token from the query
+// string or a JSON body
+func (c *AuthController) VerifyEmail(ctx *gin.Context) {
+	token := ctx.Query("token")
+	if token == "" {
+		var request struct {
+			Token string `json:"token"`
+		}
+		ctx.ShouldBindJSON(&request)
+		token = request.Token
+	}
+	if token == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+
+	if err := c.authService.VerifyEmail(token); err != nil {
+		if errors.Is(err, ErrInvalidUserToken) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerification handles sending a new verification link
+func (c *AuthController) ResendVerification(ctx *gin.Context) {
 	// Get user ID from context
 	userID, exists := ctx.Get("user_id")
 	if !exists {
@@ -108,37 +260,91 @@ func (c *FileController) GetUserFiles(ctx *gin.Context) {
 		return
 	}
 
-	// Check if search query is provided
-	searchQuery := ctx.Query("search")
-	var files []*File
-	var err error
+	if err := c.authService.ResendVerification(userID.(int)); err != nil {
+		if errors.Is(err, ErrEmailAlreadyVerified) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	if searchQuery != "" {
-		// Search files by name
-		files, err = c.fileService.SearchFiles(userID.(int), searchQuery)
-	} else {
-		// Get all user files
-		files, err = c.fileService.GetUserFiles(userID.(int))
+	ctx.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// ForgotPassword handles requests for a password reset link. The response
+// is the same whether or not the account exists.
+func (c *AuthController) ForgotPassword(ctx *gin.Context) {
+	var request struct {
+		Email string `json:"email" binding:"required,email"`
 	}
 
-	if err != nil {
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.authService.ForgotPassword(request.Email); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not send the password reset email"})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"message": "If an account exists for this email, a password reset link has been sent"})
+}
+
+// ResetPassword handles setting a new password with a reset token
+func (c *AuthController) ResetPassword(ctx *gin.Context) {
+	var request struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=6"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.authService.ResetPassword(request.Token, request.Password); err != nil {
+		if errors.Is(err, ErrInvalidUserToken) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Return files
-	ctx.JSON(http.StatusOK, gin.H{"files": files})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
 }
 
-// GetFile handles file retrieval
-func (c *FileController) GetFile(ctx *gin.Context) {
-	// Get file ID from URL
-	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+// EnrollTOTP handles starting two-factor authentication setup
+func (c *AuthController) EnrollTOTP(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	enrollment, err := c.authService.EnrollTOTP(userID.(int))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		ctx.JSON(mfaErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmTOTP handles turning on two-factor authentication with a first code
+func (c *AuthController) ConfirmTOTP(ctx *gin.Context) {
+	c.handleTOTPCode(ctx, c.authService.ConfirmTOTP, "Two-factor authentication enabled")
+}
+
+// DisableTOTP handles turning off two-factor authentication
+func (c *AuthController) DisableTOTP(ctx *gin.Context) {
+	c.handleTOTPCode(ctx, c.authService.DisableTOTP, "Two-factor authentication disabled")
+}
+
+func (c *AuthController) handleTOTPCode(ctx *gin.Context, action func(userID int, code string) error, message string) {
 	// Get user ID from context
 	userID, exists := ctx.Get("user_id")
 	if !exists {
@@ -146,57 +352,188 @@ func (c *FileController) GetFile(ctx *gin.Context) {
 		return
 	}
 
-	// Get file
-	file, err := c.fileService.GetFile(fileID, userID.(int))
+	var request struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := action(userID.(int), request.Code); err != nil {
+		ctx.JSON(mfaErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// mfaErrorStatus maps two-factor authentication errors to HTTP statuses
+func mfaErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidMFACode):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrMFAAlreadyEnabled), errors.Is(err, ErrMFANotEnrolled):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// AdminController handles administration requests
+type AdminController struct {
+	adminService *AdminService
+	loginLimiter *LoginLimiter
+	auditLog     *AuditLog
+}
+
+func NewAdminController(adminService *AdminService, loginLimiter *LoginLimiter, auditLog *AuditLog) *AdminController {
+	return &AdminController{adminService: adminService, loginLimiter: loginLimiter, auditLog: auditLog}
+}
+
+// GetUsers handles listing users a page at a time
+func (c *AdminController) GetUsers(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	users, total, err := c.adminService.ListUsers(limit, offset)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Return file
-	ctx.File(file.FilePath)
+	ctx.JSON(http.StatusOK, gin.H{"users": users, "total": total, "limit": limit, "offset": offset})
 }
 
-// ShareFile handles file sharing
-func (c *FileController) ShareFile(ctx *gin.Context) {
-	// Get file ID from URL
-	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+// SetRole handles changing a user's role
+func (c *AdminController) SetRole(ctx *gin.Context) {
+	targetID, err := strconv.Atoi(ctx.Param("user_id"))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	// Get user ID from context
-	userID, exists := ctx.Get("user_id")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	var request struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Share file
-	url, err := c.fileService.ShareFile(fileID, userID.(int))
+	user, err := c.adminService.SetRole(ctx.GetInt("user_id"), targetID, request.Role)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		respondAdminError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, user)
+}
+
+// DisableUser handles disabling an account
+func (c *AdminController) DisableUser(ctx *gin.Context) {
+	targetID, err := strconv.Atoi(ctx.Param("user_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	user, err := c.adminService.DisableUser(ctx.GetInt("user_id"), targetID)
+	if err != nil {
+		respondAdminError(ctx, err)
 		return
 	}
 
-	// Return file URL
-	ctx.JSON(http.StatusOK, gin.H{"url": url})
+	ctx.JSON(http.StatusOK, user)
 }
 
+// EnableUser handles re-enabling a disabled account
+func (c *AdminController) EnableUser(ctx *gin.Context) {
+	targetID, err := strconv.Atoi(ctx.Param("user_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
 
+	user, err := c.adminService.EnableUser(targetID)
+	if err != nil {
+		respondAdminError(ctx, err)
+		return
+	}
 
-// controllers.go (continued)
+	ctx.JSON(http.StatusOK, user)
+}
 
-// DeleteFile handles file deletion
-func (c *FileController) DeleteFile(ctx *gin.Context) {
-	// Get file ID from URL
+// GetFile handles viewing the metadata of any user's file
+func (c *AdminController) GetFile(ctx *gin.Context) {
 	fileID, err := strconv.Atoi(ctx.Param("file_id"))
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
 		return
 	}
 
+	file, err := c.adminService.GetFile(fileID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, file)
+}
+
+// DeleteFile handles permanently deleting any user's file
+func (c *AdminController) DeleteFile(ctx *gin.Context) {
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	if err := c.adminService.ForceDeleteFile(fileID); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditDelete, FileID: &fileID, Detail: "purged by administrator"})
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "File permanently deleted"})
+}
+
+// respondAdminError maps admin service errors to status codes
+func respondAdminError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidRole), errors.Is(err, ErrAdminSelfEdit):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetLockouts handles listing the accounts and IP addresses whose logins are
+// currently refused
+func (c *AdminController) GetLockouts(ctx *gin.Context) {
+	lockouts, err := c.loginLimiter.Lockouts()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// Unlock handles lifting the lockout of an account, an IP address or both
+func (c *AdminController) Unlock(ctx *gin.Context) {
 	// Get user ID from context
 	userID, exists := ctx.Get("user_id")
 	if !exists {
@@ -204,13 +541,1924 @@ func (c *FileController) DeleteFile(ctx *gin.Context) {
 		return
 	}
 
-	// Delete file
-	err = c.fileService.DeleteFile(fileID, userID.(int))
+	var request struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Email == "" && request.IP == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "email or ip is required"})
+		return
+	}
+
+	if err := c.loginLimiter.Unlock(request.Email, request.IP, userID.(int)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Lockout lifted"})
+}
+
+// GetAudit handles searching the audit log, newest events first. With format
+// csv or jsonl every matching event is streamed as a download instead of a
+// page being returned.
+func (c *AdminController) GetAudit(ctx *gin.Context) {
+	filter, err := parseAuditFilter(ctx)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Return success message
-	ctx.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
-}
\ No newline at end of file
+	// Exports ignore paging
+	format := ctx.DefaultQuery("format", "json")
+	if format != "json" {
+		c.exportAudit(ctx, filter, format)
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	events, err := c.auditLog.Find(filter, limit, offset)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"events": events, "limit": limit, "offset": offset})
+}
+
+// exportAudit streams the matching audit events as a CSV or JSON Lines file
+func (c *AdminController) exportAudit(ctx *gin.Context, filter AuditFilter, format string) {
+	encoder, err := newAuditEncoder(ctx.Writer, format)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", auditExportFormats[format])
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "audit." + format}))
+	ctx.Status(http.StatusOK)
+
+	// The status has been sent by the time an error can happen, so a failed
+	// export can only be cut short
+	err = c.auditLog.Export(filter, func(event *AuditEvent) error {
+		return encoder.Encode(event)
+	})
+	if err == nil {
+		err = encoder.Flush()
+	}
+	if err != nil {
+		log.Printf("Audit export failed: %v", err)
+	}
+}
+
+// parseAuditFilter reads the audit log filters from the query string. Times
+// are RFC 3339; since is inclusive and until exclusive.
+func parseAuditFilter(ctx *gin.Context) (AuditFilter, error) {
+	filter := AuditFilter{Action: ctx.Query("action"), IP: ctx.Query("ip")}
+
+	if value := ctx.Query("user_id"); value != "" {
+		userID, err := strconv.Atoi(value)
+		if err != nil {
+			return AuditFilter{}, errors.New("Invalid user ID")
+		}
+		filter.UserID = &userID
+	}
+
+	if value := ctx.Query("file_id"); value != "" {
+		fileID, err := strconv.Atoi(value)
+		if err != nil {
+			return AuditFilter{}, errors.New("Invalid file ID")
+		}
+		filter.FileID = &fileID
+	}
+
+	for name, target := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := ctx.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return AuditFilter{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*target = &t
+		}
+	}
+
+	return filter, nil
+}
+
+// JWKSController publishes the keys that verify our access tokens
+type JWKSController struct {
+	keys *KeyRing
+}
+
+func NewJWKSController(keys *KeyRing) *JWKSController {
+	return &JWKSController{keys: keys}
+}
+
+// JWKS handles serving the public signing keys as a JSON Web Key Set
+func (c *JWKSController) JWKS(ctx *gin.Context) {
+	// Verifiers may cache the set, but not for longer than a key rotation takes
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, c.keys.JWKS())
+}
+
+// OIDCController handles single sign-on through an OpenID Connect provider
+type OIDCController struct {
+	oidcService *OIDCService
+	auditLog    *AuditLog
+}
+
+func NewOIDCController(oidcService *OIDCService, auditLog *AuditLog) *OIDCController {
+	return &OIDCController{oidcService: oidcService, auditLog: auditLog}
+}
+
+// Login handles starting a single sign-on login. Browsers are redirected to
+// the identity provider; clients asking for JSON get the URL instead.
+func (c *OIDCController) Login(ctx *gin.Context) {
+	authURL, err := c.oidcService.StartLogin()
+	if err != nil {
+		log.Printf("Failed to start single sign-on: %v", err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+		return
+	}
+
+	if ctx.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		ctx.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+		return
+	}
+
+	ctx.Redirect(http.StatusFound, authURL)
+}
+
+// Callback handles the identity provider redirecting back after login and
+// responds like POST /login
+func (c *OIDCController) Callback(ctx *gin.Context) {
+	// The provider reports refused or failed logins as query parameters
+	if providerError := ctx.Query("error"); providerError != "" {
+		message := ctx.Query("error_description")
+		if message == "" {
+			message = providerError
+		}
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": message})
+		return
+	}
+
+	state := ctx.Query("state")
+	code := ctx.Query("code")
+	if state == "" || code == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "state and code are required"})
+		return
+	}
+
+	result, err := c.oidcService.FinishLogin(state, code)
+	if err != nil {
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLoginFailed, Detail: "single sign-on: " + err.Error()})
+		switch {
+		case errors.Is(err, ErrOIDCStateInvalid):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrOIDCEmailRequired):
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			log.Printf("Single sign-on failed: %v", err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		}
+		return
+	}
+
+	if result.Tokens != nil {
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditLogin, UserID: &result.Tokens.UserID, Detail: "single sign-on"})
+	}
+
+	respondLogin(ctx, result)
+}
+
+// FileController handles file-related requests
+type FileController struct {
+	fileService   *FileService
+	folderService *FolderService
+	auditLog      *AuditLog
+}
+
+func NewFileController(fileService *FileService, folderService *FolderService, auditLog *AuditLog) *FileController {
+	return &FileController{fileService: fileService, folderService: folderService, auditLog: auditLog}
+}
+
+// UploadFile handles file upload
+func (c *FileController) UploadFile(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get file, reading no more than the largest upload allows
+	limitUploadBody(ctx, c.fileService.MaxUploadSize())
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	// Optional target folder
+	folderID, err := parseFolderID(ctx.PostForm("folder_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Optional team whose workspace gets the file
+	teamID, err := parseTeamID(ctx.PostForm("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Optional client-supplied checksums, hex encoded
+	opts := UploadOptions{
+		FolderID: folderID,
+		TeamID:   teamID,
+		Checksums: Checksums{
+			SHA256: ctx.PostForm("sha256"),
+			MD5:    ctx.PostForm("md5"),
+		},
+	}
+
+	// Upload file
+	uploadedFile, err := c.fileService.UploadFile(userID.(int), file, opts)
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if respondTeamAccessError(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrFolderNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUpload, FileID: &uploadedFile.ID, Detail: uploadedFile.OriginalFilename})
+
+	// Return file metadata
+	ctx.JSON(http.StatusCreated, gin.H{
+		"id":       uploadedFile.ID,
+		"filename": uploadedFile.OriginalFilename,
+		"size":     uploadedFile.FileSize,
+		"url":      "/files/" + strconv.Itoa(uploadedFile.ID),
+		"sha256":   uploadedFile.ContentHash,
+		"md5":      uploadedFile.ContentMD5,
+	})
+}
+
+// UploadFiles handles uploading several files in one request
+func (c *FileController) UploadFiles(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get files, reading no more than the largest batch allows
+	limitUploadBody(ctx, c.fileService.MaxBatchUploadSize())
+	form, err := ctx.MultipartForm()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": ErrBatchTooLarge.Error()})
+		return
+	}
+	if err != nil || len(form.File["files"]) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "At least one file is required in the files field"})
+		return
+	}
+	if err := c.fileService.CheckBatch(len(form.File["files"])); err != nil {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Upload files
+	results := c.fileService.UploadFilesAsync(userID.(int), form.File["files"])
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			continue
+		}
+		fileID := result.ID
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUpload, FileID: &fileID, Detail: result.Filename})
+	}
+
+	// Report per-file results; 207 signals that some uploads failed
+	status := http.StatusCreated
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	ctx.JSON(status, gin.H{
+		"files":    results,
+		"uploaded": len(results) - failed,
+		"failed":   failed,
+	})
+}
+
+// GetUserFiles handles retrieval of user files
+func (c *FileController) GetUserFiles(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// List a team's workspace rather than the user's own when one is given
+	teamID, err := parseTeamID(ctx.Query("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if search query is provided
+	searchQuery := ctx.Query("search")
+	var files []*File
+
+	// List a single folder when one is requested
+	if folderParam, ok := ctx.GetQuery("folder_id"); ok {
+		c.getFolderContents(ctx, userID.(int), teamID, folderParam, searchQuery)
+		return
+	}
+
+	if searchQuery != "" {
+		// Search files by name
+		files, err = c.fileService.SearchFiles(userID.(int), teamID, searchQuery)
+	} else {
+		// Get all files of the workspace
+		files, err = c.fileService.GetUserFiles(userID.(int), teamID)
+	}
+
+	if err != nil {
+		if respondTeamAccessError(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Return files
+	ctx.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// getFolderContents responds with the files and subfolders of one folder
+// together with the breadcrumbs leading to it
+func (c *FileController) getFolderContents(ctx *gin.Context, userID int, teamID *int, folderParam, searchQuery string) {
+	folderID, err := parseFolderID(folderParam)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	breadcrumbs := []*Folder{}
+	if folderID != nil {
+		breadcrumbs, err = c.folderService.Breadcrumbs(*folderID, userID)
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	files, err := c.fileService.GetFolderFiles(userID, teamID, folderID, searchQuery)
+	if err != nil {
+		if respondTeamAccessError(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrFolderNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	folders, err := c.folderService.GetSubfolders(userID, teamID, folderID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"folder_id":   folderID,
+		"breadcrumbs": breadcrumbs,
+		"folders":     folders,
+		"files":       files,
+	})
+}
+
+// GetFile handles file retrieval
+func (c *FileController) GetFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get file
+	file, err := c.fileService.GetFile(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.serveFile(ctx, file, file.OriginalFilename)
+}
+
+// VerifyFile handles rehashing a stored file to detect corruption
+func (c *FileController) VerifyFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Verify file
+	result, err := c.fileService.VerifyFile(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, result)
+}
+
+// UploadVersion handles uploading a new version of an existing file
+func (c *FileController) UploadVersion(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get file, reading no more than the largest upload allows
+	limitUploadBody(ctx, c.fileService.MaxUploadSize())
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	expected := Checksums{
+		SHA256: ctx.PostForm("sha256"),
+		MD5:    ctx.PostForm("md5"),
+	}
+
+	// Upload version
+	file, err := c.fileService.UploadVersion(fileID, userID.(int), fileHeader, expected)
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUpload, FileID: &file.ID, Detail: fmt.Sprintf("%s, version %d", file.OriginalFilename, file.Version)})
+	ctx.JSON(http.StatusOK, file)
+}
+
+// GetVersions handles listing a file's versions
+func (c *FileController) GetVersions(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get versions
+	versions, err := c.fileService.GetVersions(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+// GetVersion handles downloading a specific version of a file
+func (c *FileController) GetVersion(ctx *gin.Context) {
+	// Get file ID and version from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+	version, err := strconv.Atoi(ctx.Param("version"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Get version
+	file, err := c.fileService.GetVersion(fileID, userID.(int), version)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.serveFile(ctx, file, fmt.Sprintf("%s, version %d", file.OriginalFilename, version))
+}
+
+// RestoreVersion handles making an earlier version current again
+func (c *FileController) RestoreVersion(ctx *gin.Context) {
+	// Get file ID and version from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+	version, err := strconv.Atoi(ctx.Param("version"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Restore version
+	file, err := c.fileService.RestoreVersion(fileID, userID.(int), version)
+	if err != nil {
+		if respondQuotaExceeded(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, file)
+}
+
+// MoveFile handles moving a file into another folder
+func (c *FileController) MoveFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		FolderID *int `json:"folder_id"` // Null moves the file to the root
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Move file
+	if err := c.fileService.MoveFile(fileID, userID.(int), request.FolderID); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "File moved successfully"})
+}
+
+// ShareFile handles file sharing
+func (c *FileController) ShareFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Share options are optional; GET requests use the defaults
+	var request struct {
+		ExpiresIn    int    `json:"expires_in" binding:"min=0"`    // Seconds
+		MaxDownloads int    `json:"max_downloads" binding:"min=0"` // Zero means unlimited
+		Password     string `json:"password" binding:"omitempty,min=6"`
+	}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Share file
+	share, err := c.fileService.ShareFile(fileID, userID.(int), ShareOptions{
+		ExpiresIn:    time.Duration(request.ExpiresIn) * time.Second,
+		MaxDownloads: request.MaxDownloads,
+		Password:     request.Password,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditShare, FileID: &fileID, Detail: fmt.Sprintf("link %d", share.ID)})
+
+	// Return share URL
+	ctx.JSON(http.StatusOK, gin.H{
+		"url":                "/s/" + share.Token,
+		"token":              share.Token,
+		"expires_at":         share.ExpiresAt,
+		"max_downloads":      share.MaxDownloads,
+		"password_protected": share.HasPassword(),
+	})
+}
+
+// RevokeShare handles revoking a share link
+func (c *FileController) RevokeShare(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Revoke share
+	share, err := c.fileService.RevokeShare(ctx.Param("token"), userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUnshare, FileID: &share.FileID, Detail: fmt.Sprintf("link %d", share.ID)})
+
+	// Return success message
+	ctx.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// GetGrants handles listing who a file is shared with
+func (c *FileController) GetGrants(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	grants, err := c.fileService.GetGrants(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"grants": grants})
+}
+
+// GrantAccess handles sharing a file with another registered user
+func (c *FileController) GrantAccess(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	grant, err := c.fileService.GrantAccess(fileID, userID.(int), request.Email, request.Role)
+	if err != nil {
+		if errors.Is(err, ErrInvalidGrantRole) || errors.Is(err, ErrGrantToSelf) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditShare, FileID: &fileID, Detail: fmt.Sprintf("%s as %s", grant.Email, grant.Role)})
+	ctx.JSON(http.StatusCreated, grant)
+}
+
+// RevokeGrant handles stopping sharing a file with a user
+func (c *FileController) RevokeGrant(ctx *gin.Context) {
+	// Get file and grantee IDs from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+	granteeID, err := strconv.Atoi(ctx.Param("user_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := c.fileService.RevokeGrant(fileID, userID.(int), granteeID); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUnshare, FileID: &fileID, Detail: fmt.Sprintf("user %d", granteeID)})
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
+
+// GetSharedWithMe handles listing the files other users shared with the user
+func (c *FileController) GetSharedWithMe(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	files, err := c.fileService.GetSharedWithMe(userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// DownloadShare handles unauthenticated downloads through a share link.
+// Password protected links are downloaded with a POST carrying the password.
+func (c *FileController) DownloadShare(ctx *gin.Context) {
+	var request struct {
+		Password string `json:"password" form:"password"`
+	}
+	if ctx.Request.Method == http.MethodPost {
+		if err := ctx.ShouldBind(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Resolve the share token
+	share, file, err := c.fileService.OpenShare(ctx.Param("token"), request.Password, ctx.ClientIP())
+	if err != nil {
+		respondShareError(ctx, err)
+		return
+	}
+
+	// Open the contents first, so a storage failure does not use up a download
+	content, err := c.fileService.OpenFile(file)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	// A link with a download limit answers every GET with the whole file and
+	// counts it before sending anything, so ranged and conditional requests
+	// cannot fetch the file piecemeal without using up downloads
+	limited := share.MaxDownloads != nil
+	if limited && ctx.Request.Method != http.MethodHead {
+		requireWholeFile(ctx.Request)
+		if err := c.fileService.CountShareDownload(share); err != nil {
+			respondShareError(ctx, err)
+			return
+		}
+	}
+
+	delivered := c.serveContent(ctx, file, content, file.OriginalFilename+", share link")
+
+	// Other links only keep a tally, of the responses that carried content
+	if !limited && delivered {
+		if err := c.fileService.CountShareDownload(share); err != nil {
+			log.Printf("Failed to count download of share %d: %v", share.ID, err)
+		}
+	}
+}
+
+// respondShareError maps the errors of opening a share link to status codes
+func respondShareError(ctx *gin.Context, err error) {
+	switch {
+	case respondTooManyAttempts(ctx, err):
+	case errors.Is(err, ErrShareExpired):
+		ctx.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrSharePasswordRequired):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "password_required": true})
+	case errors.Is(err, ErrSharePasswordInvalid):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "password_required": true})
+	default:
+		ctx.JSON(http.StatusNotFound, gin.H{"error": ErrShareNotFound.Error()})
+	}
+}
+
+// serveFile streams a file's contents from storage with serveContent and
+// reports whether a download was sent
+func (c *FileController) serveFile(ctx *gin.Context, file *File, detail string) bool {
+	// Open file contents from storage
+	content, err := c.fileService.OpenFile(file)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	defer content.Close()
+
+	return c.serveContent(ctx, file, content, detail)
+}
+
+// serveContent sends a file's opened contents. Range requests and
+// conditional requests are answered by http.ServeContent using the ETag
+// derived from the content hash and the time the contents were stored.
+// Every response carrying content, whole or partial, is audited as a
+// download described by detail; serveContent reports whether there was one.
+func (c *FileController) serveContent(ctx *gin.Context, file *File, content io.ReadSeeker, detail string) bool {
+	header := ctx.Writer.Header()
+	if file.ContentHash != "" {
+		header.Set("ETag", `"`+file.ContentHash+`"`)
+	}
+	if file.MimeType != "" {
+		header.Set("Content-Type", file.MimeType)
+	}
+	disposition := "attachment"
+	if inlineSafe(file.MimeType) {
+		disposition = "inline"
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.OriginalFilename}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "private, no-cache")
+
+	// Return file
+	http.ServeContent(ctx.Writer, ctx.Request, file.OriginalFilename, file.ModifiedAt(), content)
+
+	// Not modified, failed preconditions and unsatisfiable ranges sent nothing
+	status := ctx.Writer.Status()
+	if ctx.Request.Method == http.MethodHead || (status != http.StatusOK && status != http.StatusPartialContent) {
+		return false
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditDownload, FileID: &file.ID, Detail: detail})
+	c.fileService.RecordDownload(file, ctx.GetInt("user_id"))
+	return true
+}
+
+// inlineSafe reports whether browsers may display a file of mimeType in
+// place. Anything that can run script in the site's origin, such as HTML or
+// SVG, is downloaded instead.
+func inlineSafe(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	return mediaType == "application/pdf" || mediaType == "text/plain"
+}
+
+// GetUsage handles reporting the user's storage usage and quota
+func (c *FileController) GetUsage(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	usage, err := c.fileService.GetUsage(userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, usage)
+}
+
+// respondQuotaExceeded answers with 413 and the space left when err is a
+// QuotaError, reporting whether it did
+func respondQuotaExceeded(ctx *gin.Context, err error) bool {
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+
+	ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":           quotaErr.Error(),
+		"quota_bytes":     quotaErr.Quota,
+		"used_bytes":      quotaErr.Used,
+		"remaining_bytes": quotaErr.Remaining(),
+	})
+	return true
+}
+
+// multipartOverhead is the room left in an upload request for form fields
+// and part headers on top of the file itself
+const multipartOverhead = 1 << 20
+
+// limitUploadBody caps the request body so oversized uploads are cut off
+// while they stream in. A maxSize of zero leaves the body unlimited.
+func limitUploadBody(ctx *gin.Context, maxSize int64) {
+	if maxSize > 0 {
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxSize+multipartOverhead)
+	}
+}
+
+// respondUploadRejected answers with a 4xx when err means the upload breaks
+// the upload policy or the user's quota, reporting whether it did
+func respondUploadRejected(ctx *gin.Context, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case respondQuotaExceeded(ctx, err):
+	case errors.Is(err, ErrFileTooLarge):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.As(err, &maxBytesErr):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": ErrFileTooLarge.Error()})
+	case errors.Is(err, ErrFileTypeNotAllowed):
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// parseFolderID parses a folder_id parameter; empty and "root" mean the root
+func parseFolderID(value string) (*int, error) {
+	if value == "" || value == "root" {
+		return nil, nil
+	}
+
+	folderID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errors.New("Invalid folder ID")
+	}
+
+	return &folderID, nil
+}
+
+// parseTeamID parses a team_id parameter; empty means the user's own
+// workspace
+func parseTeamID(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	teamID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errors.New("Invalid team ID")
+	}
+
+	return &teamID, nil
+}
+
+// respondTeamAccessError answers with 404 or 403 when err means the user is
+// not in the team or may not change its files, reporting whether it did
+func respondTeamAccessError(ctx *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, ErrTeamNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrTeamReadOnly):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// requireWholeFile drops a request's range and conditional headers, so that
+// http.ServeContent answers it with the whole file
+func requireWholeFile(r *http.Request) {
+	for _, name := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		r.Header.Del(name)
+	}
+}
+
+// controllers.go (continued)
+
+// DeleteFile handles file deletion
+func (c *FileController) DeleteFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Delete file
+	err = c.fileService.DeleteFile(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditDelete, FileID: &fileID, Detail: "moved to trash"})
+
+	// Return success message
+	ctx.JSON(http.StatusOK, gin.H{"message": "File moved to trash"})
+}
+
+// GetTrash handles listing the files in the trash
+func (c *FileController) GetTrash(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// A team's trash rather than the user's own when one is given
+	teamID, err := parseTeamID(ctx.Query("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get trashed files
+	files, err := c.fileService.GetTrash(userID.(int), teamID)
+	if err != nil {
+		if respondTeamAccessError(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// RestoreFile handles taking a file out of the trash
+func (c *FileController) RestoreFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Restore file
+	file, err := c.fileService.RestoreFile(fileID, userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, file)
+}
+
+// PurgeFile handles permanently deleting a file from the trash
+func (c *FileController) PurgeFile(ctx *gin.Context) {
+	// Get file ID from URL
+	fileID, err := strconv.Atoi(ctx.Param("file_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Purge file
+	if err := c.fileService.PurgeFile(fileID, userID.(int)); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditDelete, FileID: &fileID, Detail: "purged"})
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "File deleted permanently"})
+}
+
+// tusVersion is the tus protocol version implemented by TusController
+const tusVersion = "1.0.0"
+
+// TusController handles resumable uploads using the tus protocol
+type TusController struct {
+	tusService *TusService
+	auditLog   *AuditLog
+}
+
+func NewTusController(tusService *TusService, auditLog *AuditLog) *TusController {
+	return &TusController{tusService: tusService, auditLog: auditLog}
+}
+
+// RequireTusResumable rejects requests for an unsupported protocol version
+func (c *TusController) RequireTusResumable() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method == http.MethodOptions {
+			ctx.Next()
+			return
+		}
+
+		ctx.Header("Tus-Resumable", tusVersion)
+		if ctx.GetHeader("Tus-Resumable") != tusVersion {
+			ctx.Header("Tus-Version", tusVersion)
+			ctx.AbortWithStatus(http.StatusPreconditionFailed)
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// Options handles tus capability discovery
+func (c *TusController) Options(ctx *gin.Context) {
+	ctx.Header("Tus-Resumable", tusVersion)
+	ctx.Header("Tus-Version", tusVersion)
+	ctx.Header("Tus-Extension", "creation,termination,expiration")
+	if maxSize := c.tusService.MaxSize(); maxSize > 0 {
+		ctx.Header("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// CreateUpload handles the tus creation extension
+func (c *TusController) CreateUpload(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	length, err := strconv.ParseInt(ctx.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Valid Upload-Length header is required"})
+		return
+	}
+
+	// Create upload
+	upload, err := c.tusService.CreateUpload(userID.(int), length, ctx.GetHeader("Upload-Metadata"))
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrUploadTooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Empty files are complete as soon as they are created
+	if upload.Length == 0 {
+		_, file, err := c.tusService.WriteChunk(upload.ID, upload.UserID, 0, http.NoBody)
+		if err != nil {
+			if respondUploadRejected(ctx, err) {
+				return
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUpload, FileID: &file.ID, Detail: file.OriginalFilename + ", resumable upload"})
+		ctx.Header("Upload-File-Id", strconv.Itoa(file.ID))
+	}
+
+	ctx.Header("Location", "/tus/"+upload.ID)
+	ctx.Header("Upload-Offset", "0")
+	ctx.Header("Upload-Expires", c.tusService.ExpiresAt(upload).UTC().Format(http.TimeFormat))
+	ctx.Status(http.StatusCreated)
+}
+
+// GetOffset handles HEAD requests reporting how much of an upload has arrived
+func (c *TusController) GetOffset(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.Status(http.StatusUnauthorized)
+		return
+	}
+
+	upload, err := c.tusService.GetUpload(ctx.Param("upload_id"), userID.(int))
+	if err != nil {
+		ctx.Status(http.StatusNotFound)
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	ctx.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	ctx.Header("Upload-Expires", c.tusService.ExpiresAt(upload).UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		ctx.Header("Upload-Metadata", upload.Metadata)
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// WriteChunk handles PATCH requests appending data to an upload
+func (c *TusController) WriteChunk(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if ctx.ContentType() != "application/offset+octet-stream" {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Valid Upload-Offset header is required"})
+		return
+	}
+
+	// Write chunk
+	upload, file, err := c.tusService.WriteChunk(ctx.Param("upload_id"), userID.(int), offset, ctx.Request.Body)
+	if err != nil {
+		if respondUploadRejected(ctx, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, ErrUploadNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUploadOffsetMismatch):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUploadExpired):
+			ctx.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if file != nil {
+		recordAudit(c.auditLog, ctx, AuditEvent{Action: AuditUpload, FileID: &file.ID, Detail: file.OriginalFilename + ", resumable upload"})
+		ctx.Header("Upload-File-Id", strconv.Itoa(file.ID))
+	} else {
+		ctx.Header("Upload-Expires", c.tusService.ExpiresAt(upload).UTC().Format(http.TimeFormat))
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// Terminate handles the tus termination extension
+func (c *TusController) Terminate(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := c.tusService.Terminate(ctx.Param("upload_id"), userID.(int)); err != nil {
+		if errors.Is(err, ErrUploadNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// FolderController handles folder-related requests
+type FolderController struct {
+	folderService *FolderService
+}
+
+func NewFolderController(folderService *FolderService) *FolderController {
+	return &FolderController{folderService: folderService}
+}
+
+// CreateFolder handles folder creation
+func (c *FolderController) CreateFolder(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Name     string `json:"name" binding:"required"`
+		ParentID *int   `json:"parent_id"`
+		TeamID   *int   `json:"team_id"` // Null creates the folder in the user's own workspace
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Create folder
+	folder, err := c.folderService.CreateFolder(userID.(int), request.TeamID, request.ParentID, request.Name)
+	if err != nil {
+		ctx.JSON(folderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, folder)
+}
+
+// RenameFolder handles renaming a folder
+func (c *FolderController) RenameFolder(ctx *gin.Context) {
+	// Get folder ID from URL
+	folderID, err := strconv.Atoi(ctx.Param("folder_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Rename folder
+	folder, err := c.folderService.RenameFolder(folderID, userID.(int), request.Name)
+	if err != nil {
+		ctx.JSON(folderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, folder)
+}
+
+// MoveFolder handles moving a folder under another parent
+func (c *FolderController) MoveFolder(ctx *gin.Context) {
+	// Get folder ID from URL
+	folderID, err := strconv.Atoi(ctx.Param("folder_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		ParentID *int `json:"parent_id"` // Null moves the folder to the root
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Move folder
+	folder, err := c.folderService.MoveFolder(folderID, userID.(int), request.ParentID)
+	if err != nil {
+		ctx.JSON(folderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, folder)
+}
+
+// DeleteFolder handles deleting an empty folder
+func (c *FolderController) DeleteFolder(ctx *gin.Context) {
+	// Get folder ID from URL
+	folderID, err := strconv.Atoi(ctx.Param("folder_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Delete folder
+	if err := c.folderService.DeleteFolder(folderID, userID.(int)); err != nil {
+		ctx.JSON(folderErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Folder deleted successfully"})
+}
+
+// folderErrorStatus maps folder errors to HTTP status codes
+func folderErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrFolderNotFound), errors.Is(err, ErrTeamNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTeamReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, ErrFolderExists), errors.Is(err, ErrFolderNotEmpty), errors.Is(err, ErrFolderCycle):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// TeamController handles team and membership requests
+type TeamController struct {
+	teamService *TeamService
+}
+
+func NewTeamController(teamService *TeamService) *TeamController {
+	return &TeamController{teamService: teamService}
+}
+
+// GetTeams handles listing the user's teams
+func (c *TeamController) GetTeams(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	teams, err := c.teamService.GetTeams(userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"teams": teams})
+}
+
+// CreateTeam handles creating a team owned by the user
+func (c *TeamController) CreateTeam(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	team, err := c.teamService.CreateTeam(userID.(int), request.Name)
+	if err != nil {
+		ctx.JSON(teamErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, team)
+}
+
+// GetMembers handles listing a team's members
+func (c *TeamController) GetMembers(ctx *gin.Context) {
+	// Get team ID from URL
+	teamID, err := strconv.Atoi(ctx.Param("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	members, err := c.teamService.GetMembers(teamID, userID.(int))
+	if err != nil {
+		ctx.JSON(teamErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// AddMember handles inviting a registered user into a team or changing a
+// member's role
+func (c *TeamController) AddMember(ctx *gin.Context) {
+	// Get team ID from URL
+	teamID, err := strconv.Atoi(ctx.Param("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := c.teamService.AddMember(teamID, userID.(int), request.Email, request.Role)
+	if err != nil {
+		ctx.JSON(teamErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, member)
+}
+
+// RemoveMember handles removing a member from a team, or leaving it
+func (c *TeamController) RemoveMember(ctx *gin.Context) {
+	// Get team and member IDs from URL
+	teamID, err := strconv.Atoi(ctx.Param("team_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+		return
+	}
+	memberID, err := strconv.Atoi(ctx.Param("user_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := c.teamService.RemoveMember(teamID, userID.(int), memberID); err != nil {
+		ctx.JSON(teamErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// teamErrorStatus maps team errors to HTTP status codes
+func teamErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTeamNotFound), errors.Is(err, ErrTeamMemberNotFound), errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotTeamOwner):
+		return http.StatusForbidden
+	case errors.Is(err, ErrLastTeamOwner):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidTeamName), errors.Is(err, ErrInvalidTeamRole):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// APIKeyController handles personal API key requests
+type APIKeyController struct {
+	apiKeyService *APIKeyService
+}
+
+func NewAPIKeyController(apiKeyService *APIKeyService) *APIKeyController {
+	return &APIKeyController{apiKeyService: apiKeyService}
+}
+
+// GetAPIKeys handles listing the user's API keys
+func (c *APIKeyController) GetAPIKeys(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keys, err := c.apiKeyService.GetAPIKeys(userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// CreateAPIKey handles creating an API key. The key itself is only part of
+// this response.
+func (c *APIKeyController) CreateAPIKey(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes" binding:"required"`
+		ExpiresIn int      `json:"expires_in" binding:"min=0"` // Seconds; zero means the key never expires
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, rawKey, err := c.apiKeyService.CreateAPIKey(userID.(int), request.Name, request.Scopes, time.Duration(request.ExpiresIn)*time.Second)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"api_key": key,
+		"key":     rawKey,
+	})
+}
+
+// DeleteAPIKey handles revoking an API key
+func (c *APIKeyController) DeleteAPIKey(ctx *gin.Context) {
+	// Get key ID from URL
+	keyID, err := strconv.Atoi(ctx.Param("key_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := c.apiKeyService.DeleteAPIKey(keyID, userID.(int)); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "API key deleted"})
+}
+
+// WebhookController handles webhook requests
+type WebhookController struct {
+	webhookService *WebhookService
+}
+
+func NewWebhookController(webhookService *WebhookService) *WebhookController {
+	return &WebhookController{webhookService: webhookService}
+}
+
+// GetWebhooks handles listing the user's webhooks
+func (c *WebhookController) GetWebhooks(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	webhooks, err := c.webhookService.GetWebhooks(userID.(int))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// CreateWebhook handles registering a webhook. The signing secret is only
+// part of this response.
+func (c *WebhookController) CreateWebhook(ctx *gin.Context) {
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhook, secret, err := c.webhookService.CreateWebhook(userID.(int), request.URL, request.Events)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidWebhookURL), errors.Is(err, ErrInvalidWebhookEvent):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrTooManyWebhooks):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// DeleteWebhook handles removing a webhook
+func (c *WebhookController) DeleteWebhook(ctx *gin.Context) {
+	// Get webhook ID from URL
+	webhookID, err := strconv.Atoi(ctx.Param("webhook_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := c.webhookService.DeleteWebhook(webhookID, userID.(int)); err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// GetDeliveries handles listing a webhook's deliveries a page at a time,
+// newest first
+func (c *WebhookController) GetDeliveries(ctx *gin.Context) {
+	// Get webhook ID from URL
+	webhookID, err := strconv.Atoi(ctx.Param("webhook_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	// Get user ID from context
+	userID, exists := ctx.Get("user_id")
+	if !exists {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	deliveries, err := c.webhookService.GetDeliveries(webhookID, userID.(int), limit, offset)
+	if err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "limit": limit, "offset": offset})
+}
+
+// respondWebhookError maps webhook service errors to status codes
+func respondWebhookError(ctx *gin.Context, err error) {
+	if errors.Is(err, ErrWebhookNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
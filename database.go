@@ -3,12 +3,37 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// DBTX is implemented by both *sql.DB and *sql.Tx, so repositories built on
+// it can run inside a transaction
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn inside a transaction, committing when fn returns nil and
+// rolling back otherwise
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // InitDB initializes the database connection
 func InitDB() (*sql.DB, error) {
 	dbHost := os.Getenv("DB_HOST")
@@ -52,11 +77,120 @@ func createTables(db *sql.DB) error {
 		id INT AUTO_INCREMENT PRIMARY KEY,
 		email VARCHAR(255) NOT NULL UNIQUE,
 		password VARCHAR(255) NOT NULL,
+		used_bytes BIGINT NOT NULL DEFAULT 0,
+		email_verified_at TIMESTAMP NULL,
+		totp_secret VARCHAR(64) NOT NULL DEFAULT '',
+		totp_enabled_at TIMESTAMP NULL,
+		totp_last_step BIGINT NOT NULL DEFAULT 0,
+		role VARCHAR(16) NOT NULL DEFAULT 'user',
+		disabled_at TIMESTAMP NULL,
+		token_generation INT NOT NULL DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);`)
 	if err != nil {
 		return err
 	}
+	if err = addColumn(db, "users", "email_verified_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "totp_secret", "VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "totp_enabled_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "totp_last_step", "BIGINT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "role", "VARCHAR(16) NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "disabled_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "users", "token_generation", "INT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Create teams table for workspaces shared by several users
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS teams (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		created_by INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create team_members table holding each member's role in a team
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS team_members (
+		team_id INT NOT NULL,
+		user_id INT NOT NULL,
+		role VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (team_id, user_id),
+		INDEX idx_team_members_user (user_id),
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create folders table
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS folders (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		team_id INT NULL,
+		parent_id INT NULL,
+		name VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		workspace_key VARCHAR(24) AS (IF(team_id IS NULL, CONCAT('u', user_id), CONCAT('t', team_id))) VIRTUAL,
+		parent_key INT AS (COALESCE(parent_id, 0)) VIRTUAL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (parent_id) REFERENCES folders(id),
+		INDEX idx_folders_team (team_id),
+		UNIQUE INDEX idx_folders_name (workspace_key, parent_key, name)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "folders", "team_id", "INT NULL, ADD INDEX idx_folders_team (team_id)"); err != nil {
+		return err
+	}
+
+	// Keep folder names unique within their parent. A unique index ignores rows
+	// with a NULL in it, so it is built on keys standing in for the workspace
+	// and the parent instead of team_id and parent_id.
+	hasParentKey, err := hasColumn(db, "folders", "parent_key")
+	if err != nil {
+		return err
+	}
+	if !hasParentKey {
+		// Rename duplicates left by concurrent creates so the index can be built
+		_, err = db.Exec(`
+		UPDATE folders f JOIN folders g
+			ON g.id < f.id AND g.name = f.name AND g.parent_id <=> f.parent_id AND g.team_id <=> f.team_id
+			AND (f.team_id IS NOT NULL OR g.user_id = f.user_id)
+		SET f.name = CONCAT(LEFT(f.name, 240), ' (', f.id, ')')
+		`)
+		if err != nil {
+			return err
+		}
+
+		if err = addColumn(db, "folders", "workspace_key", "VARCHAR(24) AS (IF(team_id IS NULL, CONCAT('u', user_id), CONCAT('t', team_id))) VIRTUAL"); err != nil {
+			return err
+		}
+		if err = addColumn(db, "folders", "parent_key", "INT AS (COALESCE(parent_id, 0)) VIRTUAL, ADD UNIQUE INDEX idx_folders_name (workspace_key, parent_key, name)"); err != nil {
+			return err
+		}
+	}
 
 	// Create files table
 	_, err = db.Exec(`
@@ -69,13 +203,389 @@ func createTables(db *sql.DB) error {
 		file_size BIGINT NOT NULL,
 		mime_type VARCHAR(100),
 		is_public BOOLEAN DEFAULT FALSE,
+		content_hash CHAR(64) NOT NULL DEFAULT '',
+		content_md5 CHAR(32) NOT NULL DEFAULT '',
+		folder_id INT NULL,
+		team_id INT NULL,
+		version INT NOT NULL DEFAULT 1,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NULL,
+		deleted_at TIMESTAMP NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		INDEX idx_files_folder (folder_id),
+		INDEX idx_files_team (team_id)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "content_hash", "CHAR(64) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "content_md5", "CHAR(32) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "folder_id", "INT NULL, ADD INDEX idx_files_folder (folder_id)"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "team_id", "INT NULL, ADD INDEX idx_files_team (team_id)"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "version", "INT NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "updated_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+
+	if err = addColumn(db, "files", "deleted_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+
+	// Create file_versions table holding the previous versions of each file
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		file_id INT NOT NULL,
+		version INT NOT NULL,
+		file_path VARCHAR(255) NOT NULL,
+		file_size BIGINT NOT NULL,
+		mime_type VARCHAR(100),
+		content_hash CHAR(64) NOT NULL DEFAULT '',
+		content_md5 CHAR(32) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE KEY uniq_file_version (file_id, version),
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Track storage used per user, counting every version of every file
+	hasUsedBytes, err := hasColumn(db, "users", "used_bytes")
+	if err != nil {
+		return err
+	}
+	if !hasUsedBytes {
+		if err = addColumn(db, "users", "used_bytes", "BIGINT NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+		UPDATE users SET used_bytes =
+			(SELECT COALESCE(SUM(file_size), 0) FROM files WHERE files.user_id = users.id) +
+			(SELECT COALESCE(SUM(v.file_size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.user_id = users.id)
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// file_path used to hold a path under ./uploads; it now holds the storage key
+	_, err = db.Exec(`UPDATE files SET file_path = filename WHERE file_path = CONCAT('uploads/', filename)`)
+	if err != nil {
+		return err
+	}
+
+	// Create blobs table tracking how many files reference each stored blob
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		digest CHAR(64) PRIMARY KEY,
+		storage_key VARCHAR(255) NOT NULL UNIQUE,
+		size BIGINT NOT NULL,
+		ref_count INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create shares table
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS shares (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		file_id INT NOT NULL,
+		user_id INT NOT NULL,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NULL,
+		max_downloads INT NULL,
+		download_count INT NOT NULL DEFAULT 0,
+		revoked_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);`)
 	if err != nil {
 		return err
 	}
 
+	if err = addColumn(db, "shares", "password_hash", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Share links replaced public files; files made public before then are
+	// private again and need a share link to be reached by others
+	_, err = db.Exec(`UPDATE files SET is_public = FALSE WHERE is_public`)
+	if err != nil {
+		return err
+	}
+
+	// Create tus_uploads table for in-progress resumable uploads
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS tus_uploads (
+		id VARCHAR(64) PRIMARY KEY,
+		user_id INT NOT NULL,
+		upload_length BIGINT NOT NULL,
+		upload_offset BIGINT NOT NULL DEFAULT 0,
+		filename VARCHAR(255) NOT NULL,
+		mime_type VARCHAR(100),
+		metadata TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create refresh_tokens table; only SHA-256 hashes of the tokens are kept
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		family_id CHAR(32) NOT NULL,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP NULL,
+		revoked_at TIMESTAMP NULL,
+		created_at TIMESTAMP NOT NULL,
+		INDEX idx_refresh_tokens_family (family_id),
+		INDEX idx_refresh_tokens_expires (expires_at),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create revoked_tokens table, the denylist of access tokens by jti
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti VARCHAR(64) PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL,
+		INDEX idx_revoked_tokens_expires (expires_at)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create user_tokens table for email verification and password reset
+	// tokens; only SHA-256 hashes of the tokens are kept
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		purpose VARCHAR(32) NOT NULL,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP NULL,
+		created_at TIMESTAMP NOT NULL,
+		INDEX idx_user_tokens_expires (expires_at),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create recovery_codes table; only SHA-256 hashes of the codes are kept
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at TIMESTAMP NULL,
+		INDEX idx_recovery_codes_user (user_id, code_hash),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create api_keys table; only SHA-256 hashes of the secrets are kept
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		prefix VARCHAR(16) NOT NULL UNIQUE,
+		secret_hash CHAR(64) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		last_used_at TIMESTAMP NULL,
+		expires_at TIMESTAMP NULL,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create file_grants table for sharing files with other users
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS file_grants (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		file_id INT NOT NULL,
+		user_id INT NOT NULL,
+		role VARCHAR(16) NOT NULL,
+		granted_by INT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE KEY idx_file_grants_file_user (file_id, user_id),
+		INDEX idx_file_grants_user (user_id),
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create user_identities table linking accounts to single sign-on subjects
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		issuer VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		UNIQUE KEY idx_user_identities_subject (issuer, subject),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create oidc_states table for single sign-on logins in progress
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS oidc_states (
+		state_hash CHAR(64) PRIMARY KEY,
+		nonce VARCHAR(64) NOT NULL,
+		code_verifier VARCHAR(128) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		INDEX idx_oidc_states_expires (expires_at)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create login_attempts table for brute-force protection shared between
+	// instances
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		attempt_key VARCHAR(320) PRIMARY KEY,
+		failures INT NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL,
+		blocked_until TIMESTAMP NULL,
+		locked BOOLEAN NOT NULL DEFAULT FALSE,
+		INDEX idx_login_attempts_blocked (blocked_until)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create audit_events table. Rows are only ever inserted, and they keep
+	// no foreign keys so that they outlive the users and files they mention.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		action VARCHAR(32) NOT NULL,
+		user_id INT NULL,
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		ip VARCHAR(45) NOT NULL DEFAULT '',
+		user_agent VARCHAR(512) NOT NULL DEFAULT '',
+		file_id INT NULL,
+		detail VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP(6) NOT NULL,
+		INDEX idx_audit_events_created (created_at),
+		INDEX idx_audit_events_user (user_id),
+		INDEX idx_audit_events_file (file_id),
+		INDEX idx_audit_events_action (action)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create webhooks table
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		url VARCHAR(2048) NOT NULL,
+		events VARCHAR(255) NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Create webhook_deliveries table, the queue of events to send and the
+	// log of those sent
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		webhook_id INT NOT NULL,
+		event VARCHAR(32) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		response_status INT NULL,
+		last_error VARCHAR(255) NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP(6) NULL,
+		created_at TIMESTAMP(6) NOT NULL,
+		delivered_at TIMESTAMP(6) NULL,
+		INDEX idx_webhook_deliveries_due (status, next_attempt_at),
+		FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+
+
+// hasColumn reports whether a table already has a column
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?
+	`, table, column).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// isDuplicateKey reports whether err is MySQL rejecting a row that would
+// break a unique index
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// addColumn adds a column to an existing table unless it is already present
+func addColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
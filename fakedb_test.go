@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReply is what a fakeHandler answers a statement with: rows for
+// queries, an insert ID and affected row count for everything else
+type fakeReply struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	LastInsertID int64
+	RowsAffected int64
+}
+
+// fakeHandler answers one statement. Transactions show up as BEGIN, COMMIT
+// and ROLLBACK statements, so tests can fail a commit too.
+type fakeHandler func(query string, args []driver.Value) (fakeReply, error)
+
+// fakeDrivers maps data source names to the handlers behind them
+var (
+	fakeDrivers  sync.Map
+	fakeDBCount  int64
+	registerFake sync.Once
+)
+
+// openFakeDB returns a database whose statements are answered by handler, so
+// services can be tested against scripted repository behaviour without a
+// MySQL server. Calls to handler are serialised.
+func openFakeDB(t *testing.T, handler fakeHandler) *sql.DB {
+	registerFake.Do(func() { sql.Register("fakedb", fakeDriver{}) })
+
+	var mu sync.Mutex
+	name := fmt.Sprintf("%s#%d", t.Name(), atomic.AddInt64(&fakeDBCount, 1))
+	fakeDrivers.Store(name, fakeHandler(func(query string, args []driver.Value) (fakeReply, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return handler(strings.Join(strings.Fields(query), " "), args)
+	}))
+	t.Cleanup(func() { fakeDrivers.Delete(name) })
+
+	db, err := sql.Open("fakedb", name)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	handler, ok := fakeDrivers.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{handler: handler.(fakeHandler)}, nil
+}
+
+type fakeConn struct {
+	handler fakeHandler
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if _, err := c.handler("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &fakeTx{conn: c}, nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (tx *fakeTx) Commit() error {
+	_, err := tx.conn.handler("COMMIT", nil)
+	return err
+}
+
+func (tx *fakeTx) Rollback() error {
+	_, err := tx.conn.handler("ROLLBACK", nil)
+	return err
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	reply, err := s.conn.handler(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{lastInsertID: reply.LastInsertID, rowsAffected: reply.RowsAffected}, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	reply, err := s.conn.handler(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: reply.Columns, rows: reply.Rows}, nil
+}
+
+type fakeResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeRow answers a query with a single row of values, one per column of
+// the comma separated list
+func fakeRow(columns string, values ...driver.Value) fakeReply {
+	return fakeReply{Columns: strings.Split(columns, ", "), Rows: [][]driver.Value{values}}
+}
+
+// fileValues returns a files row for file, in fileColumns order
+func fileValues(file *File) []driver.Value {
+	return []driver.Value{
+		int64(file.ID), int64(file.UserID), file.Filename, file.OriginalFilename, file.FilePath,
+		file.FileSize, file.MimeType, file.IsPublic, file.ContentHash, file.ContentMD5,
+		optionalValue(file.FolderID), optionalValue(file.TeamID), int64(file.Version),
+		file.CreatedAt, timeValue(file.UpdatedAt), timeValue(file.DeletedAt),
+	}
+}
+
+func optionalValue(id *int) driver.Value {
+	if id == nil {
+		return nil
+	}
+	return int64(*id)
+}
+
+func timeValue(t *time.Time) driver.Value {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
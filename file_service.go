@@ -1,32 +1,168 @@
 package main
 
 import (
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrShareNotFound = errors.New("share link not found")
+	ErrShareExpired  = errors.New("share link has expired")
+
+	ErrSharePasswordRequired = errors.New("share link requires a password")
+	ErrSharePasswordInvalid  = errors.New("invalid share password")
+
+	ErrChecksumMismatch = errors.New("checksum does not match the uploaded content")
+	ErrVersionNotFound  = errors.New("file version not found")
+
+	ErrGrantNotFound    = errors.New("user has no access to this file")
+	ErrInvalidGrantRole = errors.New("role must be viewer or editor")
+	ErrGrantToSelf      = errors.New("you already own this file")
+)
+
+// Roles a file grant can give
+const (
+	GrantViewer = "viewer"
+	GrantEditor = "editor"
+)
+
+// QuotaError reports that storing a file would exceed the user's quota
+type QuotaError struct {
+	Quota     int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d bytes requested, %d bytes remaining", e.Requested, e.Remaining())
+}
+
+// Remaining returns how many bytes the user can still store
+func (e *QuotaError) Remaining() int64 {
+	if e.Used >= e.Quota {
+		return 0
+	}
+	return e.Quota - e.Used
+}
+
+// File lifecycle events, reported to the handler set with OnFileEvent
+const (
+	FileUploaded   = "file.uploaded"
+	FileDeleted    = "file.deleted"
+	FileShared     = "file.shared"
+	FileDownloaded = "file.downloaded"
 )
 
+// FileEvent is something that happened to a file
+type FileEvent struct {
+	Type      string
+	File      *File
+	ActorID   int        // Zero for share link visitors and administrators
+	Share     *Share     // The link a file.shared event created
+	Grant     *FileGrant // The access a file.shared event gave a user
+	Permanent bool       // Whether a file.deleted file skipped the trash
+	Time      time.Time
+}
+
+// Checksums holds hex-encoded digests of a file's contents. Empty fields are
+// not checked.
+type Checksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+}
+
 // FileService handles file operations
 type FileService struct {
-	fileRepo *FileRepository
-	mutex    sync.Mutex
+	db          *sql.DB
+	userRepo    *UserRepository
+	fileRepo    *FileRepository
+	versionRepo *FileVersionRepository
+	blobRepo    *BlobRepository
+	folderRepo  *FolderRepository
+	shareRepo   *ShareRepository
+	grantRepo   *FileGrantRepository
+	teamRepo    *TeamRepository
+	storage     Storage
+	policy      UploadPolicy
+	onFileEvent func(FileEvent)
+	limiter     *LoginLimiter
+	mutex       sync.Mutex
 }
 
-func NewFileService(fileRepo *FileRepository) *FileService {
+func NewFileService(db *sql.DB, userRepo *UserRepository, fileRepo *FileRepository, versionRepo *FileVersionRepository, blobRepo *BlobRepository, folderRepo *FolderRepository, shareRepo *ShareRepository, grantRepo *FileGrantRepository, teamRepo *TeamRepository, storage Storage, policy UploadPolicy) *FileService {
 	return &FileService{
-		fileRepo: fileRepo,
-		mutex:    sync.Mutex{},
+		db:          db,
+		userRepo:    userRepo,
+		fileRepo:    fileRepo,
+		versionRepo: versionRepo,
+		blobRepo:    blobRepo,
+		folderRepo:  folderRepo,
+		shareRepo:   shareRepo,
+		grantRepo:   grantRepo,
+		teamRepo:    teamRepo,
+		storage:     storage,
+		policy:      policy,
+		mutex:       sync.Mutex{},
+	}
+}
+
+// OnFileEvent sets what happens when a file is uploaded, deleted, shared
+// or downloaded; by default nothing does. fn is called after the change is
+// saved, on the goroutine that made it.
+func (s *FileService) OnFileEvent(fn func(FileEvent)) {
+	s.onFileEvent = fn
+}
+
+// LimitSharePasswords makes share links refuse password attempts for a
+// while after too many wrong ones, as limiter does for logins; by default
+// attempts are unlimited
+func (s *FileService) LimitSharePasswords(limiter *LoginLimiter) {
+	s.limiter = limiter
+}
+
+// notify reports event to the OnFileEvent handler
+func (s *FileService) notify(event FileEvent) {
+	if s.onFileEvent == nil {
+		return
 	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.onFileEvent(event)
+}
+
+// RecordDownload reports that the user, or an anonymous share link visitor
+// when userID is zero, downloaded a file
+func (s *FileService) RecordDownload(file *File, userID int) {
+	s.notify(FileEvent{Type: FileDownloaded, File: file, ActorID: userID})
+}
+
+// UploadOptions controls where an uploaded file is placed and how it is checked
+type UploadOptions struct {
+	FolderID  *int      // Nil places the file at the root
+	TeamID    *int      // Nil keeps the file in the user's own workspace
+	Checksums Checksums // Digests the contents must match
 }
 
-// UploadFile uploads a file to local storage and saves metadata to database
-func (s *FileService) UploadFile(userID int, fileHeader *multipart.FileHeader) (*File, error) {
+// UploadFile uploads a file to the storage backend and saves metadata to database
+func (s *FileService) UploadFile(userID int, fileHeader *multipart.FileHeader, opts UploadOptions) (*File, error) {
 	// Open the uploaded file
 	src, err := fileHeader.Open()
 	if err != nil {
@@ -34,61 +170,367 @@ func (s *FileService) UploadFile(userID int, fileHeader *multipart.FileHeader) (
 	}
 	defer src.Close()
 
-	// Generate a unique filename
-	uniqueFilename, err := generateUniqueFilename(fileHeader.Filename)
-	if err != nil {
+	// Reject uploads that cannot be stored before reading them
+	if err := s.CheckUpload(fileHeader.Filename, fileHeader.Size); err != nil {
+		return nil, err
+	}
+	if err := s.CheckQuota(userID, fileHeader.Size); err != nil {
+		return nil, err
+	}
+
+	return s.StoreFile(userID, fileHeader.Filename, src, opts)
+}
+
+// StoreFile writes the contents of src to the storage backend and saves the
+// file's metadata to database. Contents are stored by their SHA-256 digest,
+// so identical uploads share a single blob. The MIME type is sniffed from
+// the contents rather than trusted from the client. Uploads that break the
+// upload policy or do not match the expected checksums are rejected.
+func (s *FileService) StoreFile(userID int, originalFilename string, src io.Reader, opts UploadOptions) (*File, error) {
+	if err := s.policy.CheckName(originalFilename); err != nil {
 		return nil, err
 	}
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+	// Team files need a role that may add them, and the folder must be in
+	// the same workspace
+	ws, err := workspaceFor(s.teamRepo, userID, opts.TeamID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkFolder(ws, userID, opts.FolderID); err != nil {
 		return nil, err
 	}
 
-	// Create file path
-	filePath := filepath.Join(uploadsDir, uniqueFilename)
+	// Generate a unique filename
+	uniqueFilename, err := generateUniqueFilename(originalFilename)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create destination file
-	dst, err := os.Create(filePath)
+	// Hash the contents before deciding where they go
+	content, err := spoolContent(src)
 	if err != nil {
 		return nil, err
 	}
-	defer dst.Close()
+	defer content.Close()
 
-	// Copy file to destination
-	if _, err = io.Copy(dst, src); err != nil {
+	mimeType, err := s.checkContent(content)
+	if err != nil {
 		return nil, err
 	}
 
+	if !content.Checksums.Matches(opts.Checksums) {
+		return nil, ErrChecksumMismatch
+	}
+
 	// Create file metadata
 	file := &File{
 		UserID:          userID,
 		Filename:        uniqueFilename,
-		OriginalFilename: fileHeader.Filename,
-		FilePath:        filePath,
-		FileSize:        fileHeader.Size,
-		MimeType:        fileHeader.Header.Get("Content-Type"),
+		OriginalFilename: originalFilename,
+		FilePath:        blobKey(content.SHA256),
+		FileSize:        content.Size,
+		MimeType:        mimeType,
 		IsPublic:        false,
+		ContentHash:     content.SHA256,
+		ContentMD5:      content.MD5,
+		FolderID:        opts.FolderID,
+		TeamID:          ws.TeamID,
+		Version:         1,
+	}
+
+	stored, err := s.storeBlob(content)
+	if err != nil {
+		return nil, err
 	}
 
-	// Save file metadata to database
-	fileID, err := s.fileRepo.Create(file)
+	// Save file metadata, usage and the blob reference together
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.reserveSpace(tx, userID, content.Size); err != nil {
+			return err
+		}
+
+		if err := s.acquireBlob(tx, content); err != nil {
+			return err
+		}
+
+		fileID, err := s.fileRepo.WithTx(tx).Create(file)
+		if err != nil {
+			return err
+		}
+		file.ID = fileID
+		return nil
+	})
 	if err != nil {
-		// Delete the file if metadata saving fails
-		os.Remove(filePath)
+		if stored {
+			s.discardBlob(file.FilePath)
+		}
 		return nil, err
 	}
 
-	file.ID = fileID
+	s.notify(FileEvent{Type: FileUploaded, File: file, ActorID: userID})
 	return file, nil
 }
 
-// UploadFileAsync uploads multiple files concurrently
-func (s *FileService) UploadFilesAsync(userID int, fileHeaders []*multipart.FileHeader) ([]int, error) {
+// storeBlob uploads content to storage under its content-addressed key,
+// unless it is there already, and reports whether it did. It runs before the
+// transaction that acquires the blob so that no row lock or connection is
+// held during the upload; if that transaction fails, discardBlob removes the
+// upload again.
+func (s *FileService) storeBlob(content *spooledContent) (bool, error) {
+	key := blobKey(content.SHA256)
+	if _, err := s.storage.Stat(key); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrBlobNotFound) {
+		return false, err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := s.storage.Put(key, content); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// acquireBlob references the blob holding content, which storeBlob stored
+// beforehand. A blob no file referenced may have been deleted since then;
+// acquiring its row waits for that deletion to finish, so when the row turns
+// out new the contents are checked and stored again if they are gone.
+func (s *FileService) acquireBlob(tx *sql.Tx, content *spooledContent) error {
+	key := blobKey(content.SHA256)
+	created, err := s.blobRepo.WithTx(tx).Acquire(content.SHA256, key, content.Size)
+	if err != nil || !created {
+		return err
+	}
+
+	if _, err := s.storage.Stat(key); !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = s.storage.Put(key, content)
+	return err
+}
+
+// discardBlob removes a blob stored for a transaction that failed, unless a
+// file acquired it meanwhile
+func (s *FileService) discardBlob(key string) {
+	s.deleteBlobs([]string{key})
+}
+
+// releaseBlob drops a file's reference to its blob. It returns the storage
+// key when nothing references the blob any more, for deleteBlobs to delete
+// once tx has committed; deleting earlier would lose the contents of files
+// that a rollback brings back. Blobs stored before deduplication are not
+// tracked and belong to a single file, so their keys are always returned.
+func (s *FileService) releaseBlob(tx *sql.Tx, storageKey string) (string, error) {
+	tracked, last, err := s.blobRepo.WithTx(tx).Release(storageKey)
+	if err != nil {
+		return "", err
+	}
+
+	if !tracked || last {
+		return storageKey, nil
+	}
+
+	return "", nil
+}
+
+// deleteBlobs deletes the contents of blobs released by a committed
+// transaction. Failures are logged; the blobs stay unreferenced and
+// SweepBlobs tries again later.
+func (s *FileService) deleteBlobs(keys []string) {
+	for _, key := range keys {
+		if err := s.deleteBlob(key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// deleteBlob deletes a blob's contents and then its row, unless a file
+// acquired it again after it was released. The row stays locked meanwhile,
+// so an upload of the same contents waits rather than relying on them.
+func (s *FileService) deleteBlob(key string) error {
+	return withTx(s.db, func(tx *sql.Tx) error {
+		blobs := s.blobRepo.WithTx(tx)
+
+		tracked, unused, err := blobs.LockUnused(key)
+		if err != nil {
+			return err
+		}
+		if tracked && !unused {
+			return nil
+		}
+
+		if err := s.storage.Delete(key); err != nil {
+			return err
+		}
+
+		if tracked {
+			return blobs.DeleteUnused(key)
+		}
+		return nil
+	})
+}
+
+// SweepBlobs deletes blobs left unreferenced by earlier failures to delete
+// them and returns how many it removed
+func (s *FileService) SweepBlobs() (int, error) {
+	const batchSize = 100
+
+	keys, err := s.blobRepo.GetUnused(batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, key := range keys {
+		if err := s.deleteBlob(key); err != nil {
+			return swept, err
+		}
+		swept++
+	}
+
+	return swept, nil
+}
+
+// MaxUploadSize returns the largest file accepted, or zero when unlimited
+func (s *FileService) MaxUploadSize() int64 {
+	return s.policy.MaxSize
+}
+
+// MaxBatchUploadSize returns the largest batch upload accepted, or zero when
+// unlimited
+func (s *FileService) MaxBatchUploadSize() int64 {
+	return s.policy.MaxBatchSize()
+}
+
+// CheckBatch applies the upload policy's limit on files per batch
+func (s *FileService) CheckBatch(count int) error {
+	return s.policy.CheckBatch(count)
+}
+
+// CheckUpload applies the size and extension rules of the upload policy
+// before any contents are read
+func (s *FileService) CheckUpload(filename string, size int64) error {
+	if err := s.policy.CheckSize(size); err != nil {
+		return err
+	}
+	return s.policy.CheckName(filename)
+}
+
+// checkContent sniffs the MIME type of spooled contents and applies the size
+// and type rules of the upload policy
+func (s *FileService) checkContent(content *spooledContent) (string, error) {
+	if err := s.policy.CheckSize(content.Size); err != nil {
+		return "", err
+	}
+
+	mimeType, err := sniffContentType(content)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.policy.CheckType(mimeType); err != nil {
+		return "", err
+	}
+
+	return mimeType, nil
+}
+
+// CheckQuota reports whether size more bytes fit in the user's quota without
+// reserving them. Uploads are checked again when they are stored.
+func (s *FileService) CheckQuota(userID int, size int64) error {
+	quota := storageQuota()
+	if quota == 0 {
+		return nil
+	}
+
+	used, err := s.userRepo.GetUsedBytes(userID)
+	if err != nil {
+		return err
+	}
+
+	// Resumable uploads in progress hold on to their space
+	pending, err := s.userRepo.GetPendingBytes(userID)
+	if err != nil {
+		return err
+	}
+	used += pending
+
+	if used+size > quota {
+		return &QuotaError{Quota: quota, Used: used, Requested: size}
+	}
+
+	return nil
+}
+
+// reserveSpace adds size to the user's storage usage, failing if that
+// exceeds their quota. The user's row stays locked until tx ends, so
+// concurrent uploads cannot both take the last free bytes.
+func (s *FileService) reserveSpace(tx *sql.Tx, userID int, size int64) error {
+	users := s.userRepo.WithTx(tx)
+
+	used, err := users.GetUsedBytesForUpdate(userID)
+	if err != nil {
+		return err
+	}
+
+	if quota := storageQuota(); quota > 0 && used+size > quota {
+		return &QuotaError{Quota: quota, Used: used, Requested: size}
+	}
+
+	return users.AddUsedBytes(userID, size)
+}
+
+// GetUsage reports the storage used by a user against their quota
+func (s *FileService) GetUsage(userID int) (*StorageUsage, error) {
+	usage, err := s.userRepo.GetUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage.QuotaBytes = storageQuota()
+	if usage.QuotaBytes > 0 {
+		remaining := (&QuotaError{Quota: usage.QuotaBytes, Used: usage.UsedBytes}).Remaining()
+		usage.RemainingBytes = &remaining
+	}
+
+	return usage, nil
+}
+
+// storageQuota returns how many bytes each user may store, or zero when
+// STORAGE_QUOTA_BYTES is unset
+func storageQuota() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("STORAGE_QUOTA_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// UploadResult is the outcome of uploading one file in a batch
+type UploadResult struct {
+	ID       int    `json:"id,omitempty"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size,omitempty"`
+	URL      string `json:"url,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	MD5      string `json:"md5,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// UploadFilesAsync uploads multiple files concurrently, at most
+// batchUploadConcurrency at a time. Results are returned in the order of
+// fileHeaders and each one carries either the stored file or its error.
+func (s *FileService) UploadFilesAsync(userID int, fileHeaders []*multipart.FileHeader) []UploadResult {
 	var wg sync.WaitGroup
-	fileIDs := make([]int, len(fileHeaders))
-	errorsChan := make(chan error, len(fileHeaders))
+	results := make([]UploadResult, len(fileHeaders))
+	semaphore := make(chan struct{}, batchUploadConcurrency())
 
 	// Process each file in its own goroutine
 	for i, fileHeader := range fileHeaders {
@@ -96,35 +538,97 @@ func (s *FileService) UploadFilesAsync(userID int, fileHeaders []*multipart.File
 		go func(i int, fileHeader *multipart.FileHeader) {
 			defer wg.Done()
 
-			file, err := s.UploadFile(userID, fileHeader)
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i].Filename = fileHeader.Filename
+			file, err := s.UploadFile(userID, fileHeader, UploadOptions{})
 			if err != nil {
-				errorsChan <- err
+				results[i].Error = err.Error()
 				return
 			}
-			fileIDs[i] = file.ID
+			results[i].ID = file.ID
+			results[i].Size = file.FileSize
+			results[i].URL = fmt.Sprintf("/files/%d", file.ID)
+			results[i].SHA256 = file.ContentHash
+			results[i].MD5 = file.ContentMD5
 		}(i, fileHeader)
 	}
 
 	// Wait for all goroutines to finish
 	wg.Wait()
-	close(errorsChan)
 
-	// Check for errors
-	if len(errorsChan) > 0 {
-		return nil, <-errorsChan
+	return results
+}
+
+// batchUploadConcurrency returns how many files of a batch are uploaded at once
+func batchUploadConcurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("UPLOAD_BATCH_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
+// GetUserFiles retrieves all files of the user's own workspace, or of a team
+// when teamID is set
+func (s *FileService) GetUserFiles(userID int, teamID *int) ([]*File, error) {
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.fileRepo.GetByWorkspace(ws)
+}
+
+// SearchFiles searches for files by name within a workspace
+func (s *FileService) SearchFiles(userID int, teamID *int, name string) ([]*File, error) {
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, false)
+	if err != nil {
+		return nil, err
 	}
+	return s.fileRepo.SearchByName(ws, name)
+}
 
-	return fileIDs, nil
+// GetFolderFiles retrieves the files directly inside a folder, or at the root
+// of the workspace when folderID is nil, optionally filtered by name
+func (s *FileService) GetFolderFiles(userID int, teamID *int, folderID *int, name string) ([]*File, error) {
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkFolder(ws, userID, folderID); err != nil {
+		return nil, err
+	}
+	return s.fileRepo.GetByFolder(ws, folderID, name)
 }
 
-// GetUserFiles retrieves all files for a user
-func (s *FileService) GetUserFiles(userID int) ([]*File, error) {
-	return s.fileRepo.GetByUserID(userID)
+// MoveFile moves a file into a folder of its workspace, or to the root when
+// folderID is nil
+func (s *FileService) MoveFile(fileID, userID int, folderID *int) error {
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkFolder(file.Workspace(), userID, folderID); err != nil {
+		return err
+	}
+	return s.fileRepo.UpdateFolder(fileID, file.UserID, folderID)
 }
 
-// SearchFiles searches for files by name
-func (s *FileService) SearchFiles(userID int, name string) ([]*File, error) {
-	return s.fileRepo.SearchByName(userID, name)
+// checkFolder makes sure folderID, unless nil, is a folder of ws the user
+// can see
+func (s *FileService) checkFolder(ws Workspace, userID int, folderID *int) error {
+	if folderID == nil {
+		return nil
+	}
+
+	folder, err := s.folderRepo.GetByID(*folderID, userID)
+	if err != nil {
+		return err
+	}
+	if !folder.Workspace().Same(ws) {
+		return ErrFolderNotFound
+	}
+	return nil
 }
 
 // GetFile retrieves a file by ID
@@ -134,60 +638,926 @@ func (s *FileService) GetFile(fileID, userID int) (*File, error) {
 		return nil, err
 	}
 
-	// Check if the file belongs to the user or is public
-	if file.UserID != userID && !file.IsPublic {
-		return nil, errors.New("file not found or you don't have permission to access it")
+	// Check if the file is in the user's workspace or was shared with them
+	allowed, err := s.hasAccess(file, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		role, err := s.grantRepo.GetRole(fileID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if role == "" {
+			return nil, errors.New("file not found or you don't have permission to access it")
+		}
 	}
 
 	return file, nil
 }
 
-// ShareFile makes a file publicly accessible
-func (s *FileService) ShareFile(fileID, userID int) (string, error) {
-	// Check if the file exists and belongs to the user
-	file, err := s.fileRepo.GetByID(fileID)
+// OpenFile opens the stored contents of a file for reading
+func (s *FileService) OpenFile(file *File) (io.ReadSeekCloser, error) {
+	return s.storage.Get(file.FilePath)
+}
+
+// UploadVersion replaces a file's contents with a new version, keeping the
+// current contents in the file's version history
+func (s *FileService) UploadVersion(fileID, userID int, fileHeader *multipart.FileHeader, expected Checksums) (*File, error) {
+	current, err := s.getOwnedFile(fileID, userID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if file.UserID != userID {
-		return "", errors.New("file not found or you don't have permission to share it")
+	if err := s.CheckUpload(fileHeader.Filename, fileHeader.Size); err != nil {
+		return nil, err
 	}
 
-	// Make the file public
-	if !file.IsPublic {
-		if err := s.fileRepo.UpdatePublicStatus(fileID, userID, true); err != nil {
-			return "", err
-		}
+	// The current contents stay in the history, so the new version needs
+	// room of its own. Versions count against whoever added the file, who
+	// gets the space back when it is purged.
+	if err := s.CheckQuota(current.UserID, fileHeader.Size); err != nil {
+		return nil, err
 	}
 
-	// Return the public URL
-	return fmt.Sprintf("/files/%d", fileID), nil
-}
+	// Open the uploaded file
+	src, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
 
-// DeleteFile deletes a file and its metadata
-func (s *FileService) DeleteFile(fileID, userID int) error {
-	// Check if the file exists and belongs to the user
-	file, err := s.fileRepo.GetByID(fileID)
+	// Hash the contents before deciding where they go
+	content, err := spoolContent(src)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer content.Close()
+
+	mimeType, err := s.checkContent(content)
+	if err != nil {
+		return nil, err
 	}
 
-	if file.UserID != userID {
-		return errors.New("file not found or you don't have permission to delete it")
+	if !content.Checksums.Matches(expected) {
+		return nil, ErrChecksumMismatch
 	}
 
-	// Lock to prevent concurrent access to the file
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	stored, err := s.storeBlob(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var file *File
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.reserveSpace(tx, current.UserID, content.Size); err != nil {
+			return err
+		}
+
+		if err := s.acquireBlob(tx, content); err != nil {
+			return err
+		}
 
-	// Delete the file from local storage
-	if err := os.Remove(file.FilePath); err != nil && !os.IsNotExist(err) {
+		file, err = s.replaceContent(tx, fileID, &FileVersion{
+			FilePath:    blobKey(content.SHA256),
+			FileSize:    content.Size,
+			MimeType:    mimeType,
+			ContentHash: content.SHA256,
+			ContentMD5:  content.MD5,
+		})
 		return err
+	})
+	if err != nil {
+		if stored {
+			s.discardBlob(blobKey(content.SHA256))
+		}
+		return nil, err
 	}
 
-	// Delete the file metadata from database
-	return s.fileRepo.Delete(fileID, userID)
+	s.notify(FileEvent{Type: FileUploaded, File: file, ActorID: userID})
+	return file, nil
+}
+
+// GetVersions lists every version of a file, newest first, including the
+// current one
+func (s *FileService) GetVersions(fileID, userID int) ([]*FileVersion, error) {
+	file, err := s.GetFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := s.versionRepo.GetByFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := &FileVersion{
+		FileID:      file.ID,
+		Version:     file.Version,
+		FilePath:    file.FilePath,
+		FileSize:    file.FileSize,
+		MimeType:    file.MimeType,
+		ContentHash: file.ContentHash,
+		ContentMD5:  file.ContentMD5,
+		Current:     true,
+		CreatedAt:   file.ModifiedAt(),
+	}
+
+	return append([]*FileVersion{current}, history...), nil
+}
+
+// GetVersion retrieves one version of a file as a File that can be served
+func (s *FileService) GetVersion(fileID, userID, versionNumber int) (*File, error) {
+	file, err := s.GetFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if versionNumber == file.Version {
+		return file, nil
+	}
+
+	version, err := s.versionRepo.GetByVersion(fileID, versionNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	file.FilePath = version.FilePath
+	file.FileSize = version.FileSize
+	file.MimeType = version.MimeType
+	file.ContentHash = version.ContentHash
+	file.ContentMD5 = version.ContentMD5
+	file.Version = version.Version
+	file.CreatedAt = version.CreatedAt
+	file.UpdatedAt = nil
+	return file, nil
+}
+
+// RestoreVersion makes an earlier version current again. The restored
+// contents become a new version, so no history is lost.
+func (s *FileService) RestoreVersion(fileID, userID, versionNumber int) (*File, error) {
+	current, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := s.versionRepo.GetByVersion(fileID, versionNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions stored before deduplication are copied into content-addressed
+	// storage first, since their blobs cannot be shared
+	var content *spooledContent
+	stored := false
+	if !isBlobVersion(version) {
+		src, err := s.storage.Get(version.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		content, err = spoolContent(src)
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+
+		if stored, err = s.storeBlob(content); err != nil {
+			return nil, err
+		}
+	}
+
+	var file *File
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		if err := s.reserveSpace(tx, current.UserID, version.FileSize); err != nil {
+			return err
+		}
+
+		restored, err := s.referenceVersion(tx, version, content)
+		if err != nil {
+			return err
+		}
+
+		file, err = s.replaceContent(tx, fileID, restored)
+		return err
+	})
+	if err != nil {
+		if stored {
+			s.discardBlob(blobKey(content.SHA256))
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// replaceContent archives a file's current contents as a version and points
+// the file at next, which must already hold a blob reference
+func (s *FileService) replaceContent(tx *sql.Tx, fileID int, next *FileVersion) (*File, error) {
+	files := s.fileRepo.WithTx(tx)
+
+	// Lock the file so concurrent uploads get consecutive version numbers
+	file, err := files.GetByIDForUpdate(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The archived version keeps the current blob reference
+	_, err = s.versionRepo.WithTx(tx).Create(&FileVersion{
+		FileID:      file.ID,
+		Version:     file.Version,
+		FilePath:    file.FilePath,
+		FileSize:    file.FileSize,
+		MimeType:    file.MimeType,
+		ContentHash: file.ContentHash,
+		ContentMD5:  file.ContentMD5,
+		CreatedAt:   file.ModifiedAt(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	file.FilePath = next.FilePath
+	file.FileSize = next.FileSize
+	file.MimeType = next.MimeType
+	file.ContentHash = next.ContentHash
+	file.ContentMD5 = next.ContentMD5
+	file.Version++
+	file.UpdatedAt = &now
+
+	if err := files.UpdateContent(file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// referenceVersion adds a blob reference for an earlier version's contents.
+// Versions stored before deduplication come with content, their contents
+// already copied into content-addressed storage by storeBlob.
+func (s *FileService) referenceVersion(tx *sql.Tx, version *FileVersion, content *spooledContent) (*FileVersion, error) {
+	restored := *version
+
+	if content == nil {
+		if _, err := s.blobRepo.WithTx(tx).Acquire(version.ContentHash, version.FilePath, version.FileSize); err != nil {
+			return nil, err
+		}
+		return &restored, nil
+	}
+
+	if err := s.acquireBlob(tx, content); err != nil {
+		return nil, err
+	}
+
+	restored.FilePath = blobKey(content.SHA256)
+	restored.FileSize = content.Size
+	restored.ContentHash = content.SHA256
+	restored.ContentMD5 = content.MD5
+	return &restored, nil
+}
+
+// isBlobVersion reports whether a version's contents are kept in a shared,
+// content-addressed blob rather than one stored before deduplication
+func isBlobVersion(version *FileVersion) bool {
+	return version.ContentHash != "" && version.FilePath == blobKey(version.ContentHash)
+}
+
+// getOwnedFile retrieves a file only if it belongs to the user, or to a team
+// in which they may change files
+func (s *FileService) getOwnedFile(fileID, userID int) (*File, error) {
+	file, err := s.fileRepo.GetByID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := s.hasAccess(file, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, errors.New("file not found or you don't have permission to modify it")
+	}
+
+	return file, nil
+}
+
+// hasAccess reports whether the user may read a file, or change it when
+// write is set, through its workspace: their own files, or those of a team
+// they are a member of. Grants and public files are checked separately.
+func (s *FileService) hasAccess(file *File, userID int, write bool) (bool, error) {
+	if file.TeamID == nil {
+		return file.UserID == userID, nil
+	}
+
+	role, err := s.teamRepo.GetRole(*file.TeamID, userID)
+	if err != nil {
+		return false, err
+	}
+	return role != "" && (!write || canChangeTeamFiles(role)), nil
+}
+
+// VerifyResult describes the outcome of rehashing a stored file
+type VerifyResult struct {
+	Status   string    `json:"status"` // ok, mismatch, missing or recorded
+	Expected Checksums `json:"expected"`
+	Actual   Checksums `json:"actual"`
+	Size     int64     `json:"size"`
+}
+
+// VerifyFile rehashes a file's stored blob and compares it to the checksums
+// recorded at upload time. Files uploaded before checksums were recorded get
+// them recorded now.
+func (s *FileService) VerifyFile(fileID, userID int) (*VerifyResult, error) {
+	file, err := s.GetFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{
+		Expected: Checksums{SHA256: file.ContentHash, MD5: file.ContentMD5},
+	}
+
+	content, err := s.storage.Get(file.FilePath)
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			result.Status = "missing"
+			return result, nil
+		}
+		return nil, err
+	}
+	defer content.Close()
+
+	result.Actual, result.Size, err = computeChecksums(content)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case file.ContentHash == "" && file.ContentMD5 == "":
+		if err := s.fileRepo.UpdateChecksums(file.ID, result.Actual.SHA256, result.Actual.MD5); err != nil {
+			return nil, err
+		}
+		result.Status = "recorded"
+	case result.Actual.Matches(result.Expected) && result.Size == file.FileSize:
+		result.Status = "ok"
+	default:
+		result.Status = "mismatch"
+	}
+
+	return result, nil
+}
+
+// ShareOptions controls the lifetime of a share link
+type ShareOptions struct {
+	ExpiresIn    time.Duration // Zero means the link never expires
+	MaxDownloads int           // Zero means unlimited downloads
+	Password     string        // Empty means no password is required
+}
+
+// ShareFile creates a share link for a file with a random token
+func (s *FileService) ShareFile(fileID, userID int, opts ShareOptions) (*Share, error) {
+	// Check if the file exists and the user may share it
+	file, err := s.fileRepo.GetByID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := s.hasAccess(file, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, errors.New("file not found or you don't have permission to share it")
+	}
+
+	token, err := generateShareToken()
+	if err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		FileID: fileID,
+		UserID: userID,
+		Token:  token,
+	}
+	if opts.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(opts.ExpiresIn)
+		share.ExpiresAt = &expiresAt
+	}
+	if opts.MaxDownloads > 0 {
+		maxDownloads := opts.MaxDownloads
+		share.MaxDownloads = &maxDownloads
+	}
+	if opts.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		share.PasswordHash = string(hashedPassword)
+	}
+
+	shareID, err := s.shareRepo.Create(share)
+	if err != nil {
+		return nil, err
+	}
+
+	share.ID = shareID
+	share.CreatedAt = time.Now()
+
+	s.notify(FileEvent{Type: FileShared, File: file, ActorID: userID, Share: share})
+	return share, nil
+}
+
+// OpenShare resolves a share token to the share and its file. Password
+// protected shares require the matching password. Downloads are counted
+// separately with CountShareDownload.
+func (s *FileService) OpenShare(token, password, ip string) (*Share, *File, error) {
+	share, err := s.shareRepo.GetByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if share.RevokedAt != nil {
+		return nil, nil, ErrShareNotFound
+	}
+	if share.ExpiresAt != nil && !share.ExpiresAt.After(now) {
+		return nil, nil, ErrShareExpired
+	}
+	if share.MaxDownloads != nil && share.DownloadCount >= *share.MaxDownloads {
+		return nil, nil, ErrShareExpired
+	}
+
+	if share.HasPassword() {
+		if password == "" {
+			return nil, nil, ErrSharePasswordRequired
+		}
+		if err := s.checkSharePassword(share, password, ip); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	file, err := s.fileRepo.GetByID(share.FileID)
+	if err != nil {
+		return nil, nil, ErrShareNotFound
+	}
+
+	// Links stop working once whoever created them can no longer see the
+	// file, such as a member who left the file's team
+	allowed, err := s.hasAccess(file, share.UserID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		return nil, nil, ErrShareNotFound
+	}
+
+	return share, file, nil
+}
+
+// checkSharePassword compares password to the share's, refusing to while
+// the share or the IP address is locked out after wrong passwords
+func (s *FileService) checkSharePassword(share *Share, password, ip string) error {
+	if s.limiter != nil {
+		if err := s.limiter.CheckShare(share.ID, ip); err != nil {
+			return err
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)); err != nil {
+		if s.limiter != nil {
+			if err := s.limiter.RecordShareFailure(share.ID, ip); err != nil {
+				return err
+			}
+		}
+		return ErrSharePasswordInvalid
+	}
+
+	return nil
+}
+
+// CountShareDownload counts a download against a share, failing with
+// ErrShareExpired once its limit is used up or it stopped working meanwhile
+func (s *FileService) CountShareDownload(share *Share) error {
+	return s.shareRepo.ConsumeDownload(share.ID, time.Now())
+}
+
+// GrantAccess shares one of the user's files with the registered user with
+// the given email address, or changes the role they already have
+func (s *FileService) GrantAccess(fileID, userID int, email, role string) (*FileGrant, error) {
+	if role != GrantViewer && role != GrantEditor {
+		return nil, ErrInvalidGrantRole
+	}
+
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grantee, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if grantee.ID == userID {
+		return nil, ErrGrantToSelf
+	}
+
+	grant := &FileGrant{
+		FileID:    fileID,
+		UserID:    grantee.ID,
+		Email:     grantee.Email,
+		Role:      role,
+		GrantedBy: userID,
+		CreatedAt: time.Now(),
+	}
+	if err := s.grantRepo.Upsert(grant); err != nil {
+		return nil, err
+	}
+
+	s.notify(FileEvent{Type: FileShared, File: file, ActorID: userID, Grant: grant})
+	return grant, nil
+}
+
+// GetGrants lists who one of the user's files is shared with
+func (s *FileService) GetGrants(fileID, userID int) ([]*FileGrant, error) {
+	if _, err := s.getOwnedFile(fileID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.grantRepo.GetByFileID(fileID)
+}
+
+// RevokeGrant stops sharing one of the user's files with another user
+func (s *FileService) RevokeGrant(fileID, userID, granteeID int) error {
+	if _, err := s.getOwnedFile(fileID, userID); err != nil {
+		return err
+	}
+
+	return s.grantRepo.Delete(fileID, granteeID)
+}
+
+// GetSharedWithMe lists the files other users shared with the user
+func (s *FileService) GetSharedWithMe(userID int) ([]*SharedFile, error) {
+	return s.grantRepo.GetSharedWith(userID)
+}
+
+// RevokeShare disables a share link owned by the user and returns it
+func (s *FileService) RevokeShare(token string, userID int) (*Share, error) {
+	share, err := s.shareRepo.GetByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.shareRepo.Revoke(token, userID, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return share, nil
+}
+
+// DeleteFile moves a file to the trash, from where it can be restored until
+// it is purged
+func (s *FileService) DeleteFile(fileID, userID int) error {
+	// Check if the file exists and the user may delete it
+	file, err := s.fileRepo.GetByID(fileID)
+	if err != nil {
+		return err
+	}
+
+	allowed, err := s.hasAccess(file, userID, true)
+	if err != nil {
+		return err
+	}
+
+	// Editors may delete files shared with them; the file goes to the
+	// owner's trash
+	if !allowed {
+		role, err := s.grantRepo.GetRole(fileID, userID)
+		if err != nil {
+			return err
+		}
+		if role != GrantEditor {
+			return errors.New("file not found or you don't have permission to delete it")
+		}
+	}
+
+	now := time.Now()
+	if err := s.fileRepo.Trash(fileID, file.UserID, now); err != nil {
+		return err
+	}
+
+	s.notify(FileEvent{Type: FileDeleted, File: file, ActorID: userID, Time: now})
+	return nil
+}
+
+// GetTrash retrieves the files in the trash of the user's own workspace, or
+// of a team when teamID is set
+func (s *FileService) GetTrash(userID int, teamID *int) ([]*File, error) {
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.fileRepo.GetTrashed(ws)
+}
+
+// getTrashedFile retrieves a file in the trash of a workspace in which the
+// user may change files
+func (s *FileService) getTrashedFile(fileID, userID int) (*File, error) {
+	file, err := s.fileRepo.GetTrashedByID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := s.hasAccess(file, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, errors.New("file not found in trash")
+	}
+
+	return file, nil
+}
+
+// RestoreFile takes a file out of the trash. If its folder no longer exists
+// the file is restored to the root.
+func (s *FileService) RestoreFile(fileID, userID int) (*File, error) {
+	file, err := s.getTrashedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	folderID := file.FolderID
+	if folderID != nil {
+		if _, err := s.folderRepo.GetByID(*folderID, userID); err != nil {
+			folderID = nil
+		}
+	}
+
+	if err := s.fileRepo.Restore(fileID, file.UserID, folderID); err != nil {
+		return nil, err
+	}
+
+	file.FolderID = folderID
+	file.DeletedAt = nil
+	return file, nil
+}
+
+// PurgeFile permanently deletes a file from the user's trash
+func (s *FileService) PurgeFile(fileID, userID int) error {
+	file, err := s.getTrashedFile(fileID, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.purge(file)
+}
+
+// GetAnyFile retrieves a file whatever its owner, including files in the
+// trash
+func (s *FileService) GetAnyFile(fileID int) (*File, error) {
+	return s.fileRepo.GetByIDIncludingTrash(fileID)
+}
+
+// ForceDeleteFile permanently deletes a file whatever its owner, whether or
+// not it is in the trash. Files in the trash were reported deleted when they
+// were put there, so only the others are reported now.
+func (s *FileService) ForceDeleteFile(fileID int) error {
+	file, err := s.fileRepo.GetByIDIncludingTrash(fileID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.purge(file); err != nil {
+		return err
+	}
+
+	if file.DeletedAt == nil {
+		s.notify(FileEvent{Type: FileDeleted, File: file, Permanent: true})
+	}
+	return nil
+}
+
+// PurgeExpiredTrash permanently deletes files that have been in the trash
+// for longer than retention and returns how many were removed
+func (s *FileService) PurgeExpiredTrash(retention time.Duration) (int, error) {
+	const batchSize = 100
+	cutoff := time.Now().Add(-retention)
+
+	purged := 0
+	for {
+		files, err := s.fileRepo.GetTrashedBefore(cutoff, batchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		// A file that fails to purge stays in the trash untouched; carry on
+		// with the rest and stop after this batch, which would otherwise
+		// return the same file again
+		var firstErr error
+		for _, file := range files {
+			if err := s.purge(file); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			purged++
+		}
+
+		if firstErr != nil || len(files) < batchSize {
+			return purged, firstErr
+		}
+	}
+}
+
+// RunTrashPurger purges expired trash every interval until stop is closed
+func (s *FileService) RunTrashPurger(retention, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.PurgeExpiredTrash(retention)
+		if err != nil {
+			log.Printf("Failed to purge trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d files from trash", purged)
+		}
+
+		if swept, err := s.SweepBlobs(); err != nil {
+			log.Printf("Failed to sweep unreferenced blobs: %v", err)
+		} else if swept > 0 {
+			log.Printf("Deleted %d unreferenced blobs", swept)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// purge deletes a file's metadata and releases the blobs of all its
+// versions. Contents nothing else uses are deleted only once that is
+// committed.
+func (s *FileService) purge(file *File) error {
+	// Lock to prevent concurrent access to the file
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var released []string
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		released = nil
+
+		versions, err := s.versionRepo.WithTx(tx).GetByFileID(file.ID)
+		if err != nil {
+			return err
+		}
+
+		// Removing the file row also removes its version rows
+		if err := s.fileRepo.WithTx(tx).Delete(file.ID, file.UserID); err != nil {
+			return err
+		}
+
+		freed := file.FileSize
+		paths := []string{file.FilePath}
+		for _, version := range versions {
+			freed += version.FileSize
+			paths = append(paths, version.FilePath)
+		}
+		for _, path := range paths {
+			key, err := s.releaseBlob(tx, path)
+			if err != nil {
+				return err
+			}
+			if key != "" {
+				released = append(released, key)
+			}
+		}
+
+		return s.userRepo.WithTx(tx).AddUsedBytes(file.UserID, -freed)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.deleteBlobs(released)
+	return nil
+}
+
+// TrashSettingsFromEnv reads how long trashed files are kept
+// (TRASH_RETENTION) and how often expired ones are purged
+// (TRASH_PURGE_INTERVAL)
+func TrashSettingsFromEnv() (retention, interval time.Duration, err error) {
+	retention = 30 * 24 * time.Hour
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		if retention, err = time.ParseDuration(value); err != nil {
+			return 0, 0, errors.New("TRASH_RETENTION must be a duration such as 720h")
+		}
+	}
+
+	interval = time.Hour
+	if value := os.Getenv("TRASH_PURGE_INTERVAL"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return 0, 0, errors.New("TRASH_PURGE_INTERVAL must be a positive duration such as 1h")
+		}
+	}
+
+	return retention, interval, nil
+}
+
+// generateShareToken generates an unguessable URL-safe share token
+func generateShareToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// spooledContent is upload data held in a seekable form together with its
+// size and digests
+type spooledContent struct {
+	io.ReadSeeker
+	Checksums
+	Size    int64
+	cleanup func()
+}
+
+func (c *spooledContent) Close() error {
+	c.cleanup()
+	return nil
+}
+
+// spoolContent hashes src, copying it to a temporary file first unless it
+// is already a seekable file that can be rewound
+func spoolContent(src io.Reader) (*spooledContent, error) {
+	if f, ok := src.(*os.File); ok {
+		checksums, size, err := computeChecksums(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return &spooledContent{ReadSeeker: f, Checksums: checksums, Size: size, cleanup: func() {}}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	checksums, size, err := computeChecksums(io.TeeReader(src, tmp))
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return &spooledContent{ReadSeeker: tmp, Checksums: checksums, Size: size, cleanup: cleanup}, nil
+}
+
+// computeChecksums reads r to the end and returns its digests and size
+func computeChecksums(r io.Reader) (Checksums, int64, error) {
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+
+	size, err := io.Copy(io.MultiWriter(sha256Hash, md5Hash), r)
+	if err != nil {
+		return Checksums{}, 0, err
+	}
+
+	return Checksums{
+		SHA256: hex.EncodeToString(sha256Hash.Sum(nil)),
+		MD5:    hex.EncodeToString(md5Hash.Sum(nil)),
+	}, size, nil
+}
+
+// Matches reports whether c agrees with every digest set in expected
+func (c Checksums) Matches(expected Checksums) bool {
+	if expected.SHA256 != "" && !strings.EqualFold(expected.SHA256, c.SHA256) {
+		return false
+	}
+	if expected.MD5 != "" && !strings.EqualFold(expected.MD5, c.MD5) {
+		return false
+	}
+	return true
+}
+
+// blobKey returns the storage key of the blob with the given SHA-256 digest
+func blobKey(digest string) string {
+	return "blobs/" + digest[:2] + "/" + digest
 }
 
 // generateUniqueFilename generates a unique filename
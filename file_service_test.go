@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolContent(t *testing.T) {
+	const digest = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	const md5Digest = "5d41402abc4b2a76b9719d911017c592"                              // md5("hello")
+
+	// Streams are copied to a temporary file
+	content, err := spoolContent(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), content.Size)
+	assert.Equal(t, digest, content.SHA256)
+	assert.Equal(t, md5Digest, content.MD5)
+	data, _ := io.ReadAll(content)
+	assert.Equal(t, "hello", string(data))
+	content.Close()
+
+	// Files are hashed in place and rewound
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello"), 0644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	content, err = spoolContent(f)
+	require.NoError(t, err)
+	assert.Equal(t, digest, content.SHA256)
+	data, _ = io.ReadAll(content)
+	assert.Equal(t, "hello", string(data))
+
+	assert.Equal(t, "blobs/2c/"+digest, blobKey(digest))
+}
+
+func TestChecksumsMatches(t *testing.T) {
+	actual := Checksums{SHA256: "abcd", MD5: "ef01"}
+
+	assert.True(t, actual.Matches(Checksums{}))
+	assert.True(t, actual.Matches(Checksums{SHA256: "ABCD"}))
+	assert.True(t, actual.Matches(Checksums{MD5: "ef01"}))
+	assert.False(t, actual.Matches(Checksums{SHA256: "abcd", MD5: "0000"}))
+}
+
+func TestTrashSettingsFromEnv(t *testing.T) {
+	retention, interval, err := TrashSettingsFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, retention)
+	assert.Equal(t, time.Hour, interval)
+
+	t.Setenv("TRASH_RETENTION", "168h")
+	t.Setenv("TRASH_PURGE_INTERVAL", "10m")
+	retention, interval, err = TrashSettingsFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, retention)
+	assert.Equal(t, 10*time.Minute, interval)
+
+	t.Setenv("TRASH_RETENTION", "a week")
+	_, _, err = TrashSettingsFromEnv()
+	assert.Error(t, err)
+}
+
+func TestStorageQuota(t *testing.T) {
+	t.Setenv("STORAGE_QUOTA_BYTES", "")
+	assert.Equal(t, int64(0), storageQuota(), "unset means unlimited")
+
+	t.Setenv("STORAGE_QUOTA_BYTES", "1048576")
+	assert.Equal(t, int64(1048576), storageQuota())
+
+	err := &QuotaError{Quota: 100, Used: 80, Requested: 30}
+	assert.Equal(t, int64(20), err.Remaining())
+	assert.Contains(t, err.Error(), "20 bytes remaining")
+
+	err = &QuotaError{Quota: 100, Used: 120, Requested: 1}
+	assert.Equal(t, int64(0), err.Remaining(), "usage above a lowered quota leaves nothing")
+}
+
+func TestGrantAccessRejectsUnknownRoles(t *testing.T) {
+	service := &FileService{}
+
+	for _, role := range []string{"", "owner", "Editor", "admin"} {
+		_, err := service.GrantAccess(1, 1, "friend@example.com", role)
+		assert.ErrorIs(t, err, ErrInvalidGrantRole, role)
+	}
+}
+
+func TestPurgeDeletesContentOnlyAfterCommit(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	for _, key := range []string{"kept.bin", "gone.bin"} {
+		_, err := storage.Put(key, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+
+	deletedAt := time.Now().Add(-48 * time.Hour)
+	files := []*File{
+		{ID: 1, UserID: 1, FilePath: "kept.bin", FileSize: 8, DeletedAt: &deletedAt},
+		{ID: 2, UserID: 2, FilePath: "gone.bin", FileSize: 8, DeletedAt: &deletedAt},
+	}
+
+	// Each blob has one reference. Updating the first user's usage fails, so
+	// the first purge rolls back after its blob was released.
+	refCounts := map[string]int{"kept.bin": 1, "gone.bin": 1}
+	var pending map[string]int
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case query == "BEGIN":
+			pending = map[string]int{}
+			for key, count := range refCounts {
+				pending[key] = count
+			}
+		case query == "COMMIT":
+			refCounts = pending
+		case query == "ROLLBACK":
+		case strings.Contains(query, "FROM files WHERE deleted_at IS NOT NULL"):
+			reply := fakeReply{Columns: strings.Split(fileColumns, ", ")}
+			for _, file := range files {
+				reply.Rows = append(reply.Rows, fileValues(file))
+			}
+			return reply, nil
+		case strings.Contains(query, "FROM file_versions"):
+			return fakeReply{}, nil
+		case strings.HasPrefix(query, "DELETE FROM files"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "SELECT ref_count FROM blobs"):
+			count, ok := pending[args[0].(string)]
+			if !ok {
+				return fakeReply{}, nil
+			}
+			return fakeRow("ref_count", int64(count)), nil
+		case strings.HasPrefix(query, "UPDATE blobs SET ref_count"):
+			if pending[args[0].(string)] > 0 {
+				pending[args[0].(string)]--
+			}
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM blobs"):
+			delete(pending, args[0].(string))
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "UPDATE users SET used_bytes"):
+			if args[1] == int64(1) {
+				return fakeReply{}, errors.New("connection lost")
+			}
+			return fakeReply{RowsAffected: 1}, nil
+		default:
+			t.Fatalf("unexpected query %q", query)
+		}
+		return fakeReply{}, nil
+	})
+	fileService := NewFileService(db, NewUserRepository(db), NewFileRepository(db), NewFileVersionRepository(db), NewBlobRepository(db), nil, nil, nil, nil, storage, UploadPolicy{})
+
+	// The failed purge leaves its file restorable, and does not stop the rest
+	purged, err := fileService.PurgeExpiredTrash(24 * time.Hour)
+	assert.EqualError(t, err, "connection lost")
+	assert.Equal(t, 1, purged)
+
+	_, err = storage.Stat("kept.bin")
+	assert.NoError(t, err, "contents of a file still in the trash were deleted")
+	assert.Equal(t, 1, refCounts["kept.bin"])
+
+	_, err = storage.Stat("gone.bin")
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+	assert.NotContains(t, refCounts, "gone.bin")
+}
+
+func TestStoreFileUploadsOutsideTransaction(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("report contents"))
+	key := blobKey(hex.EncodeToString(digest[:]))
+
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case query == "BEGIN":
+			// The contents are in storage before any row is locked
+			_, err := storage.Stat(key)
+			assert.NoError(t, err)
+		case query == "COMMIT", query == "ROLLBACK":
+		case strings.HasPrefix(query, "SELECT used_bytes FROM users"):
+			return fakeRow("used_bytes", int64(0)), nil
+		case strings.HasPrefix(query, "UPDATE users SET used_bytes"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "INSERT INTO blobs"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "INSERT INTO files"):
+			return fakeReply{}, errors.New("connection lost")
+		case strings.HasPrefix(query, "SELECT ref_count FROM blobs"):
+			return fakeReply{}, nil
+		default:
+			t.Fatalf("unexpected query %q", query)
+		}
+		return fakeReply{}, nil
+	})
+	fileService := NewFileService(db, NewUserRepository(db), NewFileRepository(db), nil, NewBlobRepository(db), nil, nil, nil, nil, storage, UploadPolicy{})
+
+	_, err = fileService.StoreFile(1, "report.txt", strings.NewReader("report contents"), UploadOptions{})
+	assert.EqualError(t, err, "connection lost")
+
+	// The rolled back upload has no row for SweepBlobs to find, so it is
+	// removed straight away
+	_, err = storage.Stat(key)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+}
+
+func TestGetFileIgnoresLegacyPublicFlag(t *testing.T) {
+	file := &File{ID: 5, UserID: 1, IsPublic: true, CreatedAt: time.Now()}
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.Contains(query, "FROM files WHERE id = ?"):
+			return fakeRow(fileColumns, fileValues(file)...), nil
+		case strings.HasPrefix(query, "SELECT role FROM file_grants"):
+			return fakeReply{}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	fileService := NewFileService(db, nil, NewFileRepository(db), nil, nil, nil, nil, NewFileGrantRepository(db), nil, nil, UploadPolicy{})
+
+	_, err := fileService.GetFile(5, 2)
+	assert.Error(t, err, "another user reached a file through is_public")
+
+	found, err := fileService.GetFile(5, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 5, found.ID)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrFolderNotFound = errors.New("folder not found")
+	ErrFolderExists   = errors.New("a folder with this name already exists here")
+	ErrFolderNotEmpty = errors.New("folder is not empty")
+	ErrFolderCycle    = errors.New("a folder cannot be moved into itself")
+)
+
+// maxFolderDepth bounds walks up the folder tree
+const maxFolderDepth = 100
+
+// FolderService handles folder operations
+type FolderService struct {
+	folderRepo *FolderRepository
+	fileRepo   *FileRepository
+	teamRepo   *TeamRepository
+}
+
+func NewFolderService(folderRepo *FolderRepository, fileRepo *FileRepository, teamRepo *TeamRepository) *FolderService {
+	return &FolderService{folderRepo: folderRepo, fileRepo: fileRepo, teamRepo: teamRepo}
+}
+
+// CreateFolder creates a folder inside parentID, or at the root when nil, in
+// the user's own workspace or in a team's when teamID is set
+func (s *FolderService) CreateFolder(userID int, teamID *int, parentID *int, name string) (*Folder, error) {
+	name, err := cleanFolderName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID != nil {
+		parent, err := s.folderRepo.GetByID(*parentID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !parent.Workspace().Same(ws) {
+			return nil, ErrFolderNotFound
+		}
+	}
+
+	if err := s.ensureNameFree(ws, parentID, name); err != nil {
+		return nil, err
+	}
+
+	folder := &Folder{UserID: userID, TeamID: ws.TeamID, ParentID: parentID, Name: name}
+	folderID, err := s.folderRepo.Create(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.folderRepo.GetByID(folderID, userID)
+}
+
+// GetFolder retrieves a folder of the user or of one of their teams
+func (s *FolderService) GetFolder(folderID, userID int) (*Folder, error) {
+	return s.folderRepo.GetByID(folderID, userID)
+}
+
+// GetSubfolders retrieves the folders directly inside parentID, or at the
+// root of the workspace when nil
+func (s *FolderService) GetSubfolders(userID int, teamID *int, parentID *int) ([]*Folder, error) {
+	ws, err := workspaceFor(s.teamRepo, userID, teamID, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.folderRepo.GetChildren(ws, parentID)
+}
+
+// RenameFolder changes a folder's name
+func (s *FolderService) RenameFolder(folderID, userID int, name string) (*Folder, error) {
+	name, err := cleanFolderName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err := s.getWritableFolder(folderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if folder.Name == name {
+		return folder, nil
+	}
+
+	if err := s.ensureNameFree(folder.Workspace(), folder.ParentID, name); err != nil {
+		return nil, err
+	}
+
+	if err := s.folderRepo.Rename(folderID, folder.UserID, name); err != nil {
+		return nil, err
+	}
+
+	folder.Name = name
+	return folder, nil
+}
+
+// MoveFolder moves a folder under a new parent in the same workspace, or to
+// the root when nil
+func (s *FolderService) MoveFolder(folderID, userID int, parentID *int) (*Folder, error) {
+	folder, err := s.getWritableFolder(folderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sameFolderID(folder.ParentID, parentID) {
+		return folder, nil
+	}
+
+	if parentID != nil {
+		// The new parent must not be the folder itself or one of its descendants
+		ancestors, err := s.Breadcrumbs(*parentID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !ancestors[len(ancestors)-1].Workspace().Same(folder.Workspace()) {
+			return nil, ErrFolderNotFound
+		}
+		for _, ancestor := range ancestors {
+			if ancestor.ID == folderID {
+				return nil, ErrFolderCycle
+			}
+		}
+	}
+
+	if err := s.ensureNameFree(folder.Workspace(), parentID, folder.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.folderRepo.Move(folderID, folder.UserID, parentID); err != nil {
+		return nil, err
+	}
+
+	folder.ParentID = parentID
+	return folder, nil
+}
+
+// DeleteFolder deletes an empty folder
+func (s *FolderService) DeleteFolder(folderID, userID int) error {
+	folder, err := s.getWritableFolder(folderID, userID)
+	if err != nil {
+		return err
+	}
+
+	children, err := s.folderRepo.GetChildren(folder.Workspace(), &folderID)
+	if err != nil {
+		return err
+	}
+
+	fileCount, err := s.fileRepo.CountByFolder(folderID)
+	if err != nil {
+		return err
+	}
+
+	if len(children) > 0 || fileCount > 0 {
+		return ErrFolderNotEmpty
+	}
+
+	return s.folderRepo.Delete(folderID, folder.UserID)
+}
+
+// Breadcrumbs returns the path from the root down to and including folderID
+func (s *FolderService) Breadcrumbs(folderID, userID int) ([]*Folder, error) {
+	var path []*Folder
+
+	id := &folderID
+	for depth := 0; id != nil && depth < maxFolderDepth; depth++ {
+		folder, err := s.folderRepo.GetByID(*id, userID)
+		if err != nil {
+			return nil, err
+		}
+		path = append([]*Folder{folder}, path...)
+		id = folder.ParentID
+	}
+
+	return path, nil
+}
+
+// getWritableFolder retrieves a folder the user may change: one of their own,
+// or one of a team in which their role allows changes
+func (s *FolderService) getWritableFolder(folderID, userID int) (*Folder, error) {
+	folder, err := s.folderRepo.GetByID(folderID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := workspaceFor(s.teamRepo, userID, folder.TeamID, true); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+func (s *FolderService) ensureNameFree(ws Workspace, parentID *int, name string) error {
+	exists, err := s.folderRepo.ExistsByName(ws, parentID, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrFolderExists
+	}
+	return nil
+}
+
+// sameFolderID reports whether two optional folder IDs name the same folder,
+// nil standing for the root
+func sameFolderID(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// cleanFolderName trims a folder name and rejects unusable ones
+func cleanFolderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", errors.New("invalid folder name")
+	}
+	if len(name) > 255 {
+		return "", errors.New("folder name is too long")
+	}
+	return name, nil
+}
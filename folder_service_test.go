@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanFolderName(t *testing.T) {
+	name, err := cleanFolderName("  Reports 2024 ")
+	assert.NoError(t, err)
+	assert.Equal(t, "Reports 2024", name)
+
+	for _, invalid := range []string{"", "   ", ".", "..", "a/b", `a\b`} {
+		_, err := cleanFolderName(invalid)
+		assert.Error(t, err, "%q should be rejected", invalid)
+	}
+}
+
+func TestParseFolderID(t *testing.T) {
+	folderID, err := parseFolderID("root")
+	assert.NoError(t, err)
+	assert.Nil(t, folderID)
+
+	folderID, err = parseFolderID("42")
+	assert.NoError(t, err)
+	assert.Equal(t, 42, *folderID)
+
+	_, err = parseFolderID("abc")
+	assert.Error(t, err)
+}
+
+func TestMoveFolderToSameParent(t *testing.T) {
+	parentID := 3
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		if strings.HasPrefix(query, "SELECT "+folderColumns+" FROM folders WHERE id = ?") {
+			return fakeRow(folderColumns, int64(5), int64(1), nil, int64(parentID), "Reports", time.Now()), nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	service := NewFolderService(NewFolderRepository(db), nil, nil)
+
+	// The folder's own name must not count as taken
+	folder, err := service.MoveFolder(5, 1, &parentID)
+	require.NoError(t, err)
+	assert.Equal(t, parentID, *folder.ParentID)
+}
+
+func TestCreateFolderLosingARace(t *testing.T) {
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT COUNT(*) FROM folders"):
+			return fakeRow("COUNT(*)", int64(0)), nil
+		case strings.HasPrefix(query, "INSERT INTO folders"):
+			// Another request created the same folder since the name check
+			return fakeReply{}, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	service := NewFolderService(NewFolderRepository(db), nil, nil)
+
+	_, err := service.CreateFolder(1, nil, nil, "Reports")
+	assert.ErrorIs(t, err, ErrFolderExists)
+}
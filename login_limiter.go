@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed attempts")
+
+// LockoutError reports that logins are refused until RetryAfter has passed
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s; try again in %s", ErrTooManyAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockoutError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// Attempt keys are prefixed with what they count
+const (
+	attemptKeyAccount = "account:"
+	attemptKeyIP      = "ip:"
+	attemptKeyShare   = "share:"
+	attemptKeyShareIP = "share-ip:" // Kept apart from logins from the same address
+)
+
+// LockoutPolicy decides how long to refuse logins after failures. The first
+// FreeFailures cost nothing, each further failure doubles the delay starting
+// at BaseDelay, and MaxFailures lock the key for LockoutDuration. Failures
+// are forgotten after Window without any.
+type LockoutPolicy struct {
+	FreeFailures    int
+	MaxFailures     int
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+// recordFailure counts a failure at now and reports whether it locked the
+// key
+func (p LockoutPolicy) recordFailure(attempts *LoginAttempts, now time.Time) bool {
+	if now.Sub(attempts.LastFailureAt) > p.Window {
+		attempts.Failures = 0
+		attempts.Locked = false
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+
+	var delay time.Duration
+	switch {
+	case attempts.Failures >= p.MaxFailures:
+		attempts.Locked = true
+		delay = p.LockoutDuration
+	case attempts.Failures > p.FreeFailures:
+		delay = p.LockoutDuration
+		if shift := attempts.Failures - p.FreeFailures - 1; shift < 32 && p.BaseDelay<<shift < delay {
+			delay = p.BaseDelay << shift
+		}
+	default:
+		return false
+	}
+
+	blockedUntil := now.Add(delay)
+	attempts.BlockedUntil = &blockedUntil
+	return attempts.Locked
+}
+
+// LockoutEvent records an account or IP address being locked out, or an
+// administrator lifting a lockout
+type LockoutEvent struct {
+	Key         string
+	Failures    int
+	LockedUntil *time.Time // Nil when the lockout was lifted
+	UnlockedBy  int        // The administrator who lifted it
+	Time        time.Time
+}
+
+// LoginLimiter tracks failed logins per account and per IP address and
+// refuses further attempts for a while once there are too many. Wrong share
+// link passwords are counted the same way, per share under the account
+// policy and per IP address alongside logins.
+type LoginLimiter struct {
+	store     AttemptStore
+	account   LockoutPolicy
+	ip        LockoutPolicy
+	onLockout func(LockoutEvent)
+	now       func() time.Time
+}
+
+// NewLoginLimiter returns a limiter that counts attempts in store and logs
+// lockout events
+func NewLoginLimiter(store AttemptStore, account, ip LockoutPolicy) *LoginLimiter {
+	return &LoginLimiter{
+		store:     store,
+		account:   account,
+		ip:        ip,
+		onLockout: logLockoutEvent,
+		now:       time.Now,
+	}
+}
+
+// NewLoginLimiterFromEnv configures a limiter from LOGIN_MAX_FAILURES (5),
+// LOGIN_MAX_FAILURES_PER_IP (50), LOGIN_BACKOFF_BASE (1s),
+// LOGIN_LOCKOUT_DURATION (15m) and LOGIN_FAILURE_WINDOW (1h). Backoff starts
+// after half the allowed failures. LOGIN_ATTEMPT_STORE=database shares the
+// counters between instances; by default they are kept in memory.
+func NewLoginLimiterFromEnv(attemptRepo *LoginAttemptRepository) (*LoginLimiter, error) {
+	var store AttemptStore
+	switch backend := os.Getenv("LOGIN_ATTEMPT_STORE"); backend {
+	case "", "memory":
+		store = NewMemoryAttemptStore()
+	case "database":
+		store = attemptRepo
+	default:
+		return nil, fmt.Errorf("unknown LOGIN_ATTEMPT_STORE %q", backend)
+	}
+
+	accountMax, err := intFromEnv("LOGIN_MAX_FAILURES", 5)
+	if err != nil {
+		return nil, err
+	}
+	ipMax, err := intFromEnv("LOGIN_MAX_FAILURES_PER_IP", 50)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := LockoutPolicy{
+		BaseDelay:       durationFromEnv("LOGIN_BACKOFF_BASE", time.Second),
+		LockoutDuration: durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Window:          durationFromEnv("LOGIN_FAILURE_WINDOW", time.Hour),
+	}
+	account, ip := policy, policy
+	account.MaxFailures, account.FreeFailures = accountMax, accountMax/2
+	ip.MaxFailures, ip.FreeFailures = ipMax, ipMax/2
+
+	return NewLoginLimiter(store, account, ip), nil
+}
+
+// OnLockout replaces what happens when a key is locked out or an
+// administrator lifts a lockout; by default the event is logged
+func (l *LoginLimiter) OnLockout(fn func(LockoutEvent)) {
+	l.onLockout = fn
+}
+
+// Check refuses a login while the account or the IP address is blocked
+func (l *LoginLimiter) Check(email, ip string) error {
+	return l.check(attemptKeys(email, ip))
+}
+
+// CheckShare refuses a share link password while the share or the IP
+// address is blocked
+func (l *LoginLimiter) CheckShare(shareID int, ip string) error {
+	return l.check(shareAttemptKeys(shareID, ip))
+}
+
+func (l *LoginLimiter) check(keys []string) error {
+	now := l.now()
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		attempts, err := l.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if attempts != nil && attempts.BlockedUntil != nil && attempts.BlockedUntil.Sub(now) > retryAfter {
+			retryAfter = attempts.BlockedUntil.Sub(now)
+		}
+	}
+
+	if retryAfter > 0 {
+		return &LockoutError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed login against the account and the IP
+// address
+func (l *LoginLimiter) RecordFailure(email, ip string) error {
+	return l.recordFailure(attemptKeys(email, ip))
+}
+
+// RecordShareFailure counts a wrong share link password against the share
+// and the IP address
+func (l *LoginLimiter) RecordShareFailure(shareID int, ip string) error {
+	return l.recordFailure(shareAttemptKeys(shareID, ip))
+}
+
+func (l *LoginLimiter) recordFailure(keys []string) error {
+	now := l.now()
+
+	for _, key := range keys {
+		policy := l.account
+		if strings.HasPrefix(key, attemptKeyIP) || strings.HasPrefix(key, attemptKeyShareIP) {
+			policy = l.ip
+		}
+
+		var locked bool
+		attempts, err := l.store.Update(key, func(attempts *LoginAttempts) {
+			locked = policy.recordFailure(attempts, now)
+		})
+		if err != nil {
+			return err
+		}
+
+		if locked {
+			l.onLockout(LockoutEvent{Key: key, Failures: attempts.Failures, LockedUntil: attempts.BlockedUntil, Time: now})
+		}
+	}
+
+	return nil
+}
+
+// RecordSuccess clears the account's failures. Those of the IP address are
+// kept, so that logging into one account does not reset guessing at others.
+func (l *LoginLimiter) RecordSuccess(email string) error {
+	return l.store.Delete(attemptKeyAccount + normalizeEmail(email))
+}
+
+// Lockouts lists the accounts and IP addresses currently refused
+func (l *LoginLimiter) Lockouts() ([]*LoginAttempts, error) {
+	return l.store.ListBlocked(l.now())
+}
+
+// Unlock lifts the lockout of an account, an IP address or both on behalf of
+// an administrator
+func (l *LoginLimiter) Unlock(email, ip string, adminID int) error {
+	now := l.now()
+	for _, key := range attemptKeys(email, ip) {
+		if err := l.store.Delete(key); err != nil {
+			return err
+		}
+		l.onLockout(LockoutEvent{Key: key, UnlockedBy: adminID, Time: now})
+	}
+	return nil
+}
+
+// Purge forgets failures that are outside the window and no longer block
+func (l *LoginLimiter) Purge() error {
+	now := l.now()
+	window := l.account.Window
+	if l.ip.Window > window {
+		window = l.ip.Window
+	}
+	return l.store.Purge(now.Add(-window), now)
+}
+
+// RunPurger purges stale attempts every interval until stop is closed
+func (l *LoginLimiter) RunPurger(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := l.Purge(); err != nil {
+			log.Printf("Failed to purge login attempts: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logLockoutEvent writes lockout events to the log
+func logLockoutEvent(event LockoutEvent) {
+	kind := "login"
+	if isShareAttemptKey(event.Key) {
+		kind = "share link"
+	}
+
+	if event.LockedUntil == nil {
+		log.Printf("AUDIT %s lockout lifted: %s by user %d", kind, event.Key, event.UnlockedBy)
+		return
+	}
+	log.Printf("AUDIT %s lockout: %s after %d failed attempts, until %s", kind, event.Key, event.Failures, event.LockedUntil.Format(time.RFC3339))
+}
+
+// attemptKeys returns the counters a login attempt touches
+func attemptKeys(email, ip string) []string {
+	var keys []string
+	if email = normalizeEmail(email); email != "" {
+		keys = append(keys, attemptKeyAccount+email)
+	}
+	if ip != "" {
+		keys = append(keys, attemptKeyIP+ip)
+	}
+	return keys
+}
+
+// shareAttemptKeys returns the counters a share link password attempt
+// touches
+func shareAttemptKeys(shareID int, ip string) []string {
+	keys := []string{attemptKeyShare + strconv.Itoa(shareID)}
+	if ip != "" {
+		keys = append(keys, attemptKeyShareIP+ip)
+	}
+	return keys
+}
+
+// isShareAttemptKey reports whether a key counts share link password
+// attempts rather than logins
+func isShareAttemptKey(key string) bool {
+	return strings.HasPrefix(key, attemptKeyShare) || strings.HasPrefix(key, attemptKeyShareIP)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// intFromEnv reads a positive integer setting
+func intFromEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+// AttemptStore keeps failed login counters. MemoryAttemptStore suits a
+// single instance; LoginAttemptRepository shares counters between instances.
+type AttemptStore interface {
+	// Get returns the attempts for key, or nil when there are none
+	Get(key string) (*LoginAttempts, error)
+	// Update applies fn to the attempts for key atomically and returns the
+	// result
+	Update(key string, fn func(*LoginAttempts)) (*LoginAttempts, error)
+	Delete(key string) error
+	ListBlocked(now time.Time) ([]*LoginAttempts, error)
+	// Purge forgets keys without failures since failedBefore that are not
+	// blocked at now
+	Purge(failedBefore, now time.Time) error
+}
+
+// MemoryAttemptStore keeps failed login counters in memory
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*LoginAttempts
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: map[string]*LoginAttempts{}}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *attempts
+	return &copied, nil
+}
+
+func (s *MemoryAttemptStore) Update(key string, fn func(*LoginAttempts)) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = &LoginAttempts{Key: key}
+		s.attempts[key] = attempts
+	}
+	fn(attempts)
+
+	copied := *attempts
+	return &copied, nil
+}
+
+func (s *MemoryAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryAttemptStore) ListBlocked(now time.Time) ([]*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocked := []*LoginAttempts{}
+	for _, attempts := range s.attempts {
+		if attempts.BlockedUntil != nil && attempts.BlockedUntil.After(now) {
+			copied := *attempts
+			blocked = append(blocked, &copied)
+		}
+	}
+	return blocked, nil
+}
+
+func (s *MemoryAttemptStore) Purge(failedBefore, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, attempts := range s.attempts {
+		if attempts.LastFailureAt.Before(failedBefore) && (attempts.BlockedUntil == nil || !attempts.BlockedUntil.After(now)) {
+			delete(s.attempts, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLimiter(now *time.Time) (*LoginLimiter, *[]LockoutEvent) {
+	policy := LockoutPolicy{BaseDelay: time.Second, LockoutDuration: 15 * time.Minute, Window: time.Hour}
+	account, ip := policy, policy
+	account.FreeFailures, account.MaxFailures = 2, 5
+	ip.FreeFailures, ip.MaxFailures = 10, 20
+
+	limiter := NewLoginLimiter(NewMemoryAttemptStore(), account, ip)
+	limiter.now = func() time.Time { return *now }
+
+	var events []LockoutEvent
+	limiter.onLockout = func(event LockoutEvent) { events = append(events, event) }
+	return limiter, &events
+}
+
+func TestLoginLimiterBackoffAndLockout(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter, events := testLimiter(&now)
+
+	retryAfter := func() time.Duration {
+		var lockout *LockoutError
+		if err := limiter.Check("Alice@example.com", "198.51.100.7"); errors.As(err, &lockout) {
+			return lockout.RetryAfter
+		}
+		return 0
+	}
+
+	// Free failures, then a doubling delay
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		require.NoError(t, limiter.RecordFailure("alice@example.com", "198.51.100.7"))
+		assert.Equal(t, want, retryAfter(), "after failure %d", i+1)
+		now = now.Add(want)
+	}
+	assert.Empty(t, *events)
+
+	// The fifth failure locks the account and is audited
+	require.NoError(t, limiter.RecordFailure("alice@example.com", "198.51.100.7"))
+	assert.Equal(t, 15*time.Minute, retryAfter())
+	require.Len(t, *events, 1)
+	assert.Equal(t, "account:alice@example.com", (*events)[0].Key)
+	assert.Equal(t, 5, (*events)[0].Failures)
+
+	// Other accounts from elsewhere are unaffected
+	assert.NoError(t, limiter.Check("bob@example.com", "203.0.113.9"))
+
+	lockouts, err := limiter.Lockouts()
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1, "the address is still within its free failures")
+	assert.True(t, lockouts[0].Locked)
+
+	// An administrator lifts the lockout
+	require.NoError(t, limiter.Unlock("alice@example.com", "", 1))
+	assert.NoError(t, limiter.Check("alice@example.com", ""))
+	assert.Nil(t, (*events)[1].LockedUntil)
+	assert.Equal(t, 1, (*events)[1].UnlockedBy)
+}
+
+func TestLoginLimiterPerIP(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter, events := testLimiter(&now)
+
+	// Spreading guesses over many accounts still trips the address limit
+	for i := 0; i < 20; i++ {
+		require.NoError(t, limiter.RecordFailure(strings.Repeat("x", i+1)+"@example.com", "198.51.100.7"))
+	}
+	now = now.Add(time.Minute)
+
+	err := limiter.Check("new@example.com", "198.51.100.7")
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+	require.NotEmpty(t, *events)
+	assert.Equal(t, "ip:198.51.100.7", (*events)[len(*events)-1].Key)
+
+	// Logging into an account does not reset the address
+	require.NoError(t, limiter.RecordSuccess("new@example.com"))
+	assert.ErrorIs(t, limiter.Check("new@example.com", "198.51.100.7"), ErrTooManyAttempts)
+}
+
+func TestShareFailuresKeptApartFromLogins(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter, events := testLimiter(&now)
+
+	// Guessing share passwords from an address locks it for share links only
+	for i := 0; i < 20; i++ {
+		require.NoError(t, limiter.RecordShareFailure(i+1, "198.51.100.7"))
+	}
+	now = now.Add(time.Minute)
+
+	assert.ErrorIs(t, limiter.CheckShare(99, "198.51.100.7"), ErrTooManyAttempts)
+	assert.NoError(t, limiter.Check("alice@example.com", "198.51.100.7"))
+	require.NotEmpty(t, *events)
+	assert.Equal(t, "share-ip:198.51.100.7", (*events)[len(*events)-1].Key)
+}
+
+func TestLoginLimiterForgetsOldFailures(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter, _ := testLimiter(&now)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, limiter.RecordFailure("alice@example.com", ""))
+	}
+
+	// A success clears the account
+	require.NoError(t, limiter.RecordSuccess("alice@example.com"))
+	require.NoError(t, limiter.RecordFailure("alice@example.com", ""))
+	assert.NoError(t, limiter.Check("alice@example.com", ""))
+
+	// So does a quiet window
+	require.NoError(t, limiter.RecordFailure("alice@example.com", ""))
+	require.NoError(t, limiter.RecordFailure("alice@example.com", ""))
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, limiter.RecordFailure("alice@example.com", ""))
+	assert.NoError(t, limiter.Check("alice@example.com", ""))
+
+	// Purging drops counters outside the window
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, limiter.Purge())
+	attempts, err := limiter.store.Get("account:alice@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, attempts)
+}
+
+func TestLoginRateLimitedResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockAuthService := new(MockAuthService)
+	mockAuthService.On("Login", "alice@example.com", "guess", "192.0.2.1").Return(nil, &LockoutError{RetryAfter: 90*time.Second + time.Millisecond})
+
+	router := gin.New()
+	router.POST("/login", NewAuthController(mockAuthService, nil).Login)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"alice@example.com","password":"guess"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "91", w.Header().Get("Retry-After"))
+}
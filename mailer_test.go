@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTP accepts a single message on a local port and hands back its data
+func fakeSMTP(t *testing.T) (addr string, received <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				body, _ := io.ReadAll(text.DotReader())
+				data <- string(body)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), data
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTP(t)
+
+	mailer := &SMTPMailer{Addr: addr, From: "noreply@example.com"}
+	err := mailer.Send(Message{To: "alice@example.com", Subject: "Hello", Body: "line one\nline two\n"})
+	require.NoError(t, err)
+
+	data := <-received
+	assert.Contains(t, data, "From: noreply@example.com\n")
+	assert.Contains(t, data, "To: alice@example.com\n")
+	assert.Contains(t, data, "Subject: Hello\n")
+	assert.Contains(t, data, "\nline one\nline two\n")
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := &MemoryMailer{}
+	require.NoError(t, mailer.Send(Message{To: "bob@example.com", Subject: "First"}))
+	require.NoError(t, mailer.Send(Message{To: "bob@example.com", Subject: "Second"}))
+
+	messages := mailer.Messages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, "First", messages[0].Subject)
+	assert.Equal(t, "Second", messages[1].Subject)
+}
+
+func TestNewMailerFromEnv(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	mailer, err := NewMailerFromEnv()
+	require.NoError(t, err)
+	assert.IsType(t, LogMailer{}, mailer)
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("MAIL_FROM", "")
+	_, err = NewMailerFromEnv()
+	assert.Error(t, err, "a sender address is required")
+
+	t.Setenv("MAIL_FROM", "noreply@example.com")
+	t.Setenv("SMTP_PORT", "")
+	mailer, err = NewMailerFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "smtp.example.com:587", mailer.(*SMTPMailer).Addr)
+}
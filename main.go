@@ -3,6 +3,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -17,12 +18,17 @@ func main() {
 
 	// Initialize router
 	router := gin.Default()
+	// Only trust X-Forwarded-For from the configured proxies, so clients
+	// cannot pick their own IP address and dodge per-IP login limits
+	if err := router.SetTrustedProxies(parseList(os.Getenv("TRUSTED_PROXIES"), strings.TrimSpace)); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposeHeaders:    []string{"Content-Length", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Expires", "Upload-File-Id"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -33,31 +39,226 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Initialize storage backend
+	storage, err := NewStorageFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
 	// Initialize repositories
 	userRepo := NewUserRepository(db)
 	fileRepo := NewFileRepository(db)
+	versionRepo := NewFileVersionRepository(db)
+	blobRepo := NewBlobRepository(db)
+	folderRepo := NewFolderRepository(db)
+	shareRepo := NewShareRepository(db)
+	grantRepo := NewFileGrantRepository(db)
+	teamRepo := NewTeamRepository(db)
+	tusUploadRepo := NewTusUploadRepository(db)
+	refreshTokenRepo := NewRefreshTokenRepository(db)
+	revokedTokenRepo := NewRevokedTokenRepository(db)
+	userTokenRepo := NewUserTokenRepository(db)
+	recoveryCodeRepo := NewRecoveryCodeRepository(db)
+	apiKeyRepo := NewAPIKeyRepository(db)
+	identityRepo := NewUserIdentityRepository(db)
+	loginAttemptRepo := NewLoginAttemptRepository(db)
+	oidcStateRepo := NewOIDCStateRepository(db)
+	auditRepo := NewAuditRepository(db)
+	webhookRepo := NewWebhookRepository(db)
+	webhookDeliveryRepo := NewWebhookDeliveryRepository(db)
+
+	// Load the upload policy
+	uploadPolicy, err := UploadPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid upload policy: %v", err)
+	}
+
+	// Load the token signing keys; outside development there must be one
+	keyRing, err := KeyRingFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid token signing keys: %v", err)
+	}
+
+	// Initialize the mailer
+	mailer, err := NewMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid mail settings: %v", err)
+	}
+
+	// Initialize brute-force protection for logins, auditing its lockouts
+	auditLog := NewAuditLog(auditRepo)
+	loginLimiter, err := NewLoginLimiterFromEnv(loginAttemptRepo)
+	if err != nil {
+		log.Fatalf("Invalid login limits: %v", err)
+	}
+	loginLimiter.OnLockout(auditLog.RecordLockout)
 
 	// Initialize services
-	authService := NewAuthService(userRepo)
-	fileService := NewFileService(fileRepo)
+	authService := NewAuthService(db, userRepo, refreshTokenRepo, revokedTokenRepo, userTokenRepo, recoveryCodeRepo, identityRepo, keyRing, loginLimiter, mailer)
+	fileService := NewFileService(db, userRepo, fileRepo, versionRepo, blobRepo, folderRepo, shareRepo, grantRepo, teamRepo, storage, uploadPolicy)
+	fileService.LimitSharePasswords(loginLimiter)
+	folderService := NewFolderService(folderRepo, fileRepo, teamRepo)
+	teamService := NewTeamService(db, userRepo, teamRepo, shareRepo, grantRepo)
+	apiKeyService := NewAPIKeyService(apiKeyRepo, userRepo)
+	adminService := NewAdminService(db, userRepo, refreshTokenRepo, fileService)
+
+	// ADMIN_EMAILS names the users to make administrators at startup
+	if err := adminService.PromoteAdmins(parseList(os.Getenv("ADMIN_EMAILS"), normalizeEmail)); err != nil {
+		log.Fatalf("Failed to promote administrators: %v", err)
+	}
+
+	// Single sign-on is optional
+	oidcConfig, err := OIDCConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid single sign-on settings: %v", err)
+	}
+	var oidcService *OIDCService
+	if oidcConfig != nil {
+		oidcService = NewOIDCService(NewOIDCProvider(oidcConfig, nil), oidcStateRepo, authService)
+	}
+
+	// Tell users' webhooks about their files, delivering in the background
+	webhookSettings, err := WebhookSettingsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid webhook settings: %v", err)
+	}
+	webhookService := NewWebhookService(webhookRepo, webhookDeliveryRepo, teamRepo, webhookSettings)
+	fileService.OnFileEvent(webhookService.HandleFileEvent)
+	go webhookService.RunWorker(15*time.Second, nil)
+
+	// Purge expired trash in the background
+	trashRetention, trashPurgeInterval, err := TrashSettingsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid trash settings: %v", err)
+	}
+	go fileService.RunTrashPurger(trashRetention, trashPurgeInterval, nil)
+
+	// Forget expired refresh tokens and denylist entries in the background
+	go authService.RunTokenPurger(time.Hour, nil)
+	go loginLimiter.RunPurger(time.Hour, nil)
+
+	tusService, err := NewTusServiceFromEnv(tusUploadRepo, fileService)
+	if err != nil {
+		log.Fatalf("Failed to initialize resumable uploads: %v", err)
+	}
+	go tusService.RunPurger(time.Hour, nil)
 
 	// Initialize controllers
-	authController := NewAuthController(authService)
-	fileController := NewFileController(fileService)
+	authController := NewAuthController(authService, auditLog)
+	fileController := NewFileController(fileService, folderService, auditLog)
+	folderController := NewFolderController(folderService)
+	teamController := NewTeamController(teamService)
+	tusController := NewTusController(tusService, auditLog)
+	apiKeyController := NewAPIKeyController(apiKeyService)
+	webhookController := NewWebhookController(webhookService)
+	jwksController := NewJWKSController(keyRing)
+	adminController := NewAdminController(adminService, loginLimiter, auditLog)
 
 	// Public routes
 	router.POST("/register", authController.Register)
 	router.POST("/login", authController.Login)
+	router.POST("/login/mfa", authController.LoginMFA)
+	router.POST("/token/refresh", authController.Refresh)
+	router.GET("/.well-known/jwks.json", jwksController.JWKS)
+	router.GET("/email/verify", authController.VerifyEmail)
+	router.POST("/email/verify", authController.VerifyEmail)
+	router.POST("/password/forgot", authController.ForgotPassword)
+	router.POST("/password/reset", authController.ResetPassword)
+	router.GET("/s/:token", fileController.DownloadShare)
+	router.POST("/s/:token", fileController.DownloadShare)
+	router.OPTIONS("/tus", tusController.Options)
+	if oidcService != nil {
+		oidcController := NewOIDCController(oidcService, auditLog)
+		router.GET("/oidc/login", oidcController.Login)
+		router.GET("/oidc/callback", oidcController.Callback)
+	}
+
+	// Account routes, which API keys cannot reach
+	account := router.Group("/")
+	account.Use(authMiddleware(authService, apiKeyService), requireSession())
+	{
+		account.POST("/logout", authController.Logout)
+		account.POST("/email/verify/resend", authController.ResendVerification)
+		account.POST("/me/2fa/enroll", authController.EnrollTOTP)
+		account.POST("/me/2fa/verify", authController.ConfirmTOTP)
+		account.POST("/me/2fa/disable", authController.DisableTOTP)
+
+		account.GET("/me/api-keys", apiKeyController.GetAPIKeys)
+		account.POST("/me/api-keys", apiKeyController.CreateAPIKey)
+		account.DELETE("/me/api-keys/:key_id", apiKeyController.DeleteAPIKey)
 
-	// Protected routes
+		account.GET("/me/webhooks", webhookController.GetWebhooks)
+		account.POST("/me/webhooks", webhookController.CreateWebhook)
+		account.DELETE("/me/webhooks/:webhook_id", webhookController.DeleteWebhook)
+		account.GET("/me/webhooks/:webhook_id/deliveries", webhookController.GetDeliveries)
+	}
+
+	// Administration routes; auditors may look, only admins may change things
+	admin := router.Group("/admin")
+	admin.Use(authMiddleware(authService, apiKeyService), requireSession(), requireRole(RoleAdmin, RoleAuditor))
+	{
+		admin.GET("/users", adminController.GetUsers)
+		admin.PUT("/users/:user_id/role", requireRole(RoleAdmin), adminController.SetRole)
+		admin.POST("/users/:user_id/disable", requireRole(RoleAdmin), adminController.DisableUser)
+		admin.POST("/users/:user_id/enable", requireRole(RoleAdmin), adminController.EnableUser)
+		admin.GET("/files/:file_id", adminController.GetFile)
+		admin.DELETE("/files/:file_id", requireRole(RoleAdmin), adminController.DeleteFile)
+
+		admin.GET("/lockouts", adminController.GetLockouts)
+		admin.POST("/lockouts/unlock", requireRole(RoleAdmin), adminController.Unlock)
+		admin.GET("/audit", adminController.GetAudit)
+	}
+
+	// Protected routes; API keys need files:read for reads and files:write
+	// for everything else. Creating share links and recording checksums
+	// need files:write over GET too.
 	authorized := router.Group("/")
-	authorized.Use(authMiddleware())
+	authorized.Use(authMiddleware(authService, apiKeyService), requireFileScope())
 	{
 		authorized.POST("/upload", fileController.UploadFile)
+		authorized.POST("/upload/batch", fileController.UploadFiles)
 		authorized.GET("/files", fileController.GetUserFiles)
 		authorized.GET("/files/:file_id", fileController.GetFile)
-		authorized.GET("/share/:file_id", fileController.ShareFile)
+		authorized.GET("/files/:file_id/verify", requireScope(ScopeFilesWrite), fileController.VerifyFile)
+		authorized.PUT("/files/:file_id/folder", fileController.MoveFile)
+		authorized.PUT("/files/:file_id/content", fileController.UploadVersion)
+		authorized.GET("/files/:file_id/versions", fileController.GetVersions)
+		authorized.GET("/files/:file_id/versions/:version", fileController.GetVersion)
+		authorized.POST("/files/:file_id/versions/:version/restore", fileController.RestoreVersion)
+		authorized.GET("/share/:file_id", requireScope(ScopeFilesWrite), fileController.ShareFile)
+		authorized.POST("/share/:file_id", requireScope(ScopeFilesWrite), fileController.ShareFile)
+		authorized.DELETE("/share/:token", fileController.RevokeShare)
+		authorized.GET("/files/:file_id/grants", fileController.GetGrants)
+		authorized.POST("/files/:file_id/grants", fileController.GrantAccess)
+		authorized.DELETE("/files/:file_id/grants/:user_id", fileController.RevokeGrant)
+		authorized.GET("/shared-with-me", fileController.GetSharedWithMe)
 		authorized.DELETE("/files/:file_id", fileController.DeleteFile)
+		authorized.GET("/me/usage", fileController.GetUsage)
+
+		authorized.GET("/trash", fileController.GetTrash)
+		authorized.POST("/trash/:file_id/restore", fileController.RestoreFile)
+		authorized.DELETE("/trash/:file_id", fileController.PurgeFile)
+
+		authorized.POST("/folders", folderController.CreateFolder)
+		authorized.PUT("/folders/:folder_id/rename", folderController.RenameFolder)
+		authorized.PUT("/folders/:folder_id/move", folderController.MoveFolder)
+		authorized.DELETE("/folders/:folder_id", folderController.DeleteFolder)
+
+		authorized.GET("/teams", teamController.GetTeams)
+		authorized.POST("/teams", teamController.CreateTeam)
+		authorized.GET("/teams/:team_id/members", teamController.GetMembers)
+		authorized.POST("/teams/:team_id/members", teamController.AddMember)
+		authorized.DELETE("/teams/:team_id/members/:user_id", teamController.RemoveMember)
+	}
+
+	// Resumable upload routes (tus 1.0 core, creation and termination)
+	tus := router.Group("/tus")
+	tus.Use(authMiddleware(authService, apiKeyService), requireFileScope(), tusController.RequireTusResumable())
+	{
+		tus.POST("", tusController.CreateUpload)
+		tus.HEAD("/:upload_id", tusController.GetOffset)
+		tus.PATCH("/:upload_id", tusController.WriteChunk)
+		tus.DELETE("/:upload_id", tusController.Terminate)
 	}
 
 	// Start server
@@ -79,10 +280,14 @@ func main() {
 	}
 }
 
-// authMiddleware validates JWT tokens
-func authMiddleware() gin.HandlerFunc {
+// authMiddleware validates JWT access tokens and personal API keys, taken
+// from a Bearer Authorization header or an X-API-Key header
+func authMiddleware(authService *AuthService, apiKeyService *APIKeyService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
+		if token == "" {
+			token = c.GetHeader("X-API-Key")
+		}
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
 			c.Abort()
@@ -94,18 +299,102 @@ func authMiddleware() gin.HandlerFunc {
 			token = token[7:]
 		}
 
-		claims, err := ValidateToken(token)
+		if IsAPIKey(token) {
+			key, err := apiKeyService.Authenticate(token)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+
+			// Set user ID and key in context
+			c.Set("user_id", key.UserID)
+			c.Set("api_key", key)
+			c.Next()
+			return
+		}
+
+		// Validate the token and make sure it has not been revoked
+		claims, err := authService.Authenticate(token)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Set user ID in context
+		// Set user ID and claims in context
 		c.Set("user_id", claims.UserID)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// requireFileScope limits requests made with an API key to its scopes:
+// files:read for GET and HEAD, files:write for everything else. Requests
+// made with a login session are not limited.
+func requireFileScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := c.Get("api_key")
+		if !ok {
+			c.Next()
+			return
+		}
+
+		scope := ScopeFilesWrite
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			scope = ScopeFilesRead
+		}
+
+		if !key.(*APIKey).HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requireScope limits a route to API keys with scope whatever its method,
+// for GET routes that change something. Requests made with a login session
+// are not limited.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := c.Get("api_key")
+		if ok && !key.(*APIKey).HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+
 		c.Next()
 	}
-	
 }
 
+// requireRole only lets through sessions whose token carries one of roles.
+// API keys have no role, so they never pass.
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := c.Get("claims")
+		if !ok || !contains(roles, claims.(*JWTClaims).Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this resource"})
+			c.Abort()
+			return
+		}
 
+		c.Next()
+	}
+}
+
+// requireSession rejects API keys on routes that manage the account itself
+func requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires logging in; API keys are not accepted"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
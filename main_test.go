@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -21,9 +23,63 @@ func (m *MockAuthService) Register(email, password string) (int, error) {
 	return args.Int(0), args.Error(1)
 }
 
-func (m *MockAuthService) Login(email, password string) (string, error) {
-	args := m.Called(email, password)
-	return args.String(0), args.Error(1)
+func (m *MockAuthService) Login(email, password, ip string) (*LoginResult, error) {
+	args := m.Called(email, password, ip)
+	result, _ := args.Get(0).(*LoginResult)
+	return result, args.Error(1)
+}
+
+func (m *MockAuthService) LoginMFA(mfaToken, code, ip string) (*TokenPair, error) {
+	args := m.Called(mfaToken, code, ip)
+	tokens, _ := args.Get(0).(*TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockAuthService) Refresh(refreshToken string) (*TokenPair, error) {
+	args := m.Called(refreshToken)
+	tokens, _ := args.Get(0).(*TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockAuthService) Logout(claims *JWTClaims, refreshToken string) error {
+	args := m.Called(claims, refreshToken)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) VerifyEmail(token string) error {
+	args := m.Called(token)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) ResendVerification(userID int) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) ForgotPassword(email string) error {
+	args := m.Called(email)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) ResetPassword(token, password string) error {
+	args := m.Called(token, password)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) EnrollTOTP(userID int) (*TOTPEnrollment, error) {
+	args := m.Called(userID)
+	enrollment, _ := args.Get(0).(*TOTPEnrollment)
+	return enrollment, args.Error(1)
+}
+
+func (m *MockAuthService) ConfirmTOTP(userID int, code string) error {
+	args := m.Called(userID, code)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) DisableTOTP(userID int, code string) error {
+	args := m.Called(userID, code)
+	return args.Error(0)
 }
 
 // TestRegisterEndpoint tests the register endpoint
@@ -36,7 +92,7 @@ func TestRegisterEndpoint(t *testing.T) {
 	mockAuthService.On("Register", "test@example.com", "password123").Return(1, nil)
 
 	// Create auth controller with mock service
-	authController := NewAuthController(mockAuthService)
+	authController := NewAuthController(mockAuthService, nil)
 
 	// Create a new router
 	router := gin.Default()
@@ -71,4 +127,196 @@ func TestRegisterEndpoint(t *testing.T) {
 
 	// Verify that the mock was called
 	mockAuthService.AssertExpectations(t)
-}
\ No newline at end of file
+}
+// TestRefreshEndpoint tests rotating and reusing refresh tokens
+func TestRefreshEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockAuthService := new(MockAuthService)
+	mockAuthService.On("Refresh", "fresh").Return(&TokenPair{AccessToken: "access", RefreshToken: "next", TokenType: "Bearer", ExpiresIn: 900}, nil)
+	mockAuthService.On("Refresh", "used").Return(nil, ErrRefreshTokenReused)
+
+	authController := NewAuthController(mockAuthService, nil)
+	router := gin.New()
+	router.POST("/token/refresh", authController.Refresh)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		requestBody, _ := json.Marshal(map[string]string{"refresh_token": token})
+		req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := refresh("fresh")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, "access", response["token"])
+	assert.Equal(t, "next", response["refresh_token"])
+
+	w = refresh("used")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	mockAuthService.AssertExpectations(t)
+}
+
+// TestPasswordResetEndpoints tests requesting and using a reset link
+func TestPasswordResetEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockAuthService := new(MockAuthService)
+	mockAuthService.On("ForgotPassword", "nobody@example.com").Return(nil)
+	mockAuthService.On("ResetPassword", "good", "newpassword").Return(nil)
+	mockAuthService.On("ResetPassword", "used", "newpassword").Return(ErrInvalidUserToken)
+
+	authController := NewAuthController(mockAuthService, nil)
+	router := gin.New()
+	router.POST("/password/forgot", authController.ForgotPassword)
+	router.POST("/password/reset", authController.ResetPassword)
+
+	post := func(path string, body map[string]string) *httptest.ResponseRecorder {
+		requestBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown accounts get the same answer as known ones
+	w := post("/password/forgot", map[string]string{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w = post("/password/reset", map[string]string{"token": "good", "password": "newpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("/password/reset", map[string]string{"token": "used", "password": "newpassword"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/password/reset", map[string]string{"token": "good", "password": "short"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mockAuthService.AssertExpectations(t)
+}
+
+// TestLoginWithMFA tests the two step login of users with a second factor
+func TestLoginWithMFA(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockAuthService := new(MockAuthService)
+	mockAuthService.On("Login", "mfa@example.com", "password123", "192.0.2.1").Return(&LoginResult{MFAToken: "challenge"}, nil)
+	mockAuthService.On("LoginMFA", "challenge", "123456", "192.0.2.1").Return(&TokenPair{AccessToken: "access", RefreshToken: "refresh"}, nil)
+	mockAuthService.On("LoginMFA", "challenge", "000000", "192.0.2.1").Return(nil, ErrInvalidMFACode)
+
+	authController := NewAuthController(mockAuthService, nil)
+	router := gin.New()
+	router.POST("/login", authController.Login)
+	router.POST("/login/mfa", authController.LoginMFA)
+
+	post := func(path string, body map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		requestBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(requestBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.1:40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	// The password alone only yields a challenge
+	w, response := post("/login", map[string]string{"email": "mfa@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mfa_required", response["status"])
+	assert.Equal(t, "challenge", response["mfa_token"])
+	assert.Nil(t, response["token"])
+
+	w, response = post("/login/mfa", map[string]string{"mfa_token": "challenge", "code": "123456"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "access", response["token"])
+
+	w, _ = post("/login/mfa", map[string]string{"mfa_token": "challenge", "code": "000000"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	mockAuthService.AssertExpectations(t)
+}
+
+// TestServeFileRangeAndConditional tests partial and conditional downloads
+func TestServeFileRangeAndConditional(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Store a blob in a temporary local storage
+	storage, err := NewLocalStorage(t.TempDir())
+	assert.NoError(t, err)
+	_, err = storage.Put("blob.bin", strings.NewReader("0123456789"))
+	assert.NoError(t, err)
+
+	file := &File{
+		ID:               1,
+		Filename:         "blob.bin",
+		OriginalFilename: "clip 1.mp4",
+		FilePath:         "blob.bin",
+		MimeType:         "video/mp4",
+		ContentHash:      "abc123",
+		CreatedAt:        time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+	}
+
+	fileController := NewFileController(NewFileService(nil, nil, nil, nil, nil, nil, nil, nil, nil, storage, UploadPolicy{}), nil, nil)
+	router := gin.Default()
+	router.GET("/download", func(ctx *gin.Context) { fileController.serveFile(ctx, file, "") })
+
+	// Range request
+	req, _ := http.NewRequest("GET", "/download", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "2345", w.Body.String())
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, `"abc123"`, w.Header().Get("ETag"))
+	assert.Equal(t, `inline; filename="clip 1.mp4"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "video/mp4", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+
+	// Matching ETag
+	req, _ = http.NewRequest("GET", "/download", nil)
+	req.Header.Set("If-None-Match", `"abc123"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// Not modified since
+	req, _ = http.NewRequest("GET", "/download", nil)
+	req.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// Stale ETag returns the full content
+	req, _ = http.NewRequest("GET", "/download", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	// Markup that could run script is downloaded rather than displayed
+	file.MimeType = "image/svg+xml"
+	req, _ = http.NewRequest("GET", "/download", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, `attachment; filename="clip 1.mp4"`, w.Header().Get("Content-Disposition"))
+}
+
+func TestInlineSafe(t *testing.T) {
+	for _, mimeType := range []string{"image/png", "video/mp4", "audio/mpeg", "application/pdf", "text/plain; charset=utf-8"} {
+		assert.True(t, inlineSafe(mimeType), mimeType)
+	}
+	for _, mimeType := range []string{"", "text/html; charset=utf-8", "image/svg+xml", "application/xhtml+xml", "text/xml", "application/octet-stream"} {
+		assert.False(t, inlineSafe(mimeType), mimeType)
+	}
+}
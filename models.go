@@ -1,28 +1,314 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // User represents a user in the system
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"` // Password is not included in JSON responses
-	CreatedAt time.Time `json:"created_at"`
+	ID              int        `json:"id"`
+	Email           string     `json:"email"`
+	Password        string     `json:"-"` // Password is not included in JSON responses
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	TOTPSecret      string     `json:"-"` // Set but not enabled while enrollment is pending
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at,omitempty"`
+	TOTPLastStep    int64      `json:"-"` // Time step of the last accepted code
+	Role            string     `json:"role"`
+	DisabledAt      *time.Time `json:"disabled_at,omitempty"`
+	TokenGeneration int        `json:"-"` // Bumped to end every access token issued before
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// HasTOTP reports whether the user must give a second factor to log in
+func (u *User) HasTOTP() bool {
+	return u.TOTPEnabledAt != nil && u.TOTPSecret != ""
+}
+
+// IsDisabled reports whether an administrator has disabled the account
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
 }
 
 // File represents a file stored in the system
 type File struct {
-	ID              int       `json:"id"`
-	UserID          int       `json:"user_id"`
-	Filename        string    `json:"filename"`         // System-generated unique filename
-	OriginalFilename string    `json:"original_filename"` // Original file name
-	FilePath        string    `json:"file_path"`
-	FileSize        int64     `json:"file_size"`
-	MimeType        string    `json:"mime_type"`
-	IsPublic        bool      `json:"is_public"`
-	CreatedAt       time.Time `json:"created_at"`
+	ID               int        `json:"id"`
+	UserID           int        `json:"user_id"`
+	Filename         string     `json:"filename"`          // System-generated unique filename
+	OriginalFilename string     `json:"original_filename"` // Original file name
+	FilePath         string     `json:"file_path"`         // Storage key of the file contents
+	FileSize         int64      `json:"file_size"`
+	MimeType         string     `json:"mime_type"`
+	IsPublic         bool       `json:"is_public"`
+	ContentHash      string     `json:"sha256"`    // Hex SHA-256 of the contents
+	ContentMD5       string     `json:"md5"`       // Hex MD5 of the contents
+	FolderID         *int       `json:"folder_id"` // Nil when the file is at the root
+	TeamID           *int       `json:"team_id"`   // Nil when the file is the user's own
+	Version          int        `json:"version"`   // Number of the current version
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        *time.Time `json:"updated_at"`           // When the current version was uploaded
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"` // Set while the file is in the trash
+}
+
+// ModifiedAt returns when the file's current contents were stored
+func (f *File) ModifiedAt() time.Time {
+	if f.UpdatedAt != nil {
+		return *f.UpdatedAt
+	}
+	return f.CreatedAt
+}
+
+// Workspace returns the workspace holding the file
+func (f *File) Workspace() Workspace {
+	return Workspace{UserID: f.UserID, TeamID: f.TeamID}
+}
+
+// FileVersion is an earlier version of a file's contents
+type FileVersion struct {
+	ID          int       `json:"id"`
+	FileID      int       `json:"file_id"`
+	Version     int       `json:"version"`
+	FilePath    string    `json:"-"` // Storage key of the version's contents
+	FileSize    int64     `json:"file_size"`
+	MimeType    string    `json:"mime_type"`
+	ContentHash string    `json:"sha256"`
+	ContentMD5  string    `json:"md5"`
+	Current     bool      `json:"current"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Folder groups files; folders nest through ParentID
+type Folder struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	ParentID  *int      `json:"parent_id"` // Nil for top-level folders
+	TeamID    *int      `json:"team_id"`   // Nil when the folder is the user's own
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Workspace returns the workspace holding the folder
+func (f *Folder) Workspace() Workspace {
+	return Workspace{UserID: f.UserID, TeamID: f.TeamID}
+}
+
+// Workspace is where files and folders live: a user's own files when TeamID
+// is nil, and otherwise a team's, whoever of its members added them
+type Workspace struct {
+	UserID int
+	TeamID *int
+}
+
+// Same reports whether both name the same workspace
+func (w Workspace) Same(other Workspace) bool {
+	if w.TeamID == nil || other.TeamID == nil {
+		return w.TeamID == nil && other.TeamID == nil && w.UserID == other.UserID
+	}
+	return *w.TeamID == *other.TeamID
+}
+
+// Team is a group of users sharing a workspace
+type Team struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"` // The requesting user's role
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TeamMember is a user's membership of a team. Owners manage the members,
+// members add and change files, and viewers only read them.
+type TeamMember struct {
+	TeamID    int       `json:"team_id"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // repositories.go
+
+// Share is a revocable, optionally expiring link to a file
+type Share struct {
+	ID            int        `json:"id"`
+	FileID        int        `json:"file_id"`
+	UserID        int        `json:"user_id"`
+	Token         string     `json:"token"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	MaxDownloads  *int       `json:"max_downloads"`
+	DownloadCount int        `json:"download_count"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	PasswordHash  string     `json:"-"` // Empty when the share is not password protected
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// HasPassword reports whether recipients must supply a password
+func (s *Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// TusUpload is a resumable upload that has not been completed yet
+type TusUpload struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	Metadata  string    `json:"metadata"` // Raw Upload-Metadata header
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RefreshToken is a single-use token exchanged for a new access token.
+// Tokens rotated from the same login share a family.
+type RefreshToken struct {
+	ID        int
+	UserID    int
+	FamilyID  string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// UserToken is a single-use token emailed to a user, either to verify their
+// address or to reset their password
+type UserToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// APIKey is a personal key for scripts and integrations. Only a hash of its
+// secret is stored.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	SecretHash string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope reports whether the key grants scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// FileGrant gives another registered user access to a file. Viewers can
+// read it; editors can also delete it.
+type FileGrant struct {
+	ID        int       `json:"id"`
+	FileID    int       `json:"file_id"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"` // The grantee's address
+	Role      string    `json:"role"`
+	GrantedBy int       `json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SharedFile is a file someone else granted the user access to
+type SharedFile struct {
+	*File
+	Role       string `json:"role"`
+	OwnerEmail string `json:"owner_email"`
+}
+
+// UserIdentity links a user to their subject at a single sign-on provider
+type UserIdentity struct {
+	ID        int
+	UserID    int
+	Issuer    string
+	Subject   string
+	CreatedAt time.Time
+}
+
+// OIDCState is a single sign-on login waiting for the identity provider to
+// redirect back. Only a hash of the state parameter is stored.
+type OIDCState struct {
+	StateHash    string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
+
+// LoginAttempts counts recent failed logins for an account or IP address,
+// identified by Key
+type LoginAttempts struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	BlockedUntil  *time.Time `json:"blocked_until"`
+	Locked        bool       `json:"locked"` // Locked out rather than backing off
+}
+
+// AuditEvent is an entry of the audit log: who did what, from where and to
+// which file
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Action    string    `json:"action"`
+	UserID    *int      `json:"user_id"`         // Nil for anonymous requests such as share downloads
+	Email     string    `json:"email,omitempty"` // The account a login was for
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	FileID    *int      `json:"file_id"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhook is a URL a user registered to be told about events on their
+// files. The secret signs each delivery, so unlike API key secrets it is
+// stored as is.
+type Webhook struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"response_status"`      // Of the last attempt; nil if no response came
+	LastError      string          `json:"last_error,omitempty"` // Why the last attempt failed
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`      // Nil once delivered or given up on
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+// StorageUsage reports how much storage a user occupies
+type StorageUsage struct {
+	UsedBytes      int64       `json:"used_bytes"`
+	QuotaBytes     int64       `json:"quota_bytes"`               // Zero means unlimited
+	RemainingBytes *int64      `json:"remaining_bytes,omitempty"` // Nil when unlimited
+	ByMimeType     []MimeUsage `json:"by_mime_type"`
+}
+
+// MimeUsage is the storage taken by one MIME type. Files counts current
+// files only, while Bytes also includes their earlier versions.
+type MimeUsage struct {
+	MimeType string `json:"mime_type"`
+	Bytes    int64  `json:"bytes"`
+	Files    int    `json:"files"`
+}
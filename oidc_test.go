@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubIdP is a minimal OpenID Connect provider. It issues a code for every
+// authorization request it is told about and enforces PKCE when the code is
+// redeemed.
+type stubIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu     sync.Mutex
+	codes  map[string]url.Values // Authorization request by code
+	claims jwt.MapClaims         // Extra ID token claims, overriding defaults
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &stubIdP{key: key, kid: "stub-key", codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize stands in for the user logging in at the provider and returns
+// the code it would redirect back with
+func (idp *stubIdP) authorize(t *testing.T, authURL string) (code, state string) {
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, idp.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+
+	code, err = randomHex(8)
+	require.NoError(t, err)
+
+	idp.mu.Lock()
+	idp.codes[code] = parsed.Query()
+	idp.mu.Unlock()
+
+	return code, parsed.Query().Get("state")
+}
+
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	idp.mu.Lock()
+	request, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	extra := idp.claims
+	idp.mu.Unlock()
+
+	clientID, secret, _ := r.BasicAuth()
+	switch {
+	case !ok || r.PostForm.Get("grant_type") != "authorization_code":
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case clientID != "files-app" || secret != "s3cret":
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	case r.PostForm.Get("redirect_uri") != request.Get("redirect_uri"):
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case request.Get("code_challenge_method") != "S256" || pkceChallenge(r.PostForm.Get("code_verifier")) != request.Get("code_challenge"):
+		http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            request.Get("client_id"),
+		"sub":            "user-42",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"nonce":          request.Get("nonce"),
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "stub-access-token",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (idp *stubIdP) provider() *OIDCProvider {
+	return NewOIDCProvider(&OIDCConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     "files-app",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://files.example.com/oidc/callback",
+		Scopes:       []string{"openid", "email"},
+	}, idp.server.Client())
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	idp := newStubIdP(t)
+	provider := idp.provider()
+
+	verifier, err := generateSecretToken()
+	require.NoError(t, err)
+
+	authURL, err := provider.AuthCodeURL("the-state", "the-nonce", verifier)
+	require.NoError(t, err)
+
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	query := parsed.Query()
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "files-app", query.Get("client_id"))
+	assert.Equal(t, "openid email", query.Get("scope"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, pkceChallenge(verifier), query.Get("code_challenge"))
+	assert.NotContains(t, authURL, verifier)
+
+	code, state := idp.authorize(t, authURL)
+	assert.Equal(t, "the-state", state)
+
+	identity, err := provider.Exchange(code, verifier, "the-nonce")
+	require.NoError(t, err)
+	assert.Equal(t, &OIDCIdentity{
+		Issuer:        idp.server.URL,
+		Subject:       "user-42",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+	}, identity)
+
+	// Codes are single use
+	_, err = provider.Exchange(code, verifier, "the-nonce")
+	assert.Error(t, err)
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	idp := newStubIdP(t)
+	provider := idp.provider()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		verifier string
+		nonce    string
+	}{
+		{name: "wrong code verifier", verifier: "not-the-verifier"},
+		{name: "wrong nonce", nonce: "other-nonce"},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "someone-else"}},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://evil.example.com"}},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.mu.Lock()
+			idp.claims = tt.claims
+			idp.mu.Unlock()
+
+			verifier, err := generateSecretToken()
+			require.NoError(t, err)
+			authURL, err := provider.AuthCodeURL("state", "nonce", verifier)
+			require.NoError(t, err)
+			code, _ := idp.authorize(t, authURL)
+
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+			nonce := "nonce"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+
+			_, err = provider.Exchange(code, verifier, nonce)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("signed by an unknown key", func(t *testing.T) {
+		idp.mu.Lock()
+		idp.claims = nil
+		idp.mu.Unlock()
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   idp.server.URL,
+			"aud":   "files-app",
+			"sub":   "user-42",
+			"nonce": "nonce",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = idp.kid
+		forged, err := token.SignedString(otherKey)
+		require.NoError(t, err)
+
+		_, err = provider.verifyIDToken(forged, "nonce")
+		assert.Error(t, err)
+	})
+}
+
+func TestOIDCConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "")
+	config, err := OIDCConfigFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com")
+	t.Setenv("OIDC_CLIENT_ID", "")
+	_, err = OIDCConfigFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("OIDC_CLIENT_ID", "files-app")
+	t.Setenv("APP_BASE_URL", "https://files.example.com")
+	config, err = OIDCConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "https://files.example.com/oidc/callback", config.RedirectURL)
+	assert.Equal(t, []string{"openid", "email", "profile"}, config.Scopes)
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/oidc/callback", NewOIDCController(nil, nil).Callback)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/callback?error=access_denied&error_description=User+cancelled", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "User cancelled")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/callback?code=abc", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
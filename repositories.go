@@ -3,17 +3,24 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 )
 
 // UserRepository handles database operations for users
 type UserRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewUserRepository(db *sql.DB) *UserRepository {
+func NewUserRepository(db DBTX) *UserRepository {
 	return &UserRepository{db: db}
 }
 
+// WithTx returns a copy of the repository that runs inside tx
+func (r *UserRepository) WithTx(tx *sql.Tx) *UserRepository {
+	return &UserRepository{db: tx}
+}
+
 func (r *UserRepository) Create(email, hashedPassword string) (int, error) {
 	query := "INSERT INTO users (email, password) VALUES (?, ?)"
 	result, err := r.db.Exec(query, email, hashedPassword)
@@ -30,14 +37,36 @@ func (r *UserRepository) Create(email, hashedPassword string) (int, error) {
 }
 
 func (r *UserRepository) GetByEmail(email string) (*User, error) {
-	query := "SELECT id, email, password, created_at FROM users WHERE email = ?"
-	row := r.db.QueryRow(query, email)
+	query := "SELECT " + userColumns + " FROM users WHERE email = ?"
+	return scanUser(r.db.QueryRow(query, email))
+}
+
+func (r *UserRepository) GetByID(id int) (*User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = ?"
+	return scanUser(r.db.QueryRow(query, id))
+}
+
+// userColumns lists the columns read into a User, in scanUser order
+const userColumns = "id, email, password, email_verified_at, totp_secret, totp_enabled_at, totp_last_step, role, disabled_at, token_generation, created_at"
 
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.CreatedAt)
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Password,
+		&user.EmailVerifiedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.TOTPLastStep,
+		&user.Role,
+		&user.DisabledAt,
+		&user.TokenGeneration,
+		&user.CreatedAt,
+	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -45,35 +74,265 @@ func (r *UserRepository) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (r *UserRepository) GetByID(id int) (*User, error) {
-	query := "SELECT id, email, password, created_at FROM users WHERE id = ?"
-	row := r.db.QueryRow(query, id)
+// List returns users in the order they signed up
+func (r *UserRepository) List(limit, offset int) ([]*User, error) {
+	query := "SELECT " + userColumns + " FROM users ORDER BY id LIMIT ? OFFSET ?"
+	rows, err := r.db.Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var user User
-	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.CreatedAt)
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Count returns the number of users
+func (r *UserRepository) Count() (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (r *UserRepository) SetRole(id int, role string) error {
+	_, err := r.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+	return err
+}
+
+// SetDisabled disables the account at disabledAt, or enables it when
+// disabledAt is nil
+func (r *UserRepository) SetDisabled(id int, disabledAt *time.Time) error {
+	_, err := r.db.Exec("UPDATE users SET disabled_at = ? WHERE id = ?", disabledAt, id)
+	return err
+}
+
+// PromoteByEmail gives the users with the given email addresses role
+func (r *UserRepository) PromoteByEmail(emails []string, role string) error {
+	for _, email := range emails {
+		if _, err := r.db.Exec("UPDATE users SET role = ? WHERE email = ?", role, email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTOTPSecret stores a new, not yet confirmed TOTP secret, turning off
+// any second factor the user had
+func (r *UserRepository) SetTOTPSecret(id int, secret string) error {
+	_, err := r.db.Exec("UPDATE users SET totp_secret = ?, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?", secret, id)
+	return err
+}
+
+// EnableTOTP turns on the second factor once the user has confirmed a code
+func (r *UserRepository) EnableTOTP(id int, now time.Time) error {
+	_, err := r.db.Exec("UPDATE users SET totp_enabled_at = ? WHERE id = ? AND totp_secret <> ''", now, id)
+	return err
+}
+
+// DisableTOTP removes a user's second factor
+func (r *UserRepository) DisableTOTP(id int) error {
+	_, err := r.db.Exec("UPDATE users SET totp_secret = '', totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?", id)
+	return err
+}
+
+// UseTOTPStep records the time step of an accepted code. It reports false
+// when a code from that step or a later one was already used.
+func (r *UserRepository) UseTOTPStep(id int, step int64) (bool, error) {
+	result, err := r.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, id, step)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// UpdatePassword replaces a user's password hash
+func (r *UserRepository) UpdatePassword(id int, hashedPassword string) error {
+	_, err := r.db.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, id)
+	return err
+}
+
+// BumpTokenGeneration moves a user to a new token generation, so that access
+// tokens issued before are no longer accepted
+func (r *UserRepository) BumpTokenGeneration(id int) error {
+	_, err := r.db.Exec("UPDATE users SET token_generation = token_generation + 1 WHERE id = ?", id)
+	return err
+}
+
+// MarkEmailVerified records when a user proved they own their email address
+func (r *UserRepository) MarkEmailVerified(id int, now time.Time) error {
+	_, err := r.db.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL", now, id)
+	return err
+}
+
+// GetUsedBytes returns the storage used by a user
+func (r *UserRepository) GetUsedBytes(userID int) (int64, error) {
+	return r.getUsedBytes("SELECT used_bytes FROM users WHERE id = ?", userID)
+}
+
+// GetPendingBytes returns the full length of a user's unfinished resumable
+// uploads, which count against their quota before they are stored
+func (r *UserRepository) GetPendingBytes(userID int) (int64, error) {
+	var pending int64
+	err := r.db.QueryRow("SELECT COALESCE(SUM(upload_length), 0) FROM tus_uploads WHERE user_id = ?", userID).Scan(&pending)
+	return pending, err
+}
+
+// GetUsedBytesForUpdate returns the storage used by a user and locks their
+// row until the transaction ends
+func (r *UserRepository) GetUsedBytesForUpdate(userID int) (int64, error) {
+	return r.getUsedBytes("SELECT used_bytes FROM users WHERE id = ? FOR UPDATE", userID)
+}
+
+func (r *UserRepository) getUsedBytes(query string, userID int) (int64, error) {
+	var used int64
+	err := r.db.QueryRow(query, userID).Scan(&used)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+
+	return used, nil
+}
+
+// AddUsedBytes adjusts the storage used by a user by delta, never going
+// below zero
+func (r *UserRepository) AddUsedBytes(userID int, delta int64) error {
+	_, err := r.db.Exec("UPDATE users SET used_bytes = GREATEST(used_bytes + ?, 0) WHERE id = ?", delta, userID)
+	return err
+}
+
+// GetUsage returns the storage used by a user in total and per MIME type.
+// Every version of every file counts, including files in the trash.
+func (r *UserRepository) GetUsage(userID int) (*StorageUsage, error) {
+	used, err := r.GetUsedBytes(userID)
+	if err != nil {
+		return nil, err
+	}
+	usage := &StorageUsage{UsedBytes: used, ByMimeType: []MimeUsage{}}
+
+	query := `
+		SELECT mime_type, SUM(file_size), SUM(current) FROM (
+			SELECT COALESCE(mime_type, '') AS mime_type, file_size, 1 AS current
+			FROM files WHERE user_id = ?
+			UNION ALL
+			SELECT COALESCE(v.mime_type, ''), v.file_size, 0
+			FROM file_versions v JOIN files f ON f.id = v.file_id
+			WHERE f.user_id = ?
+		) contents
+		GROUP BY mime_type
+		ORDER BY SUM(file_size) DESC`
+	rows, err := r.db.Query(query, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry MimeUsage
+		if err := rows.Scan(&entry.MimeType, &entry.Bytes, &entry.Files); err != nil {
+			return nil, err
+		}
+		usage.ByMimeType = append(usage.ByMimeType, entry)
+	}
+
+	return usage, rows.Err()
+}
+
+// fileColumns lists the columns read into a File, in scanFile order
+const fileColumns = "id, user_id, filename, original_filename, file_path, file_size, mime_type, is_public, content_hash, content_md5, folder_id, team_id, version, created_at, updated_at, deleted_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// workspaceCondition returns the condition selecting the rows of a
+// workspace, and its argument
+func workspaceCondition(ws Workspace) (string, interface{}) {
+	if ws.TeamID != nil {
+		return "team_id = ?", *ws.TeamID
+	}
+	return "user_id = ? AND team_id IS NULL", ws.UserID
+}
+
+func scanFile(row rowScanner) (*File, error) {
+	var file File
+	err := row.Scan(
+		&file.ID,
+		&file.UserID,
+		&file.Filename,
+		&file.OriginalFilename,
+		&file.FilePath,
+		&file.FileSize,
+		&file.MimeType,
+		&file.IsPublic,
+		&file.ContentHash,
+		&file.ContentMD5,
+		&file.FolderID,
+		&file.TeamID,
+		&file.Version,
+		&file.CreatedAt,
+		&file.UpdatedAt,
+		&file.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+func scanFiles(rows *sql.Rows) ([]*File, error) {
+	var files []*File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return files, nil
 }
 
 // FileRepository handles database operations for files
 type FileRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewFileRepository(db *sql.DB) *FileRepository {
+func NewFileRepository(db DBTX) *FileRepository {
 	return &FileRepository{db: db}
 }
 
+// WithTx returns a copy of the repository that runs inside tx
+func (r *FileRepository) WithTx(tx *sql.Tx) *FileRepository {
+	return &FileRepository{db: tx}
+}
+
 func (r *FileRepository) Create(file *File) (int, error) {
 	query := `
-		INSERT INTO files (user_id, filename, original_filename, file_path, file_size, mime_type, is_public)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO files (user_id, filename, original_filename, file_path, file_size, mime_type, is_public, content_hash, content_md5, folder_id, team_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	result, err := r.db.Exec(
 		query, 
@@ -84,6 +343,10 @@ func (r *FileRepository) Create(file *File) (int, error) {
 		file.FileSize,
 		file.MimeType,
 		file.IsPublic,
+		file.ContentHash,
+		file.ContentMD5,
+		file.FolderID,
+		file.TeamID,
 	)
 	if err != nil {
 		return 0, err
@@ -99,24 +362,13 @@ func (r *FileRepository) Create(file *File) (int, error) {
 
 func (r *FileRepository) GetByID(id int) (*File, error) {
 	query := `
-		SELECT id, user_id, filename, original_filename, file_path, file_size, mime_type, is_public, created_at
+		SELECT `+fileColumns+`
 		FROM files
-		WHERE id = ?
+		WHERE id = ? AND deleted_at IS NULL
 	`
 	row := r.db.QueryRow(query, id)
 
-	var file File
-	err := row.Scan(
-		&file.ID,
-		&file.UserID,
-		&file.Filename,
-		&file.OriginalFilename,
-		&file.FilePath,
-		&file.FileSize,
-		&file.MimeType,
-		&file.IsPublic,
-		&file.CreatedAt,
-	)
+	file, err := scanFile(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("file not found")
@@ -124,92 +376,164 @@ func (r *FileRepository) GetByID(id int) (*File, error) {
 		return nil, err
 	}
 
-	return &file, nil
+	return file, nil
 }
 
-func (r *FileRepository) GetByUserID(userID int) ([]*File, error) {
+// GetByWorkspace returns the files of a workspace that are not in the trash
+func (r *FileRepository) GetByWorkspace(ws Workspace) ([]*File, error) {
+	condition, arg := workspaceCondition(ws)
 	query := `
-		SELECT id, user_id, filename, original_filename, file_path, file_size, mime_type, is_public, created_at
+		SELECT `+fileColumns+`
 		FROM files
-		WHERE user_id = ?
+		WHERE `+condition+` AND deleted_at IS NULL
 		ORDER BY created_at DESC
 	`
-	rows, err := r.db.Query(query, userID)
+	rows, err := r.db.Query(query, arg)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var files []*File
-	for rows.Next() {
-		var file File
-		err := rows.Scan(
-			&file.ID,
-			&file.UserID,
-			&file.Filename,
-			&file.OriginalFilename,
-			&file.FilePath,
-			&file.FileSize,
-			&file.MimeType,
-			&file.IsPublic,
-			&file.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, &file)
-	}
+	return scanFiles(rows)
+}
 
-	if err = rows.Err(); err != nil {
+func (r *FileRepository) SearchByName(ws Workspace, name string) ([]*File, error) {
+	condition, arg := workspaceCondition(ws)
+	query := `
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE `+condition+` AND original_filename LIKE ? AND deleted_at IS NULL
+		ORDER BY created_at DESC
+	`
+	rows, err := r.db.Query(query, arg, "%"+name+"%")
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return files, nil
+	return scanFiles(rows)
 }
 
-func (r *FileRepository) SearchByName(userID int, name string) ([]*File, error) {
+// GetByFolder returns the files directly inside a folder, or at the root
+// when folderID is nil, whose names contain name
+func (r *FileRepository) GetByFolder(ws Workspace, folderID *int, name string) ([]*File, error) {
+	condition, arg := workspaceCondition(ws)
 	query := `
-		SELECT id, user_id, filename, original_filename, file_path, file_size, mime_type, is_public, created_at
+		SELECT ` + fileColumns + `
 		FROM files
-		WHERE user_id = ? AND original_filename LIKE ?
+		WHERE ` + condition + ` AND folder_id <=> ? AND original_filename LIKE ? AND deleted_at IS NULL
 		ORDER BY created_at DESC
 	`
-	rows, err := r.db.Query(query, userID, "%"+name+"%")
+	rows, err := r.db.Query(query, arg, folderID, "%"+name+"%")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var files []*File
-	for rows.Next() {
-		var file File
-		err := rows.Scan(
-			&file.ID,
-			&file.UserID,
-			&file.Filename,
-			&file.OriginalFilename,
-			&file.FilePath,
-			&file.FileSize,
-			&file.MimeType,
-			&file.IsPublic,
-			&file.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
+	return scanFiles(rows)
+}
+
+// CountByFolder returns how many files are directly inside a folder
+func (r *FileRepository) CountByFolder(folderID int) (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM files WHERE folder_id = ? AND deleted_at IS NULL", folderID).Scan(&count)
+	return count, err
+}
+
+func (r *FileRepository) UpdateFolder(id int, userID int, folderID *int) error {
+	query := "UPDATE files SET folder_id = ? WHERE id = ? AND user_id = ?"
+	result, err := r.db.Exec(query, folderID, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("file not found or you don't have permission to move it")
+	}
+
+	return nil
+}
+
+// GetByIDIncludingTrash retrieves a file whatever its owner, including
+// files in the trash
+func (r *FileRepository) GetByIDIncludingTrash(id int) (*File, error) {
+	query := "SELECT " + fileColumns + " FROM files WHERE id = ?"
+	file, err := scanFile(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("file not found")
 		}
-		files = append(files, &file)
+		return nil, err
 	}
 
-	if err = rows.Err(); err != nil {
+	return file, nil
+}
+
+// GetTrashedByID retrieves a file in the trash
+func (r *FileRepository) GetTrashedByID(id int) (*File, error) {
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files
+		WHERE id = ? AND deleted_at IS NOT NULL
+	`
+	file, err := scanFile(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("file not found in trash")
+		}
 		return nil, err
 	}
 
-	return files, nil
+	return file, nil
 }
 
-func (r *FileRepository) Delete(id int, userID int) error {
-	query := "DELETE FROM files WHERE id = ? AND user_id = ?"
-	result, err := r.db.Exec(query, id, userID)
+// GetTrashed returns the files in a workspace's trash, most recently
+// deleted first
+func (r *FileRepository) GetTrashed(ws Workspace) ([]*File, error) {
+	condition, arg := workspaceCondition(ws)
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files
+		WHERE ` + condition + ` AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`
+	rows, err := r.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFiles(rows)
+}
+
+// GetTrashedBefore returns up to limit files of any user that were moved to
+// the trash before cutoff
+func (r *FileRepository) GetTrashedBefore(cutoff time.Time, limit int) ([]*File, error) {
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files
+		WHERE deleted_at IS NOT NULL AND deleted_at < ?
+		ORDER BY deleted_at
+		LIMIT ?
+	`
+	rows, err := r.db.Query(query, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFiles(rows)
+}
+
+// Trash marks a file as deleted without removing it
+func (r *FileRepository) Trash(id int, userID int, now time.Time) error {
+	query := "UPDATE files SET deleted_at = ? WHERE id = ? AND user_id = ? AND deleted_at IS NULL"
+	result, err := r.db.Exec(query, now, id, userID)
 	if err != nil {
 		return err
 	}
@@ -226,9 +550,29 @@ func (r *FileRepository) Delete(id int, userID int) error {
 	return nil
 }
 
-func (r *FileRepository) UpdatePublicStatus(id int, userID int, isPublic bool) error {
-	query := "UPDATE files SET is_public = ? WHERE id = ? AND user_id = ?"
-	result, err := r.db.Exec(query, isPublic, id, userID)
+// Restore takes a file out of the trash, placing it in folderID
+func (r *FileRepository) Restore(id int, userID int, folderID *int) error {
+	query := "UPDATE files SET deleted_at = NULL, folder_id = ? WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL"
+	result, err := r.db.Exec(query, folderID, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("file not found in trash")
+	}
+
+	return nil
+}
+
+func (r *FileRepository) Delete(id int, userID int) error {
+	query := "DELETE FROM files WHERE id = ? AND user_id = ?"
+	result, err := r.db.Exec(query, id, userID)
 	if err != nil {
 		return err
 	}
@@ -239,8 +583,1750 @@ func (r *FileRepository) UpdatePublicStatus(id int, userID int, isPublic bool) e
 	}
 
 	if rowsAffected == 0 {
-		return errors.New("file not found or you don't have permission to update it")
+		return errors.New("file not found or you don't have permission to delete it")
 	}
 
 	return nil
 }
+
+// GetByIDForUpdate reads a file and locks its row until the surrounding
+// transaction ends
+func (r *FileRepository) GetByIDForUpdate(id int) (*File, error) {
+	query := `
+		SELECT ` + fileColumns + `
+		FROM files
+		WHERE id = ? AND deleted_at IS NULL
+		FOR UPDATE
+	`
+	file, err := scanFile(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("file not found")
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// UpdateContent points a file at new contents and records its version
+func (r *FileRepository) UpdateContent(file *File) error {
+	query := `
+		UPDATE files
+		SET file_path = ?, file_size = ?, mime_type = ?, content_hash = ?, content_md5 = ?, version = ?, updated_at = ?
+		WHERE id = ?
+	`
+	_, err := r.db.Exec(
+		query,
+		file.FilePath,
+		file.FileSize,
+		file.MimeType,
+		file.ContentHash,
+		file.ContentMD5,
+		file.Version,
+		file.UpdatedAt,
+		file.ID,
+	)
+	return err
+}
+
+func (r *FileRepository) UpdateChecksums(id int, sha256, md5 string) error {
+	_, err := r.db.Exec("UPDATE files SET content_hash = ?, content_md5 = ? WHERE id = ?", sha256, md5, id)
+	return err
+}
+
+
+// BlobRepository tracks reference counts of content-addressed blobs
+type BlobRepository struct {
+	db DBTX
+}
+
+func NewBlobRepository(db DBTX) *BlobRepository {
+	return &BlobRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *BlobRepository) WithTx(tx *sql.Tx) *BlobRepository {
+	return &BlobRepository{db: tx}
+}
+
+// Acquire adds a reference to a blob, creating its row if needed. It reports
+// whether the caller must store the contents: the row is new, or nothing
+// referenced it and its contents may already be deleted. The row stays
+// locked until the surrounding transaction ends.
+func (r *BlobRepository) Acquire(digest, storageKey string, size int64) (bool, error) {
+	query := `
+		INSERT INTO blobs (digest, storage_key, size, ref_count)
+		VALUES (?, ?, ?, 1)
+		ON DUPLICATE KEY UPDATE ref_count = ref_count + 1
+	`
+	result, err := r.db.Exec(query, digest, storageKey, size)
+	if err != nil {
+		return false, err
+	}
+
+	// MySQL reports 1 affected row for an insert and 2 for an update
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rowsAffected == 1 {
+		return true, nil
+	}
+
+	var refCount int
+	if err := r.db.QueryRow("SELECT ref_count FROM blobs WHERE storage_key = ?", storageKey).Scan(&refCount); err != nil {
+		return false, err
+	}
+	return refCount == 1, nil
+}
+
+// Release drops a reference to the blob stored under storageKey. It reports
+// whether the blob is tracked at all and whether this was its last
+// reference. An unreferenced row is kept, still locked, until DeleteUnused
+// removes it once its contents are gone, so a file acquiring the blob in the
+// meantime keeps the contents alive.
+func (r *BlobRepository) Release(storageKey string) (tracked bool, last bool, err error) {
+	var refCount int
+	err = r.db.QueryRow("SELECT ref_count FROM blobs WHERE storage_key = ? FOR UPDATE", storageKey).Scan(&refCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+
+	_, err = r.db.Exec("UPDATE blobs SET ref_count = GREATEST(ref_count - 1, 0) WHERE storage_key = ?", storageKey)
+	return true, refCount <= 1, err
+}
+
+// LockUnused locks the blob stored under storageKey until the surrounding
+// transaction ends, reporting whether it is tracked and, if so, whether
+// nothing references it any more
+func (r *BlobRepository) LockUnused(storageKey string) (tracked bool, unused bool, err error) {
+	var refCount int
+	err = r.db.QueryRow("SELECT ref_count FROM blobs WHERE storage_key = ? FOR UPDATE", storageKey).Scan(&refCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+
+	return true, refCount == 0, nil
+}
+
+// DeleteUnused removes the row of a blob nothing references
+func (r *BlobRepository) DeleteUnused(storageKey string) error {
+	_, err := r.db.Exec("DELETE FROM blobs WHERE storage_key = ? AND ref_count = 0", storageKey)
+	return err
+}
+
+// GetUnused returns the storage keys of up to limit blobs nothing references,
+// whose contents are still to be deleted
+func (r *BlobRepository) GetUnused(limit int) ([]string, error) {
+	rows, err := r.db.Query("SELECT storage_key FROM blobs WHERE ref_count = 0 LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// ShareRepository handles database operations for share links
+type ShareRepository struct {
+	db DBTX
+}
+
+func NewShareRepository(db DBTX) *ShareRepository {
+	return &ShareRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *ShareRepository) WithTx(tx *sql.Tx) *ShareRepository {
+	return &ShareRepository{db: tx}
+}
+
+func (r *ShareRepository) Create(share *Share) (int, error) {
+	query := `
+		INSERT INTO shares (file_id, user_id, token, expires_at, max_downloads, password_hash)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(
+		query,
+		share.FileID,
+		share.UserID,
+		share.Token,
+		share.ExpiresAt,
+		share.MaxDownloads,
+		share.PasswordHash,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (r *ShareRepository) GetByToken(token string) (*Share, error) {
+	query := `
+		SELECT id, file_id, user_id, token, expires_at, max_downloads, download_count, revoked_at, password_hash, created_at
+		FROM shares
+		WHERE token = ?
+	`
+	row := r.db.QueryRow(query, token)
+
+	var share Share
+	err := row.Scan(
+		&share.ID,
+		&share.FileID,
+		&share.UserID,
+		&share.Token,
+		&share.ExpiresAt,
+		&share.MaxDownloads,
+		&share.DownloadCount,
+		&share.RevokedAt,
+		&share.PasswordHash,
+		&share.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+
+	return &share, nil
+}
+
+// ConsumeDownload atomically counts a download against a share, failing if
+// the share has been revoked, has expired or has no downloads left
+func (r *ShareRepository) ConsumeDownload(id int, now time.Time) error {
+	query := `
+		UPDATE shares SET download_count = download_count + 1
+		WHERE id = ?
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > ?)
+			AND (max_downloads IS NULL OR download_count < max_downloads)
+	`
+	result, err := r.db.Exec(query, id, now)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrShareExpired
+	}
+
+	return nil
+}
+
+// RevokeByTeamMember revokes the share links a user created on a team's
+// files
+func (r *ShareRepository) RevokeByTeamMember(teamID, userID int, now time.Time) error {
+	query := `
+		UPDATE shares SET revoked_at = ?
+		WHERE user_id = ? AND revoked_at IS NULL
+		AND file_id IN (SELECT id FROM files WHERE team_id = ?)
+	`
+	_, err := r.db.Exec(query, now, userID, teamID)
+	return err
+}
+
+func (r *ShareRepository) Revoke(token string, userID int, now time.Time) error {
+	query := "UPDATE shares SET revoked_at = ? WHERE token = ? AND user_id = ? AND revoked_at IS NULL"
+	result, err := r.db.Exec(query, now, token, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrShareNotFound
+	}
+
+	return nil
+}
+
+// TusUploadRepository handles database operations for resumable uploads
+type TusUploadRepository struct {
+	db *sql.DB
+}
+
+func NewTusUploadRepository(db *sql.DB) *TusUploadRepository {
+	return &TusUploadRepository{db: db}
+}
+
+func (r *TusUploadRepository) Create(upload *TusUpload) error {
+	query := `
+		INSERT INTO tus_uploads (id, user_id, upload_length, upload_offset, filename, mime_type, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := r.db.Exec(
+		query,
+		upload.ID,
+		upload.UserID,
+		upload.Length,
+		upload.Offset,
+		upload.Filename,
+		upload.MimeType,
+		upload.Metadata,
+	)
+	return err
+}
+
+func (r *TusUploadRepository) GetByID(id string, userID int) (*TusUpload, error) {
+	query := `
+		SELECT id, user_id, upload_length, upload_offset, filename, mime_type, metadata, created_at
+		FROM tus_uploads
+		WHERE id = ? AND user_id = ?
+	`
+	row := r.db.QueryRow(query, id, userID)
+
+	var upload TusUpload
+	err := row.Scan(
+		&upload.ID,
+		&upload.UserID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Filename,
+		&upload.MimeType,
+		&upload.Metadata,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+func (r *TusUploadRepository) UpdateOffset(id string, offset int64) error {
+	_, err := r.db.Exec("UPDATE tus_uploads SET upload_offset = ? WHERE id = ?", offset, id)
+	return err
+}
+
+func (r *TusUploadRepository) Delete(id string) error {
+	_, err := r.db.Exec("DELETE FROM tus_uploads WHERE id = ?", id)
+	return err
+}
+
+// GetCreatedBefore returns the IDs of up to limit uploads of any user that
+// were started before cutoff
+func (r *TusUploadRepository) GetCreatedBefore(cutoff time.Time, limit int) ([]string, error) {
+	rows, err := r.db.Query("SELECT id FROM tus_uploads WHERE created_at < ? ORDER BY created_at LIMIT ?", cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// FileVersionRepository handles database operations for previous file versions
+type FileVersionRepository struct {
+	db DBTX
+}
+
+func NewFileVersionRepository(db DBTX) *FileVersionRepository {
+	return &FileVersionRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *FileVersionRepository) WithTx(tx *sql.Tx) *FileVersionRepository {
+	return &FileVersionRepository{db: tx}
+}
+
+func (r *FileVersionRepository) Create(version *FileVersion) (int, error) {
+	query := `
+		INSERT INTO file_versions (file_id, version, file_path, file_size, mime_type, content_hash, content_md5, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(
+		query,
+		version.FileID,
+		version.Version,
+		version.FilePath,
+		version.FileSize,
+		version.MimeType,
+		version.ContentHash,
+		version.ContentMD5,
+		version.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (r *FileVersionRepository) GetByFileID(fileID int) ([]*FileVersion, error) {
+	query := `
+		SELECT id, file_id, version, file_path, file_size, mime_type, content_hash, content_md5, created_at
+		FROM file_versions
+		WHERE file_id = ?
+		ORDER BY version DESC
+	`
+	rows, err := r.db.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*FileVersion
+	for rows.Next() {
+		var version FileVersion
+		err := rows.Scan(
+			&version.ID,
+			&version.FileID,
+			&version.Version,
+			&version.FilePath,
+			&version.FileSize,
+			&version.MimeType,
+			&version.ContentHash,
+			&version.ContentMD5,
+			&version.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, &version)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (r *FileVersionRepository) GetByVersion(fileID, versionNumber int) (*FileVersion, error) {
+	query := `
+		SELECT id, file_id, version, file_path, file_size, mime_type, content_hash, content_md5, created_at
+		FROM file_versions
+		WHERE file_id = ? AND version = ?
+	`
+	row := r.db.QueryRow(query, fileID, versionNumber)
+
+	var version FileVersion
+	err := row.Scan(
+		&version.ID,
+		&version.FileID,
+		&version.Version,
+		&version.FilePath,
+		&version.FileSize,
+		&version.MimeType,
+		&version.ContentHash,
+		&version.ContentMD5,
+		&version.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+// FolderRepository handles database operations for folders
+type FolderRepository struct {
+	db DBTX
+}
+
+func NewFolderRepository(db DBTX) *FolderRepository {
+	return &FolderRepository{db: db}
+}
+
+// folderColumns lists the columns read into a Folder, in scanFolder order
+const folderColumns = "id, user_id, team_id, parent_id, name, created_at"
+
+func scanFolder(row rowScanner) (*Folder, error) {
+	var folder Folder
+	if err := row.Scan(&folder.ID, &folder.UserID, &folder.TeamID, &folder.ParentID, &folder.Name, &folder.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func (r *FolderRepository) Create(folder *Folder) (int, error) {
+	query := "INSERT INTO folders (user_id, team_id, parent_id, name) VALUES (?, ?, ?, ?)"
+	result, err := r.db.Exec(query, folder.UserID, folder.TeamID, folder.ParentID, folder.Name)
+	if isDuplicateKey(err) {
+		return 0, ErrFolderExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetByID retrieves a folder the user can see: one of their own, or one of
+// a team they are a member of
+func (r *FolderRepository) GetByID(id int, userID int) (*Folder, error) {
+	query := `
+		SELECT ` + folderColumns + `
+		FROM folders
+		WHERE id = ? AND (user_id = ? AND team_id IS NULL OR team_id IN (SELECT team_id FROM team_members WHERE user_id = ?))
+	`
+	row := r.db.QueryRow(query, id, userID, userID)
+
+	folder, err := scanFolder(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrFolderNotFound
+		}
+		return nil, err
+	}
+
+	return folder, nil
+}
+
+// GetChildren returns the folders directly inside parentID, or the top-level
+// folders when parentID is nil
+func (r *FolderRepository) GetChildren(ws Workspace, parentID *int) ([]*Folder, error) {
+	condition, arg := workspaceCondition(ws)
+	query := `
+		SELECT ` + folderColumns + `
+		FROM folders
+		WHERE ` + condition + ` AND parent_id <=> ?
+		ORDER BY name
+	`
+	rows, err := r.db.Query(query, arg, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []*Folder
+	for rows.Next() {
+		folder, err := scanFolder(rows)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return folders, nil
+}
+
+// ExistsByName reports whether parentID already holds a folder called name
+func (r *FolderRepository) ExistsByName(ws Workspace, parentID *int, name string) (bool, error) {
+	var count int
+	condition, arg := workspaceCondition(ws)
+	query := "SELECT COUNT(*) FROM folders WHERE " + condition + " AND parent_id <=> ? AND name = ?"
+	err := r.db.QueryRow(query, arg, parentID, name).Scan(&count)
+	return count > 0, err
+}
+
+func (r *FolderRepository) Rename(id int, userID int, name string) error {
+	query := "UPDATE folders SET name = ? WHERE id = ? AND user_id = ?"
+	_, err := r.db.Exec(query, name, id, userID)
+	if isDuplicateKey(err) {
+		return ErrFolderExists
+	}
+	return err
+}
+
+func (r *FolderRepository) Move(id int, userID int, parentID *int) error {
+	query := "UPDATE folders SET parent_id = ? WHERE id = ? AND user_id = ?"
+	_, err := r.db.Exec(query, parentID, id, userID)
+	if isDuplicateKey(err) {
+		return ErrFolderExists
+	}
+	return err
+}
+
+func (r *FolderRepository) Delete(id int, userID int) error {
+	query := "DELETE FROM folders WHERE id = ? AND user_id = ?"
+	result, err := r.db.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotFound
+	}
+
+	return nil
+}
+
+// RefreshTokenRepository handles database operations for refresh tokens
+type RefreshTokenRepository struct {
+	db DBTX
+}
+
+func NewRefreshTokenRepository(db DBTX) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *RefreshTokenRepository) WithTx(tx *sql.Tx) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: tx}
+}
+
+func (r *RefreshTokenRepository) Create(token *RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := r.db.Exec(query, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+// GetByHashForUpdate finds a refresh token by its hash and locks it until
+// the transaction ends
+func (r *RefreshTokenRepository) GetByHashForUpdate(tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, used_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = ? FOR UPDATE
+	`
+	var token RefreshToken
+	err := r.db.QueryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// MarkUsed records that a refresh token has been rotated
+func (r *RefreshTokenRepository) MarkUsed(id int, now time.Time) error {
+	_, err := r.db.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+// RevokeFamily revokes every token rotated from the same login
+func (r *RefreshTokenRepository) RevokeFamily(familyID string, now time.Time) error {
+	_, err := r.db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, familyID)
+	return err
+}
+
+// DeleteExpired removes tokens that can no longer be used
+func (r *RefreshTokenRepository) DeleteExpired(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now)
+	return err
+}
+
+// RevokeAllForUser revokes every refresh token a user holds
+func (r *RefreshTokenRepository) RevokeAllForUser(userID int, now time.Time) error {
+	_, err := r.db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	return err
+}
+
+// RevokedTokenRepository handles the denylist of revoked access tokens
+type RevokedTokenRepository struct {
+	db DBTX
+}
+
+func NewRevokedTokenRepository(db DBTX) *RevokedTokenRepository {
+	return &RevokedTokenRepository{db: db}
+}
+
+// Add denies an access token until it expires on its own
+func (r *RevokedTokenRepository) Add(jti string, expiresAt time.Time) error {
+	_, err := r.db.Exec("INSERT IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", jti, expiresAt)
+	return err
+}
+
+// Exists reports whether an access token has been revoked
+func (r *RevokedTokenRepository) Exists(jti string) (bool, error) {
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// DeleteExpired forgets revoked tokens that have expired anyway
+func (r *RevokedTokenRepository) DeleteExpired(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now)
+	return err
+}
+
+// UserTokenRepository handles single-use tokens sent to users by email
+type UserTokenRepository struct {
+	db DBTX
+}
+
+func NewUserTokenRepository(db DBTX) *UserTokenRepository {
+	return &UserTokenRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *UserTokenRepository) WithTx(tx *sql.Tx) *UserTokenRepository {
+	return &UserTokenRepository{db: tx}
+}
+
+func (r *UserTokenRepository) Create(token *UserToken) error {
+	query := `
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := r.db.Exec(query, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+// GetByHashForUpdate finds a token issued for purpose by its hash and locks
+// it until the transaction ends
+func (r *UserTokenRepository) GetByHashForUpdate(purpose, tokenHash string) (*UserToken, error) {
+	query := `
+		SELECT id, user_id, purpose, token_hash, expires_at, used_at, created_at
+		FROM user_tokens WHERE purpose = ? AND token_hash = ? FOR UPDATE
+	`
+	var token UserToken
+	err := r.db.QueryRow(query, purpose, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidUserToken
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// UseAll marks every unused token a user holds for purpose as used
+func (r *UserTokenRepository) UseAll(userID int, purpose string, now time.Time) error {
+	_, err := r.db.Exec("UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL", now, userID, purpose)
+	return err
+}
+
+// DeleteExpired removes tokens that can no longer be used
+func (r *UserTokenRepository) DeleteExpired(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM user_tokens WHERE expires_at < ?", now)
+	return err
+}
+
+// RecoveryCodeRepository handles the one-time codes that stand in for a
+// user's authenticator app
+type RecoveryCodeRepository struct {
+	db DBTX
+}
+
+func NewRecoveryCodeRepository(db DBTX) *RecoveryCodeRepository {
+	return &RecoveryCodeRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *RecoveryCodeRepository) WithTx(tx *sql.Tx) *RecoveryCodeRepository {
+	return &RecoveryCodeRepository{db: tx}
+}
+
+// Replace discards a user's recovery codes and stores new code hashes
+func (r *RecoveryCodeRepository) Replace(userID int, codeHashes []string) error {
+	if err := r.DeleteAll(userID); err != nil {
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err := r.db.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Use spends a recovery code, reporting false if the user holds no unused
+// code with that hash
+func (r *RecoveryCodeRepository) Use(userID int, codeHash string, now time.Time) (bool, error) {
+	result, err := r.db.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", now, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// CountUnused returns how many recovery codes a user has left
+func (r *RecoveryCodeRepository) CountUnused(userID int) (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// DeleteAll removes every recovery code of a user
+func (r *RecoveryCodeRepository) DeleteAll(userID int) error {
+	_, err := r.db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	return err
+}
+
+// APIKeyRepository handles database operations for personal API keys
+type APIKeyRepository struct {
+	db DBTX
+}
+
+func NewAPIKeyRepository(db DBTX) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+// apiKeyColumns lists the columns read into an APIKey, in scanAPIKey order
+const apiKeyColumns = "id, user_id, name, prefix, secret_hash, scopes, last_used_at, expires_at, created_at"
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.SecretHash,
+		&scopes,
+		&key.LastUsedAt,
+		&key.ExpiresAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	return &key, nil
+}
+
+func (r *APIKeyRepository) Create(key *APIKey) (int, error) {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, secret_hash, scopes, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(query, key.UserID, key.Name, key.Prefix, key.SecretHash, strings.Join(key.Scopes, ","), key.ExpiresAt, key.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (r *APIKeyRepository) GetByPrefix(prefix string) (*APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE prefix = ?"
+	key, err := scanAPIKey(r.db.QueryRow(query, prefix))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *APIKeyRepository) GetByUserID(userID int) ([]*APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE user_id = ? ORDER BY created_at DESC"
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Touch records that a key was used. Writes are skipped when the recorded
+// time is less than a minute old, so busy keys do not write on every request.
+func (r *APIKeyRepository) Touch(id int, now time.Time) error {
+	query := "UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)"
+	_, err := r.db.Exec(query, now, id, now.Add(-time.Minute))
+	return err
+}
+
+func (r *APIKeyRepository) Delete(id, userID int) error {
+	result, err := r.db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// UserIdentityRepository handles database operations for single sign-on
+// identities
+type UserIdentityRepository struct {
+	db DBTX
+}
+
+func NewUserIdentityRepository(db DBTX) *UserIdentityRepository {
+	return &UserIdentityRepository{db: db}
+}
+
+// WithTx returns a repository that runs its queries in tx
+func (r *UserIdentityRepository) WithTx(tx *sql.Tx) *UserIdentityRepository {
+	return &UserIdentityRepository{db: tx}
+}
+
+func (r *UserIdentityRepository) Create(identity *UserIdentity) error {
+	query := "INSERT INTO user_identities (user_id, issuer, subject, created_at) VALUES (?, ?, ?, ?)"
+	_, err := r.db.Exec(query, identity.UserID, identity.Issuer, identity.Subject, identity.CreatedAt)
+	return err
+}
+
+// GetUserID returns the user linked to a provider subject
+func (r *UserIdentityRepository) GetUserID(issuer, subject string) (int, error) {
+	var userID int
+	err := r.db.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// OIDCStateRepository handles database operations for single sign-on logins
+// in progress
+type OIDCStateRepository struct {
+	db DBTX
+}
+
+func NewOIDCStateRepository(db DBTX) *OIDCStateRepository {
+	return &OIDCStateRepository{db: db}
+}
+
+func (r *OIDCStateRepository) Create(state *OIDCState) error {
+	query := "INSERT INTO oidc_states (state_hash, nonce, code_verifier, expires_at, created_at) VALUES (?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(query, state.StateHash, state.Nonce, state.CodeVerifier, state.ExpiresAt, state.CreatedAt)
+	return err
+}
+
+// Take returns a login state and deletes it, so each state is used at most
+// once even when the callback is replayed concurrently
+func (r *OIDCStateRepository) Take(stateHash string) (*OIDCState, error) {
+	var state OIDCState
+	query := "SELECT state_hash, nonce, code_verifier, expires_at, created_at FROM oidc_states WHERE state_hash = ?"
+	err := r.db.QueryRow(query, stateHash).Scan(&state.StateHash, &state.Nonce, &state.CodeVerifier, &state.ExpiresAt, &state.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOIDCStateInvalid
+		}
+		return nil, err
+	}
+
+	result, err := r.db.Exec("DELETE FROM oidc_states WHERE state_hash = ?", stateHash)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	return &state, nil
+}
+
+// DeleteExpired removes logins that were abandoned at the identity provider
+func (r *OIDCStateRepository) DeleteExpired(now time.Time) error {
+	_, err := r.db.Exec("DELETE FROM oidc_states WHERE expires_at < ?", now)
+	return err
+}
+
+// LoginAttemptRepository keeps failed login counters in the database so
+// every instance sees the same ones. It implements AttemptStore.
+type LoginAttemptRepository struct {
+	db *sql.DB
+}
+
+func NewLoginAttemptRepository(db *sql.DB) *LoginAttemptRepository {
+	return &LoginAttemptRepository{db: db}
+}
+
+// loginAttemptColumns lists the columns read into LoginAttempts, in
+// scanLoginAttempts order
+const loginAttemptColumns = "attempt_key, failures, last_failure_at, blocked_until, locked"
+
+func scanLoginAttempts(row rowScanner) (*LoginAttempts, error) {
+	var attempts LoginAttempts
+	err := row.Scan(&attempts.Key, &attempts.Failures, &attempts.LastFailureAt, &attempts.BlockedUntil, &attempts.Locked)
+	if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+func (r *LoginAttemptRepository) Get(key string) (*LoginAttempts, error) {
+	query := "SELECT " + loginAttemptColumns + " FROM login_attempts WHERE attempt_key = ?"
+	attempts, err := scanLoginAttempts(r.db.QueryRow(query, key))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return attempts, err
+}
+
+// Update locks the row for key while fn changes it, so concurrent failures
+// on several instances are all counted
+func (r *LoginAttemptRepository) Update(key string, fn func(*LoginAttempts)) (*LoginAttempts, error) {
+	var attempts *LoginAttempts
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		// Make sure the row exists so there is something to lock
+		_, err := tx.Exec("INSERT IGNORE INTO login_attempts (attempt_key, last_failure_at) VALUES (?, ?)", key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		query := "SELECT " + loginAttemptColumns + " FROM login_attempts WHERE attempt_key = ? FOR UPDATE"
+		attempts, err = scanLoginAttempts(tx.QueryRow(query, key))
+		if err != nil {
+			return err
+		}
+
+		fn(attempts)
+
+		_, err = tx.Exec(
+			"UPDATE login_attempts SET failures = ?, last_failure_at = ?, blocked_until = ?, locked = ? WHERE attempt_key = ?",
+			attempts.Failures, attempts.LastFailureAt, attempts.BlockedUntil, attempts.Locked, key,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+func (r *LoginAttemptRepository) Delete(key string) error {
+	_, err := r.db.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key)
+	return err
+}
+
+func (r *LoginAttemptRepository) ListBlocked(now time.Time) ([]*LoginAttempts, error) {
+	query := "SELECT " + loginAttemptColumns + " FROM login_attempts WHERE blocked_until > ? ORDER BY blocked_until DESC"
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := []*LoginAttempts{}
+	for rows.Next() {
+		attempts, err := scanLoginAttempts(rows)
+		if err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, attempts)
+	}
+
+	return blocked, rows.Err()
+}
+
+func (r *LoginAttemptRepository) Purge(failedBefore, now time.Time) error {
+	_, err := r.db.Exec(
+		"DELETE FROM login_attempts WHERE last_failure_at < ? AND (blocked_until IS NULL OR blocked_until <= ?)",
+		failedBefore, now,
+	)
+	return err
+}
+
+// FileGrantRepository handles database operations for file grants
+type FileGrantRepository struct {
+	db DBTX
+}
+
+func NewFileGrantRepository(db DBTX) *FileGrantRepository {
+	return &FileGrantRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *FileGrantRepository) WithTx(tx *sql.Tx) *FileGrantRepository {
+	return &FileGrantRepository{db: tx}
+}
+
+// DeleteGrantedByTeamMember removes the grants a user handed out on a team's
+// files
+func (r *FileGrantRepository) DeleteGrantedByTeamMember(teamID, userID int) error {
+	query := "DELETE FROM file_grants WHERE granted_by = ? AND file_id IN (SELECT id FROM files WHERE team_id = ?)"
+	_, err := r.db.Exec(query, userID, teamID)
+	return err
+}
+
+// Upsert grants a user access to a file, changing the role of an existing
+// grant
+func (r *FileGrantRepository) Upsert(grant *FileGrant) error {
+	query := `
+		INSERT INTO file_grants (file_id, user_id, role, granted_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE role = VALUES(role), granted_by = VALUES(granted_by)
+	`
+	_, err := r.db.Exec(query, grant.FileID, grant.UserID, grant.Role, grant.GrantedBy, grant.CreatedAt)
+	return err
+}
+
+// GetRole returns the user's role on a file, or an empty string without a
+// grant
+func (r *FileGrantRepository) GetRole(fileID, userID int) (string, error) {
+	var role string
+	err := r.db.QueryRow("SELECT role FROM file_grants WHERE file_id = ? AND user_id = ?", fileID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// GetByFileID lists a file's grants with the grantees' email addresses
+func (r *FileGrantRepository) GetByFileID(fileID int) ([]*FileGrant, error) {
+	query := `
+		SELECT g.id, g.file_id, g.user_id, u.email, g.role, g.granted_by, g.created_at
+		FROM file_grants g JOIN users u ON u.id = g.user_id
+		WHERE g.file_id = ?
+		ORDER BY g.created_at
+	`
+	rows, err := r.db.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []*FileGrant{}
+	for rows.Next() {
+		var grant FileGrant
+		if err := rows.Scan(&grant.ID, &grant.FileID, &grant.UserID, &grant.Email, &grant.Role, &grant.GrantedBy, &grant.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, &grant)
+	}
+
+	return grants, rows.Err()
+}
+
+func (r *FileGrantRepository) Delete(fileID, userID int) error {
+	result, err := r.db.Exec("DELETE FROM file_grants WHERE file_id = ? AND user_id = ?", fileID, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrGrantNotFound
+	}
+
+	return nil
+}
+
+// GetSharedWith lists the files in nobody's trash that others granted the
+// user access to, newest first
+func (r *FileGrantRepository) GetSharedWith(userID int) ([]*SharedFile, error) {
+	query := `
+		SELECT ` + fileColumns + `,
+			(SELECT role FROM file_grants WHERE file_id = files.id AND user_id = ?),
+			(SELECT email FROM users WHERE users.id = files.user_id)
+		FROM files
+		WHERE deleted_at IS NULL AND id IN (SELECT file_id FROM file_grants WHERE user_id = ?)
+		ORDER BY created_at DESC
+	`
+	rows, err := r.db.Query(query, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*SharedFile{}
+	for rows.Next() {
+		var shared SharedFile
+		shared.File, err = scanFile(extraColumns{rows, []interface{}{&shared.Role, &shared.OwnerEmail}})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &shared)
+	}
+
+	return files, rows.Err()
+}
+
+// extraColumns scans the columns after those a scan function reads into
+// extra
+type extraColumns struct {
+	row   rowScanner
+	extra []interface{}
+}
+
+func (e extraColumns) Scan(dest ...interface{}) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// TeamRepository handles database operations for teams and their members
+type TeamRepository struct {
+	db DBTX
+}
+
+func NewTeamRepository(db DBTX) *TeamRepository {
+	return &TeamRepository{db: db}
+}
+
+// WithTx returns a copy of the repository that runs inside tx
+func (r *TeamRepository) WithTx(tx *sql.Tx) *TeamRepository {
+	return &TeamRepository{db: tx}
+}
+
+func (r *TeamRepository) Create(team *Team) (int, error) {
+	result, err := r.db.Exec("INSERT INTO teams (name, created_by, created_at) VALUES (?, ?, ?)", team.Name, team.CreatedBy, team.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetForUser lists the teams the user is a member of, with their role in
+// each
+func (r *TeamRepository) GetForUser(userID int) ([]*Team, error) {
+	query := `
+		SELECT t.id, t.name, m.role, t.created_by, t.created_at
+		FROM teams t JOIN team_members m ON m.team_id = t.id
+		WHERE m.user_id = ?
+		ORDER BY t.name
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	teams := []*Team{}
+	for rows.Next() {
+		var team Team
+		if err := rows.Scan(&team.ID, &team.Name, &team.Role, &team.CreatedBy, &team.CreatedAt); err != nil {
+			return nil, err
+		}
+		teams = append(teams, &team)
+	}
+
+	return teams, rows.Err()
+}
+
+// GetRole returns the user's role in a team, or an empty string when they
+// are not a member
+func (r *TeamRepository) GetRole(teamID, userID int) (string, error) {
+	var role string
+	err := r.db.QueryRow("SELECT role FROM team_members WHERE team_id = ? AND user_id = ?", teamID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// GetMembers lists a team's members with their email addresses
+func (r *TeamRepository) GetMembers(teamID int) ([]*TeamMember, error) {
+	query := `
+		SELECT m.team_id, m.user_id, u.email, m.role, m.created_at
+		FROM team_members m JOIN users u ON u.id = m.user_id
+		WHERE m.team_id = ?
+		ORDER BY m.created_at
+	`
+	rows, err := r.db.Query(query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*TeamMember{}
+	for rows.Next() {
+		var member TeamMember
+		if err := rows.Scan(&member.TeamID, &member.UserID, &member.Email, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+
+	return members, rows.Err()
+}
+
+// GetOwnersForUpdate returns the IDs of a team's owners and locks their
+// memberships until the surrounding transaction ends
+func (r *TeamRepository) GetOwnersForUpdate(teamID int) ([]int, error) {
+	rows, err := r.db.Query("SELECT user_id FROM team_members WHERE team_id = ? AND role = ? FOR UPDATE", teamID, TeamRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		owners = append(owners, userID)
+	}
+
+	return owners, rows.Err()
+}
+
+// UpsertMember adds a user to a team, changing the role of an existing
+// member
+func (r *TeamRepository) UpsertMember(member *TeamMember) error {
+	query := `
+		INSERT INTO team_members (team_id, user_id, role, created_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE role = VALUES(role)
+	`
+	_, err := r.db.Exec(query, member.TeamID, member.UserID, member.Role, member.CreatedAt)
+	return err
+}
+
+func (r *TeamRepository) RemoveMember(teamID, userID int) error {
+	result, err := r.db.Exec("DELETE FROM team_members WHERE team_id = ? AND user_id = ?", teamID, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTeamMemberNotFound
+	}
+
+	return nil
+}
+
+// AuditRepository appends to and reads the audit log. It has no way to
+// change or remove events.
+type AuditRepository struct {
+	db DBTX
+}
+
+func NewAuditRepository(db DBTX) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// auditColumns lists the columns read into an AuditEvent, in scanAuditEvent
+// order
+const auditColumns = "id, action, user_id, email, ip, user_agent, file_id, detail, created_at"
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	var event AuditEvent
+	err := row.Scan(
+		&event.ID,
+		&event.Action,
+		&event.UserID,
+		&event.Email,
+		&event.IP,
+		&event.UserAgent,
+		&event.FileID,
+		&event.Detail,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (r *AuditRepository) Append(event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (action, user_id, email, ip, user_agent, file_id, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(query, event.Action, event.UserID, event.Email, event.IP, event.UserAgent, event.FileID, event.Detail, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	event.ID, err = result.LastInsertId()
+	return err
+}
+
+// Find returns up to limit events matching filter, newest first
+func (r *AuditRepository) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if filter.Action != "" {
+		add("action = ?", filter.Action)
+	}
+	if filter.UserID != nil {
+		add("user_id = ?", *filter.UserID)
+	}
+	if filter.FileID != nil {
+		add("file_id = ?", *filter.FileID)
+	}
+	if filter.IP != "" {
+		add("ip = ?", filter.IP)
+	}
+	if filter.Since != nil {
+		add("created_at >= ?", *filter.Since)
+	}
+	if filter.Until != nil {
+		add("created_at < ?", *filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		add("id < ?", filter.BeforeID)
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+
+	rows, err := r.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// WebhookRepository handles database operations for webhooks
+type WebhookRepository struct {
+	db DBTX
+}
+
+func NewWebhookRepository(db DBTX) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+// webhookColumns lists the columns read into a Webhook, in scanWebhook order
+const webhookColumns = "id, user_id, url, events, secret, created_at"
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var webhook Webhook
+	var events string
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.UserID,
+		&webhook.URL,
+		&events,
+		&webhook.Secret,
+		&webhook.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.Events = strings.Split(events, ",")
+	return &webhook, nil
+}
+
+func (r *WebhookRepository) Create(webhook *Webhook) (int, error) {
+	query := `
+		INSERT INTO webhooks (user_id, url, events, secret, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(query, webhook.UserID, webhook.URL, strings.Join(webhook.Events, ","), webhook.Secret, webhook.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetByID retrieves a webhook whoever registered it
+func (r *WebhookRepository) GetByID(id int) (*Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE id = ?"
+	webhook, err := scanWebhook(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+func (r *WebhookRepository) GetByUserID(userID int) ([]*Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE user_id = ? ORDER BY created_at DESC"
+	return r.query(query, userID)
+}
+
+// GetSubscribed retrieves the user's webhooks that want event
+func (r *WebhookRepository) GetSubscribed(userID int, event string) ([]*Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE user_id = ? AND FIND_IN_SET(?, events) > 0"
+	return r.query(query, userID, event)
+}
+
+func (r *WebhookRepository) CountByUserID(userID int) (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE user_id = ?", userID).Scan(&count)
+	return count, err
+}
+
+// Delete removes a webhook together with its deliveries
+func (r *WebhookRepository) Delete(id, userID int) error {
+	result, err := r.db.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+func (r *WebhookRepository) query(query string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// WebhookDeliveryRepository handles database operations for webhook
+// deliveries
+type WebhookDeliveryRepository struct {
+	db DBTX
+}
+
+func NewWebhookDeliveryRepository(db DBTX) *WebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{db: db}
+}
+
+// webhookDeliveryColumns lists the columns read into a WebhookDelivery, in
+// scanWebhookDelivery order
+const webhookDeliveryColumns = "id, webhook_id, event, payload, status, attempts, response_status, last_error, next_attempt_at, created_at, delivered_at"
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.NextAttemptAt,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = []byte(payload)
+	return &delivery, nil
+}
+
+func (r *WebhookDeliveryRepository) Create(delivery *WebhookDelivery) (int64, error) {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	result, err := r.db.Exec(query, delivery.WebhookID, delivery.Event, string(delivery.Payload), delivery.Status, delivery.NextAttemptAt, delivery.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// GetDue retrieves up to limit pending deliveries whose next attempt is due,
+// the longest waiting first
+func (r *WebhookDeliveryRepository) GetDue(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?"
+	return r.query(query, WebhookPending, now, limit)
+}
+
+// GetByWebhookID retrieves a page of a webhook's deliveries, newest first
+func (r *WebhookDeliveryRepository) GetByWebhookID(webhookID, limit, offset int) ([]*WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	return r.query(query, webhookID, limit, offset)
+}
+
+// Claim postpones a due delivery until leaseUntil, reporting whether this
+// caller got it. Instances sharing the database thus never send the same
+// attempt twice, and a delivery whose sender died is retried after the lease.
+func (r *WebhookDeliveryRepository) Claim(id int64, now, leaseUntil time.Time) (bool, error) {
+	query := "UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at <= ?"
+	result, err := r.db.Exec(query, leaseUntil, id, WebhookPending, now)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// UpdateAttempt saves the outcome of an attempt to send a delivery
+func (r *WebhookDeliveryRepository) UpdateAttempt(delivery *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?
+	`
+	_, err := r.db.Exec(query, delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.LastError, delivery.NextAttemptAt, delivery.DeliveredAt, delivery.ID)
+	return err
+}
+
+func (r *WebhookDeliveryRepository) query(query string, args ...interface{}) ([]*WebhookDelivery, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
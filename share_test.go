@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shareRowColumns = "id, file_id, user_id, token, expires_at, max_downloads, download_count, revoked_at, password_hash, created_at"
+
+// shareDB serves one share and its file, keeping the share's download count
+// as the shares table would
+func shareDB(t *testing.T, share *Share, file *File) *sql.DB {
+	return openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.Contains(query, "FROM shares WHERE token = ?"):
+			if args[0] != share.Token {
+				return fakeReply{}, nil
+			}
+			return fakeRow(shareRowColumns,
+				int64(share.ID), int64(share.FileID), int64(share.UserID), share.Token, timeValue(share.ExpiresAt),
+				optionalValue(share.MaxDownloads), int64(share.DownloadCount), timeValue(share.RevokedAt),
+				share.PasswordHash, share.CreatedAt), nil
+		case strings.HasPrefix(query, "UPDATE shares SET download_count"):
+			now := args[1].(time.Time)
+			if share.RevokedAt != nil || (share.ExpiresAt != nil && !share.ExpiresAt.After(now)) ||
+				(share.MaxDownloads != nil && share.DownloadCount >= *share.MaxDownloads) {
+				return fakeReply{}, nil
+			}
+			share.DownloadCount++
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.Contains(query, "FROM files WHERE id = ?"):
+			return fakeRow(fileColumns, fileValues(file)...), nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+}
+
+// shareRouter serves the share link routes from a file service holding a
+// single share of a ten byte file, limiting password attempts with limiter
+// unless it is nil
+func shareRouter(t *testing.T, share *Share, limiter *LoginLimiter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	_, err = storage.Put("blob.bin", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+
+	file := &File{ID: share.FileID, UserID: share.UserID, OriginalFilename: "notes.txt", FilePath: "blob.bin", MimeType: "text/plain", ContentHash: "abc123", Version: 1, CreatedAt: time.Now().Add(-time.Hour)}
+	db := shareDB(t, share, file)
+	fileService := NewFileService(db, nil, NewFileRepository(db), nil, nil, nil, NewShareRepository(db), nil, nil, storage, UploadPolicy{})
+	if limiter != nil {
+		fileService.LimitSharePasswords(limiter)
+	}
+
+	router := gin.New()
+	router.GET("/s/:token", NewFileController(fileService, nil, nil).DownloadShare)
+	router.POST("/s/:token", NewFileController(fileService, nil, nil).DownloadShare)
+	return router
+}
+
+func getShare(router *gin.Engine, header, value string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/s/token", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func postShare(router *gin.Engine, path, password string) *httptest.ResponseRecorder {
+	form := url.Values{"password": {password}}
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimitedShareCannotBeDrainedWithRanges(t *testing.T) {
+	maxDownloads := 2
+	share := &Share{ID: 1, FileID: 7, UserID: 3, Token: "token", MaxDownloads: &maxDownloads, CreatedAt: time.Now()}
+	router := shareRouter(t, share, nil)
+
+	// Ranged and conditional requests get the whole file and are counted
+	w := getShare(router, "Range", "bytes=1-")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	w = getShare(router, "If-None-Match", `"abc123"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, share.DownloadCount)
+
+	// The limit is used up whichever way the file is asked for
+	for _, rangeHeader := range []string{"bytes=0-0", "bytes=0-0,1-", "bytes=5-"} {
+		w = getShare(router, "Range", rangeHeader)
+		assert.Equal(t, http.StatusGone, w.Code, rangeHeader)
+	}
+	assert.Equal(t, 2, share.DownloadCount)
+}
+
+func TestUnlimitedShareCountsDeliveredContent(t *testing.T) {
+	share := &Share{ID: 1, FileID: 7, UserID: 3, Token: "token", CreatedAt: time.Now()}
+	router := shareRouter(t, share, nil)
+
+	// Seeking still works, and every part sent is counted
+	w := getShare(router, "Range", "bytes=1-3")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "123", w.Body.String())
+	assert.Equal(t, 1, share.DownloadCount)
+
+	// Revalidating a cached copy sends nothing and counts nothing
+	w = getShare(router, "If-None-Match", `"abc123"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, 1, share.DownloadCount)
+}
+
+func TestLimitedShareKeepsDownloadWhenStorageFails(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// The file's contents are missing from storage
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+
+	maxDownloads := 1
+	share := &Share{ID: 1, FileID: 7, UserID: 3, Token: "token", MaxDownloads: &maxDownloads, CreatedAt: time.Now()}
+	file := &File{ID: 7, UserID: 3, OriginalFilename: "notes.txt", FilePath: "blob.bin", Version: 1, CreatedAt: time.Now()}
+	db := shareDB(t, share, file)
+	fileService := NewFileService(db, nil, NewFileRepository(db), nil, nil, nil, NewShareRepository(db), nil, nil, storage, UploadPolicy{})
+
+	router := gin.New()
+	router.GET("/s/:token", NewFileController(fileService, nil, nil).DownloadShare)
+
+	w := getShare(router, "", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, 0, share.DownloadCount, "a download that never started was counted")
+}
+
+func TestOpenShare(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	used, unused := 3, 5
+
+	tests := []struct {
+		name     string
+		share    Share
+		token    string
+		password string
+		err      error
+	}{
+		{name: "unknown token", token: "other", err: ErrShareNotFound},
+		{name: "revoked", share: Share{RevokedAt: &past}, err: ErrShareNotFound},
+		{name: "expired", share: Share{ExpiresAt: &past}, err: ErrShareExpired},
+		{name: "download limit reached", share: Share{MaxDownloads: &used, DownloadCount: 3}, err: ErrShareExpired},
+		{name: "password missing", share: Share{PasswordHash: string(hash)}, err: ErrSharePasswordRequired},
+		{name: "password wrong", share: Share{PasswordHash: string(hash)}, password: "open sesam", err: ErrSharePasswordInvalid},
+		{name: "password right", share: Share{PasswordHash: string(hash)}, password: "open sesame"},
+		{name: "within limits", share: Share{ExpiresAt: &future, MaxDownloads: &unused, DownloadCount: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			share := tt.share
+			share.ID, share.FileID, share.UserID, share.Token = 1, 7, 3, "token"
+			file := &File{ID: 7, UserID: 3, OriginalFilename: "notes.txt", CreatedAt: time.Now()}
+			db := shareDB(t, &share, file)
+			fileService := NewFileService(db, nil, NewFileRepository(db), nil, nil, nil, NewShareRepository(db), nil, nil, nil, UploadPolicy{})
+
+			token := tt.token
+			if token == "" {
+				token = share.Token
+			}
+			opened, openedFile, err := fileService.OpenShare(token, tt.password, "203.0.113.9")
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, share.ID, opened.ID)
+			assert.Equal(t, file.ID, openedFile.ID)
+			assert.Equal(t, share.DownloadCount, opened.DownloadCount, "opening a share does not count a download")
+		})
+	}
+}
+
+func TestShareLinkRoute(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	require.NoError(t, err)
+	share := &Share{ID: 1, FileID: 7, UserID: 3, Token: "token", PasswordHash: string(hash), CreatedAt: time.Now()}
+	router := shareRouter(t, share, nil)
+
+	post := func(path, password string) *httptest.ResponseRecorder {
+		return postShare(router, path, password)
+	}
+
+	// The link needs no login, but does need its password
+	w := getShare(router, "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `"password_required":true`)
+
+	w = post("/s/token", "wrong password")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, 0, share.DownloadCount)
+
+	w = post("/s/token", "open sesame")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, `inline; filename=notes.txt`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, 1, share.DownloadCount)
+
+	// Unknown and expired links
+	w = post("/s/nope", "open sesame")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	past := time.Now().Add(-time.Minute)
+	share.ExpiresAt = &past
+	w = post("/s/token", "open sesame")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, 1, share.DownloadCount)
+}
+
+func TestSharePasswordGuessingIsLimited(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	require.NoError(t, err)
+	share := &Share{ID: 1, FileID: 7, UserID: 3, Token: "token", PasswordHash: string(hash), CreatedAt: time.Now()}
+
+	policy := LockoutPolicy{FreeFailures: 1, MaxFailures: 3, BaseDelay: time.Second, LockoutDuration: 15 * time.Minute, Window: time.Hour}
+	limiter := NewLoginLimiter(NewMemoryAttemptStore(), policy, LockoutPolicy{FreeFailures: 100, MaxFailures: 100, Window: time.Hour})
+	limiter.OnLockout(func(LockoutEvent) {})
+	router := shareRouter(t, share, limiter)
+
+	// The first wrong password is free, the next one has to wait
+	w := postShare(router, "/s/token", "guess 1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postShare(router, "/s/token", "guess 2")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postShare(router, "/s/token", "guess 3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Even the right password is refused until the delay has passed
+	w = postShare(router, "/s/token", "open sesame")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 0, share.DownloadCount)
+}
@@ -18,6 +18,8 @@ document.addEventListener('DOMContentLoaded', function() {
     const ENDPOINTS = {
         REGISTER: `${API_URL}/register`,
         LOGIN: `${API_URL}/login`,
+        LOGIN_MFA: `${API_URL}/login/mfa`,
+        LOGOUT: `${API_URL}/logout`,
         UPLOAD: `${API_URL}/upload`,
         FILES: `${API_URL}/files`,
         FILE: (id) => `${API_URL}/files/${id}`,
@@ -85,13 +87,34 @@ document.addEventListener('DOMContentLoaded', function() {
                 body: JSON.stringify({ email, password })
             });
 
-            const data = await response.json();
+            let data = await response.json();
             
             if (!response.ok) {
                 throw new Error(data.error || 'Login failed');
             }
 
+            // Accounts with two-factor authentication need a code as well
+            if (data.status === 'mfa_required') {
+                const code = prompt('Enter the code from your authenticator app or a recovery code');
+                if (!code) return;
+
+                const mfaResponse = await fetch(ENDPOINTS.LOGIN_MFA, {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json'
+                    },
+                    body: JSON.stringify({ mfa_token: data.mfa_token, code })
+                });
+
+                data = await mfaResponse.json();
+
+                if (!mfaResponse.ok) {
+                    throw new Error(data.error || 'Login failed');
+                }
+            }
+
             localStorage.setItem('token', data.token);
+            localStorage.setItem('refreshToken', data.refresh_token);
             localStorage.setItem('userEmail', email);
             userEmail.textContent = email;
             showMessage('Login successful!');
@@ -301,8 +324,21 @@ function getFile(fileId) {
         registerUser(email, password);
     });
 
-    logoutBtn.addEventListener('click', () => {
+    logoutBtn.addEventListener('click', async () => {
+        const token = localStorage.getItem('token');
+        if (token) {
+            // Revoke the session on the server; the local logout happens regardless
+            await fetch(ENDPOINTS.LOGOUT, {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${token}`,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ refresh_token: localStorage.getItem('refreshToken') || '' })
+            }).catch(() => {});
+        }
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
         localStorage.removeItem('userEmail');
         checkAuth();
         showMessage('Logged out successfully!');
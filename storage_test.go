@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal in-memory S3-compatible server standing in for MinIO
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *httptest.Server {
+	f := &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+	return httptest.NewServer(f)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if path == "" || path == "/" {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(path, "/")
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead, http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+	}
+	var result struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			Size:         int64(len(f.objects[k])),
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// exerciseStorage runs the same behavioural checks against any backend
+func exerciseStorage(t *testing.T, storage Storage) {
+	n, err := storage.Put("docs/report.txt", strings.NewReader("hello storage"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), n)
+
+	info, err := storage.Stat("docs/report.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), info.Size)
+
+	r, err := storage.Get("docs/report.txt")
+	require.NoError(t, err)
+	_, err = r.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "storage", string(data))
+
+	_, err = storage.Put("other.txt", strings.NewReader("x"))
+	require.NoError(t, err)
+
+	blobs, err := storage.List("docs/")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+	assert.Equal(t, "docs/report.txt", blobs[0].Key)
+
+	require.NoError(t, storage.Delete("docs/report.txt"))
+	_, err = storage.Get("docs/report.txt")
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+	assert.NoError(t, storage.Delete("docs/report.txt"), "deleting a missing blob is not an error")
+}
+
+func TestLocalStorage(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	exerciseStorage(t, storage)
+
+	_, err = storage.Get("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrBlobNotFound, "keys cannot escape the root directory")
+}
+
+func TestS3Storage(t *testing.T) {
+	server := newFakeS3("files")
+	defer server.Close()
+
+	storage, err := NewS3Storage(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "files",
+		AccessKey: "minio",
+		SecretKey: "minio123",
+	})
+	require.NoError(t, err)
+	exerciseStorage(t, storage)
+}
+
+func TestNewStorageFromEnv(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "local")
+	t.Setenv("STORAGE_LOCAL_PATH", t.TempDir())
+	storage, err := NewStorageFromEnv()
+	require.NoError(t, err)
+	assert.IsType(t, &LocalStorage{}, storage)
+
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	t.Setenv("S3_BUCKET", "files")
+	storage, err = NewStorageFromEnv()
+	require.NoError(t, err)
+	assert.IsType(t, &S3Storage{}, storage)
+
+	t.Setenv("STORAGE_BACKEND", "ftp")
+	_, err = NewStorageFromEnv()
+	assert.Error(t, err, "unknown backend should fail")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTeamNotFound       = errors.New("team not found")
+	ErrTeamMemberNotFound = errors.New("team member not found")
+	ErrInvalidTeamName    = errors.New("team name must be between 1 and 255 characters")
+	ErrInvalidTeamRole    = errors.New("role must be owner, member or viewer")
+	ErrNotTeamOwner       = errors.New("only team owners can manage members")
+	ErrTeamReadOnly       = errors.New("viewers cannot change the team's files")
+	ErrLastTeamOwner      = errors.New("a team needs at least one owner")
+)
+
+// Roles of team members
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleMember = "member"
+	TeamRoleViewer = "viewer"
+)
+
+// TeamService handles teams and their membership
+type TeamService struct {
+	db        *sql.DB
+	userRepo  *UserRepository
+	teamRepo  *TeamRepository
+	shareRepo *ShareRepository
+	grantRepo *FileGrantRepository
+}
+
+func NewTeamService(db *sql.DB, userRepo *UserRepository, teamRepo *TeamRepository, shareRepo *ShareRepository, grantRepo *FileGrantRepository) *TeamService {
+	return &TeamService{db: db, userRepo: userRepo, teamRepo: teamRepo, shareRepo: shareRepo, grantRepo: grantRepo}
+}
+
+// CreateTeam creates a team with the user as its owner
+func (s *TeamService) CreateTeam(userID int, name string) (*Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 {
+		return nil, ErrInvalidTeamName
+	}
+
+	team := &Team{Name: name, Role: TeamRoleOwner, CreatedBy: userID, CreatedAt: time.Now()}
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		teams := s.teamRepo.WithTx(tx)
+
+		teamID, err := teams.Create(team)
+		if err != nil {
+			return err
+		}
+		team.ID = teamID
+
+		return teams.UpsertMember(&TeamMember{TeamID: teamID, UserID: userID, Role: TeamRoleOwner, CreatedAt: team.CreatedAt})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return team, nil
+}
+
+// GetTeams lists the teams the user is a member of
+func (s *TeamService) GetTeams(userID int) ([]*Team, error) {
+	return s.teamRepo.GetForUser(userID)
+}
+
+// GetMembers lists the members of a team the user belongs to
+func (s *TeamService) GetMembers(teamID, userID int) ([]*TeamMember, error) {
+	if _, err := s.requireRole(teamID, userID); err != nil {
+		return nil, err
+	}
+	return s.teamRepo.GetMembers(teamID)
+}
+
+// AddMember invites the registered user with the given email address into
+// the team, or changes the role they already have. Only owners may do this,
+// and the last owner cannot be demoted.
+func (s *TeamService) AddMember(teamID, userID int, email, role string) (*TeamMember, error) {
+	if !validTeamRole(role) {
+		return nil, ErrInvalidTeamRole
+	}
+
+	if err := s.requireOwner(teamID, userID); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	member := &TeamMember{TeamID: teamID, UserID: user.ID, Email: user.Email, Role: role, CreatedAt: time.Now()}
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		teams := s.teamRepo.WithTx(tx)
+
+		if role != TeamRoleOwner {
+			if err := ensureOtherOwner(teams, teamID, user.ID); err != nil {
+				return err
+			}
+		}
+
+		return teams.UpsertMember(member)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+// RemoveMember takes a user out of a team. Owners may remove anyone; other
+// members may only leave. The team's files stay with the team.
+func (s *TeamService) RemoveMember(teamID, userID, memberID int) error {
+	if memberID == userID {
+		if _, err := s.requireRole(teamID, userID); err != nil {
+			return err
+		}
+	} else if err := s.requireOwner(teamID, userID); err != nil {
+		return err
+	}
+
+	return withTx(s.db, func(tx *sql.Tx) error {
+		teams := s.teamRepo.WithTx(tx)
+
+		if err := ensureOtherOwner(teams, teamID, memberID); err != nil {
+			return err
+		}
+
+		if err := teams.RemoveMember(teamID, memberID); err != nil {
+			return err
+		}
+
+		// Access the member handed out to the team's files leaves with them
+		if err := s.shareRepo.WithTx(tx).RevokeByTeamMember(teamID, memberID, time.Now()); err != nil {
+			return err
+		}
+		return s.grantRepo.WithTx(tx).DeleteGrantedByTeamMember(teamID, memberID)
+	})
+}
+
+// requireRole returns the user's role in a team, hiding teams they are not
+// a member of
+func (s *TeamService) requireRole(teamID, userID int) (string, error) {
+	role, err := s.teamRepo.GetRole(teamID, userID)
+	if err != nil {
+		return "", err
+	}
+	if role == "" {
+		return "", ErrTeamNotFound
+	}
+	return role, nil
+}
+
+func (s *TeamService) requireOwner(teamID, userID int) error {
+	role, err := s.requireRole(teamID, userID)
+	if err != nil {
+		return err
+	}
+	if role != TeamRoleOwner {
+		return ErrNotTeamOwner
+	}
+	return nil
+}
+
+// ensureOtherOwner refuses to let userID stop being an owner when they are
+// the team's only one
+func ensureOtherOwner(teams *TeamRepository, teamID, userID int) error {
+	owners, err := teams.GetOwnersForUpdate(teamID)
+	if err != nil {
+		return err
+	}
+	if len(owners) == 1 && owners[0] == userID {
+		return ErrLastTeamOwner
+	}
+	return nil
+}
+
+// workspaceFor returns the user's own workspace when teamID is nil, and the
+// team's otherwise, provided the user is a member whose role allows changes
+// when write is set
+func workspaceFor(teamRepo *TeamRepository, userID int, teamID *int, write bool) (Workspace, error) {
+	ws := Workspace{UserID: userID, TeamID: teamID}
+	if teamID == nil {
+		return ws, nil
+	}
+
+	role, err := teamRepo.GetRole(*teamID, userID)
+	if err != nil {
+		return Workspace{}, err
+	}
+	if role == "" {
+		return Workspace{}, ErrTeamNotFound
+	}
+	if write && !canChangeTeamFiles(role) {
+		return Workspace{}, ErrTeamReadOnly
+	}
+
+	return ws, nil
+}
+
+// canChangeTeamFiles reports whether a team role may add, change and delete
+// the team's files and folders
+func canChangeTeamFiles(role string) bool {
+	return role == TeamRoleOwner || role == TeamRoleMember
+}
+
+func validTeamRole(role string) bool {
+	return role == TeamRoleOwner || role == TeamRoleMember || role == TeamRoleViewer
+}
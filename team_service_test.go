@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkspaceSame(t *testing.T) {
+	team, otherTeam := 1, 2
+
+	assert.True(t, Workspace{UserID: 5}.Same(Workspace{UserID: 5}))
+	assert.False(t, Workspace{UserID: 5}.Same(Workspace{UserID: 6}))
+	assert.True(t, Workspace{UserID: 5, TeamID: &team}.Same(Workspace{UserID: 6, TeamID: &team}), "a team's folders are shared by its members")
+	assert.False(t, Workspace{UserID: 5, TeamID: &team}.Same(Workspace{UserID: 5, TeamID: &otherTeam}))
+	assert.False(t, Workspace{UserID: 5, TeamID: &team}.Same(Workspace{UserID: 5}), "team files are not the user's own")
+
+	// The user's own workspace needs no membership
+	ws, err := workspaceFor(nil, 5, nil, true)
+	require.NoError(t, err)
+	assert.True(t, ws.Same(Workspace{UserID: 5}))
+
+	condition, arg := workspaceCondition(ws)
+	assert.Equal(t, "user_id = ? AND team_id IS NULL", condition)
+	assert.Equal(t, 5, arg)
+	condition, arg = workspaceCondition(Workspace{UserID: 5, TeamID: &team})
+	assert.Equal(t, "team_id = ?", condition)
+	assert.Equal(t, 1, arg)
+}
+
+func TestTeamServiceValidation(t *testing.T) {
+	service := NewTeamService(nil, nil, nil, nil, nil)
+
+	for _, name := range []string{"", "   ", strings.Repeat("a", 256)} {
+		_, err := service.CreateTeam(1, name)
+		assert.ErrorIs(t, err, ErrInvalidTeamName)
+	}
+
+	for _, role := range []string{"", "admin", "Owner"} {
+		_, err := service.AddMember(1, 1, "friend@example.com", role)
+		assert.ErrorIs(t, err, ErrInvalidTeamRole, role)
+	}
+
+	assert.True(t, canChangeTeamFiles(TeamRoleOwner))
+	assert.True(t, canChangeTeamFiles(TeamRoleMember))
+	assert.False(t, canChangeTeamFiles(TeamRoleViewer))
+}
+
+func TestRemoveMemberRevokesTheirLinks(t *testing.T) {
+	var statements []string
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		if words := strings.Fields(query); words[0] != "SELECT" {
+			statements = append(statements, strings.Join(words[:min(3, len(words))], " "))
+		}
+
+		switch {
+		case strings.HasPrefix(query, "SELECT role FROM team_members"):
+			return fakeRow("role", TeamRoleOwner), nil
+		case strings.HasPrefix(query, "SELECT user_id FROM team_members"):
+			return fakeRow("user_id", int64(1)), nil
+		case strings.HasPrefix(query, "DELETE FROM team_members"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "UPDATE shares SET revoked_at"):
+			assert.Equal(t, []driver.Value{int64(2), int64(4)}, args[1:], "the member's links on the team's files")
+		case strings.HasPrefix(query, "DELETE FROM file_grants"):
+			assert.Equal(t, []driver.Value{int64(2), int64(4)}, args)
+		case query == "BEGIN", query == "COMMIT":
+		default:
+			t.Fatalf("unexpected query %q", query)
+		}
+		return fakeReply{RowsAffected: 1}, nil
+	})
+	service := NewTeamService(db, nil, NewTeamRepository(db), NewShareRepository(db), NewFileGrantRepository(db))
+
+	require.NoError(t, service.RemoveMember(4, 1, 2))
+	assert.Equal(t, []string{"BEGIN", "DELETE FROM team_members", "UPDATE shares SET", "DELETE FROM file_grants", "COMMIT"}, statements)
+}
+
+func TestShareOfFormerMemberStopsWorking(t *testing.T) {
+	teamID := 4
+	share := &Share{ID: 1, FileID: 7, UserID: 2, Token: "token", CreatedAt: time.Now()}
+	file := &File{ID: 7, UserID: 1, TeamID: &teamID, CreatedAt: time.Now()}
+	members := map[int64]bool{1: true, 2: true}
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.Contains(query, "FROM shares WHERE token = ?"):
+			return fakeRow(shareRowColumns, int64(share.ID), int64(share.FileID), int64(share.UserID), share.Token,
+				nil, nil, int64(0), nil, "", share.CreatedAt), nil
+		case strings.Contains(query, "FROM files WHERE id = ?"):
+			return fakeRow(fileColumns, fileValues(file)...), nil
+		case strings.HasPrefix(query, "SELECT role FROM team_members"):
+			if !members[args[1].(int64)] {
+				return fakeReply{}, nil
+			}
+			return fakeRow("role", TeamRoleMember), nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	fileService := NewFileService(db, nil, NewFileRepository(db), nil, nil, nil, NewShareRepository(db), nil, NewTeamRepository(db), nil, UploadPolicy{})
+
+	_, _, err := fileService.OpenShare("token", "", "")
+	require.NoError(t, err)
+
+	// Links made before leaving, or before links were revoked on leaving,
+	// no longer reach the team's files
+	delete(members, 2)
+	_, _, err = fileService.OpenShare("token", "", "")
+	assert.ErrorIs(t, err, ErrShareNotFound)
+}
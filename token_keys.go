@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// devJWTSecret signs tokens in development when no key is configured
+const devJWTSecret = "default_jwt_secret"
+
+// minJWTSecretLen is the shortest JWT_SECRET accepted outside development
+const minJWTSecretLen = 32
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys (RFC 8037), which
+// jwt-go does not support natively
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// SigningKey is a key of a KeyRing. Keys without a private half only verify
+// tokens, typically ones signed before a key rotation.
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// NewHMACKey returns an HS256 key. It has no ID, so it is the key used for
+// tokens without a kid header.
+func NewHMACKey(secret []byte) *SigningKey {
+	return &SigningKey{Method: jwt.SigningMethodHS256, privateKey: secret, publicKey: secret}
+}
+
+// NewSigningKey returns an RS256 or EdDSA key for an RSA or Ed25519 private
+// or public key
+func NewSigningKey(id string, key interface{}) (*SigningKey, error) {
+	if id == "" {
+		return nil, errors.New("signing keys need an ID")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, privateKey: key, publicKey: &key.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, publicKey: key}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{ID: id, Method: SigningMethodEdDSA, privateKey: key, publicKey: key.Public()}, nil
+	case ed25519.PublicKey:
+		return &SigningKey{ID: id, Method: SigningMethodEdDSA, publicKey: key}, nil
+	default:
+		return nil, fmt.Errorf("key %s: only RSA and Ed25519 keys are supported", id)
+	}
+}
+
+// CanSign reports whether the key has its private half
+func (k *SigningKey) CanSign() bool {
+	return k.privateKey != nil
+}
+
+// KeyRing signs tokens with its active key and verifies them with whichever
+// key their kid names. Rotating keys means adding the new key, making it
+// active and dropping the old one once its tokens have expired; nobody is
+// logged out along the way.
+type KeyRing struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+// NewKeyRing returns a key ring that signs with the key with ID activeID
+func NewKeyRing(keys []*SigningKey, activeID string) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[string]*SigningKey{}}
+	for _, key := range keys {
+		if _, exists := ring.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate signing key %q", key.ID)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	ring.active = ring.keys[activeID]
+	if ring.active == nil {
+		return nil, fmt.Errorf("signing key %q not found", activeID)
+	}
+	if !ring.active.CanSign() {
+		return nil, fmt.Errorf("signing key %q has no private key", activeID)
+	}
+
+	return ring, nil
+}
+
+// KeyRingFromEnv loads the token signing keys. JWT_KEYS_DIR holds one PEM
+// file per key named <kid>.pem; private keys (PKCS#8, or PKCS#1 for RSA) can
+// sign, while public keys only verify. JWT_ACTIVE_KEY picks the signing key
+// when there are several. JWT_SECRET adds an HS256 key, which only signs when
+// there is no key directory, so tokens issued before moving to key pairs
+// remain valid. Outside development a key is required.
+func KeyRingFromEnv() (*KeyRing, error) {
+	var keys []*SigningKey
+	activeID := os.Getenv("JWT_ACTIVE_KEY")
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if !devMode() && (len(secret) < minJWTSecretLen || secret == devJWTSecret) {
+			return nil, fmt.Errorf("JWT_SECRET must be at least %d characters and not the development default", minJWTSecretLen)
+		}
+		keys = append(keys, NewHMACKey([]byte(secret)))
+	}
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		dirKeys, err := loadSigningKeys(dir)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, dirKeys...)
+
+		if activeID == "" {
+			var signers []string
+			for _, key := range dirKeys {
+				if key.CanSign() {
+					signers = append(signers, key.ID)
+				}
+			}
+			if len(signers) != 1 {
+				return nil, errors.New("JWT_ACTIVE_KEY is required unless JWT_KEYS_DIR holds exactly one private key")
+			}
+			activeID = signers[0]
+		}
+	}
+
+	if len(keys) == 0 {
+		if !devMode() {
+			return nil, errors.New("no token signing key configured; set JWT_KEYS_DIR or JWT_SECRET")
+		}
+		log.Println("WARNING: signing tokens with the development secret; set JWT_KEYS_DIR or JWT_SECRET")
+		keys = append(keys, NewHMACKey([]byte(devJWTSecret)))
+	}
+
+	return NewKeyRing(keys, activeID)
+}
+
+// loadSigningKeys reads every .pem file in dir
+func loadSigningKeys(dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no .pem files in %s", dir)
+	}
+
+	var keys []*SigningKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := parsePEMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+
+		signingKey, err := NewSigningKey(id, key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey)
+	}
+
+	return keys, nil
+}
+
+// parsePEMKey decodes a PEM encoded private or public key
+func parsePEMKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// sign signs claims with the active key
+func (r *KeyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.active.Method, claims)
+	if r.active.ID != "" {
+		token.Header["kid"] = r.active.ID
+	}
+	return token.SignedString(r.active.privateKey)
+}
+
+// verificationKey finds the key for a token, refusing tokens whose algorithm
+// does not match the key's
+func (r *KeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.publicKey, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set (RFC 7517). HMAC
+// secrets are never published.
+func (r *KeyRing) JWKS() map[string][]jsonWebKey {
+	keys := []jsonWebKey{}
+	for _, key := range r.keys {
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, jsonWebKey{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+	return map[string][]jsonWebKey{"keys": keys}
+}
+
+// devMode reports whether APP_ENV is development, which allows running
+// without a configured signing key
+func devMode() bool {
+	return os.Getenv("APP_ENV") == "development"
+}
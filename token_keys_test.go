@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestKeyRing returns a key ring with a single fresh Ed25519 key
+func newTestKeyRing(t *testing.T) *KeyRing {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := NewSigningKey("test", privateKey)
+	require.NoError(t, err)
+
+	keys, err := NewKeyRing([]*SigningKey{key}, "test")
+	require.NoError(t, err)
+	return keys
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	oldKey, err := NewSigningKey("2024-01", rsaKey)
+	require.NoError(t, err)
+	before, err := NewKeyRing([]*SigningKey{oldKey}, "2024-01")
+	require.NoError(t, err)
+
+	oldToken, err := before.GenerateToken(&User{ID: 3, Role: RoleUser})
+	require.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(oldToken, &JWTClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", parsed.Header["alg"])
+	assert.Equal(t, "2024-01", parsed.Header["kid"])
+
+	// After the rotation the old key only verifies
+	retired, err := NewSigningKey("2024-01", &rsaKey.PublicKey)
+	require.NoError(t, err)
+	newKey, err := NewSigningKey("2024-07", edKey)
+	require.NoError(t, err)
+	after, err := NewKeyRing([]*SigningKey{retired, newKey}, "2024-07")
+	require.NoError(t, err)
+
+	claims, err := after.ValidateToken(oldToken)
+	require.NoError(t, err, "tokens signed before the rotation stay valid")
+	assert.Equal(t, 3, claims.UserID)
+
+	newToken, err := after.GenerateToken(&User{ID: 3, Role: RoleUser})
+	require.NoError(t, err)
+	parsed, _, err = new(jwt.Parser).ParseUnverified(newToken, &JWTClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", parsed.Header["alg"])
+	assert.Equal(t, "2024-07", parsed.Header["kid"])
+
+	_, err = after.ValidateToken(newToken)
+	assert.NoError(t, err)
+
+	// Once the old key is dropped its tokens are refused
+	final, err := NewKeyRing([]*SigningKey{newKey}, "2024-07")
+	require.NoError(t, err)
+	_, err = final.ValidateToken(oldToken)
+	assert.Error(t, err)
+
+	_, err = NewKeyRing([]*SigningKey{retired, newKey}, "2024-01")
+	assert.Error(t, err, "a public key cannot be the active key")
+}
+
+func TestKeyRingRejectsForgedTokens(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := NewSigningKey("main", rsaKey)
+	require.NoError(t, err)
+	keys, err := NewKeyRing([]*SigningKey{key}, "main")
+	require.NoError(t, err)
+
+	claims := JWTClaims{UserID: 1, StandardClaims: jwt.StandardClaims{Id: "x", ExpiresAt: time.Now().Add(time.Minute).Unix()}}
+
+	// HS256 keyed with the public key must not pass as RS256
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = "main"
+	forgedString, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	require.NoError(t, err)
+	_, err = keys.ValidateToken(forgedString)
+	assert.Error(t, err)
+
+	// Unknown kids and unsigned tokens are refused
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	unknown.Header["kid"] = "other"
+	unknownString, err := unknown.SignedString(rsaKey)
+	require.NoError(t, err)
+	_, err = keys.ValidateToken(unknownString)
+	assert.Error(t, err)
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = keys.ValidateToken(unsigned)
+	assert.Error(t, err)
+}
+
+func TestKeyRingJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	rsaSigningKey, err := NewSigningKey("a-rsa", rsaKey)
+	require.NoError(t, err)
+	edSigningKey, err := NewSigningKey("b-ed", edKey)
+	require.NoError(t, err)
+	keys, err := NewKeyRing([]*SigningKey{NewHMACKey([]byte("secret")), rsaSigningKey, edSigningKey}, "b-ed")
+	require.NoError(t, err)
+
+	set := keys.JWKS()["keys"]
+	require.Len(t, set, 2, "HMAC secrets are never published")
+	assert.Equal(t, "RSA", set[0].Kty)
+	assert.Equal(t, "RS256", set[0].Alg)
+	assert.Equal(t, "OKP", set[1].Kty)
+	assert.Equal(t, "Ed25519", set[1].Crv)
+	assert.Equal(t, "EdDSA", set[1].Alg)
+
+	// A verifier using the published key accepts our tokens
+	token, err := keys.GenerateToken(&User{ID: 9, Role: RoleUser})
+	require.NoError(t, err)
+	publicKey, err := set[1].publicKey()
+	require.NoError(t, err)
+	_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return publicKey, nil })
+	assert.NoError(t, err)
+}
+
+func TestKeyRingFromEnv(t *testing.T) {
+	t.Setenv("APP_ENV", "")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS_DIR", "")
+	t.Setenv("JWT_ACTIVE_KEY", "")
+
+	_, err := KeyRingFromEnv()
+	assert.Error(t, err, "a key is required outside development")
+
+	t.Setenv("JWT_SECRET", "too-short")
+	_, err = KeyRingFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("JWT_SECRET", "")
+	keys, err := KeyRingFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, jwt.SigningMethodHS256, keys.active.Method)
+
+	// Key pairs from a directory, keeping the old secret for existing tokens
+	t.Setenv("APP_ENV", "")
+	t.Setenv("JWT_SECRET", "an-old-secret-that-is-long-enough-to-use")
+	legacy, err := KeyRingFromEnv()
+	require.NoError(t, err)
+	legacyToken, err := legacy.GenerateToken(&User{ID: 5, Role: RoleUser})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writePEMKey(t, filepath.Join(dir, "current.pem"), "PRIVATE KEY", edKey)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEMKey(t, filepath.Join(dir, "retired.pem"), "PUBLIC KEY", &rsaKey.PublicKey)
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	keys, err = KeyRingFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "current", keys.active.ID)
+	assert.Len(t, keys.keys, 3)
+
+	_, err = keys.ValidateToken(legacyToken)
+	assert.NoError(t, err)
+
+	writePEMKey(t, filepath.Join(dir, "next.pem"), "PRIVATE KEY", rsaKey)
+	_, err = KeyRingFromEnv()
+	assert.Error(t, err, "the active key is ambiguous")
+
+	t.Setenv("JWT_ACTIVE_KEY", "next")
+	keys, err = KeyRingFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, jwt.SigningMethodRS256, keys.active.Method)
+}
+
+func writePEMKey(t *testing.T, path, blockType string, key interface{}) {
+	var der []byte
+	var err error
+	if blockType == "PUBLIC KEY" {
+		der, err = x509.MarshalPKIXPublicKey(key)
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
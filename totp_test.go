@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA-1 test key of RFC 6238, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B vectors, truncated to six digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := totpCode(rfcSecret, totpStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+
+	previous, _ := totpCode(rfcSecret, step-1)
+	got, ok := matchTOTP(rfcSecret, previous, now)
+	assert.True(t, ok, "codes from the previous step are accepted")
+	assert.Equal(t, step-1, got)
+
+	stale, _ := totpCode(rfcSecret, step-2)
+	_, ok = matchTOTP(rfcSecret, stale, now)
+	assert.False(t, ok)
+
+	_, ok = matchTOTP(rfcSecret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestTOTPEnrollmentValues(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	uri, err := url.Parse(totpURI("Files", "alice@example.com", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Files:alice@example.com", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, "Files", uri.Query().Get("issuer"))
+
+	codes, err := generateRecoveryCodes(10)
+	require.NoError(t, err)
+	assert.Len(t, codes, 10)
+	for _, code := range codes {
+		assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{4}(-[0-9a-f]{4}){3}$`), code)
+	}
+	assert.Equal(t, normalizeRecoveryCode(codes[0]), normalizeRecoveryCode(" "+codes[0][:9]+" "+codes[0][10:]))
+}
+
+func TestMFATokenIsNotAnAccessToken(t *testing.T) {
+	keys := newTestKeyRing(t)
+	mfaToken, err := keys.generateToken(JWTClaims{UserID: 1, Purpose: mfaTokenPurpose}, time.Minute)
+	require.NoError(t, err)
+
+	_, err = (&AuthService{keys: keys}).Authenticate(mfaToken)
+	assert.Error(t, err)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+	ErrUploadTooLarge       = errors.New("upload exceeds the maximum size")
+	ErrUploadExpired        = errors.New("upload has expired")
+)
+
+// defaultTusDir holds partial uploads unless TUS_UPLOAD_DIR says otherwise.
+// It must lie outside the LocalStorage root so partials never show up as
+// stored blobs.
+const defaultTusDir = "./tus-partials"
+
+// defaultTusExpiry is how long an upload may take unless TUS_UPLOAD_EXPIRY
+// says otherwise
+const defaultTusExpiry = 24 * time.Hour
+
+// TusService implements resumable uploads following the tus 1.0 protocol.
+// Partial uploads are kept on local disk and handed to FileService once the
+// last byte has arrived. Uploads not finished within the expiry are
+// discarded.
+//
+// Partial uploads bypass the Storage backend and writes to an upload are
+// serialised in memory, so every request for an upload must reach the same
+// instance: run a single instance, or route /tus by upload ID and give each
+// instance its own TUS_UPLOAD_DIR.
+type TusService struct {
+	uploadRepo  *TusUploadRepository
+	fileService *FileService
+	dir         string
+	maxSize     int64 // Zero means no limit
+	expiry      time.Duration
+
+	locksMutex sync.Mutex
+	locks      map[string]*sync.Mutex
+}
+
+func NewTusService(uploadRepo *TusUploadRepository, fileService *FileService, dir string, maxSize int64, expiry time.Duration) (*TusService, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &TusService{
+		uploadRepo:  uploadRepo,
+		fileService: fileService,
+		dir:         dir,
+		maxSize:     maxSize,
+		expiry:      expiry,
+		locks:       map[string]*sync.Mutex{},
+	}, nil
+}
+
+// NewTusServiceFromEnv configures a TusService from TUS_UPLOAD_DIR,
+// TUS_MAX_SIZE and TUS_UPLOAD_EXPIRY
+func NewTusServiceFromEnv(uploadRepo *TusUploadRepository, fileService *FileService) (*TusService, error) {
+	dir := os.Getenv("TUS_UPLOAD_DIR")
+	if dir == "" {
+		dir = defaultTusDir
+	}
+
+	var maxSize int64
+	if value := os.Getenv("TUS_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("TUS_MAX_SIZE must be a number of bytes")
+		}
+		maxSize = size
+	}
+
+	expiry := durationFromEnv("TUS_UPLOAD_EXPIRY", defaultTusExpiry)
+	return NewTusService(uploadRepo, fileService, dir, maxSize, expiry)
+}
+
+// MaxSize returns the largest upload accepted, or zero when unlimited
+func (s *TusService) MaxSize() int64 {
+	return s.maxSize
+}
+
+// ExpiresAt returns when an unfinished upload is discarded
+func (s *TusService) ExpiresAt(upload *TusUpload) time.Time {
+	return upload.CreatedAt.Add(s.expiry)
+}
+
+// CreateUpload registers a new upload of the given length
+func (s *TusService) CreateUpload(userID int, length int64, rawMetadata string) (*TusUpload, error) {
+	if s.maxSize > 0 && length > s.maxSize {
+		return nil, ErrUploadTooLarge
+	}
+
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.fileService.CheckUpload(metadata["filename"], length); err != nil {
+		return nil, err
+	}
+	if err := s.fileService.CheckQuota(userID, length); err != nil {
+		return nil, err
+	}
+
+	id, err := generateUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = id
+	}
+
+	upload := &TusUpload{
+		ID:        id,
+		UserID:    userID,
+		Length:    length,
+		Filename:  filepath.Base(filename),
+		MimeType:  metadata["filetype"],
+		Metadata:  rawMetadata,
+		CreatedAt: time.Now(),
+	}
+
+	// Create the empty partial file before the row so a PATCH never finds a
+	// row without data behind it
+	partial, err := os.Create(s.partialPath(id))
+	if err != nil {
+		return nil, err
+	}
+	partial.Close()
+
+	if err := s.uploadRepo.Create(upload); err != nil {
+		os.Remove(s.partialPath(id))
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// GetUpload returns an in-progress upload owned by the user
+func (s *TusService) GetUpload(id string, userID int) (*TusUpload, error) {
+	return s.uploadRepo.GetByID(id, userID)
+}
+
+// WriteChunk appends data at offset. When the upload becomes complete it is
+// stored as a regular file and that file is returned.
+func (s *TusService) WriteChunk(id string, userID int, offset int64, data io.Reader) (*TusUpload, *File, error) {
+	upload, lock, err := s.lockUpload(id, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Unlock()
+
+	// The purger may not have caught up with it yet
+	if time.Now().After(s.ExpiresAt(upload)) {
+		return upload, nil, ErrUploadExpired
+	}
+
+	if offset != upload.Offset {
+		return upload, nil, ErrUploadOffsetMismatch
+	}
+
+	partial, err := os.OpenFile(s.partialPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+		partial.Close()
+		return nil, nil, err
+	}
+
+	// Keep whatever arrived even if the connection drops, so the client can
+	// resume from there
+	written, copyErr := io.Copy(partial, io.LimitReader(data, upload.Length-offset))
+	closeErr := partial.Close()
+
+	upload.Offset += written
+	if err := s.uploadRepo.UpdateOffset(id, upload.Offset); err != nil {
+		return nil, nil, err
+	}
+	if copyErr != nil {
+		return upload, nil, copyErr
+	}
+	if closeErr != nil {
+		return upload, nil, closeErr
+	}
+
+	if upload.Offset < upload.Length {
+		return upload, nil, nil
+	}
+
+	file, err := s.finalize(upload)
+	if err != nil {
+		return upload, nil, err
+	}
+
+	return upload, file, nil
+}
+
+// Terminate discards an upload and its partial data
+func (s *TusService) Terminate(id string, userID int) error {
+	_, lock, err := s.lockUpload(id, userID)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := s.uploadRepo.Delete(id); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.partialPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.unlock(id)
+	return nil
+}
+
+// PurgeExpired discards uploads that were not finished in time and returns
+// how many were removed
+func (s *TusService) PurgeExpired() (int, error) {
+	const batchSize = 100
+	cutoff := time.Now().Add(-s.expiry)
+
+	purged := 0
+	for {
+		ids, err := s.uploadRepo.GetCreatedBefore(cutoff, batchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, id := range ids {
+			if err := s.discard(id); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+
+		if len(ids) < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// RunPurger discards expired uploads every interval until stop is closed
+func (s *TusService) RunPurger(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.PurgeExpired()
+		if err != nil {
+			log.Printf("Failed to purge expired uploads: %v", err)
+		} else if purged > 0 {
+			log.Printf("Discarded %d expired uploads", purged)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// discard removes an upload and its partial data, waiting for any write
+// in progress
+func (s *TusService) discard(id string) error {
+	lock := s.lock(id)
+	defer lock.Unlock()
+
+	if err := s.uploadRepo.Delete(id); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.partialPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.unlock(id)
+	return nil
+}
+
+// finalize moves a completed upload into file storage. The upload is
+// removed either way: once all bytes have arrived there is nothing left to
+// resume, so a client whose upload was refused has to start over.
+func (s *TusService) finalize(upload *TusUpload) (*File, error) {
+	partial, err := os.Open(s.partialPath(upload.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := s.fileService.StoreFile(upload.UserID, upload.Filename, partial, UploadOptions{})
+	partial.Close()
+
+	if deleteErr := s.uploadRepo.Delete(upload.ID); deleteErr != nil && err == nil {
+		err = deleteErr
+	}
+	os.Remove(s.partialPath(upload.ID))
+	s.unlock(upload.ID)
+
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *TusService) partialPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// lockUpload waits for exclusive use of an upload of the user and returns its
+// current state. Unknown and foreign IDs are refused before a lock is made
+// for them, so requests for them cannot grow the lock map.
+func (s *TusService) lockUpload(id string, userID int) (*TusUpload, *sync.Mutex, error) {
+	if _, err := s.uploadRepo.GetByID(id, userID); err != nil {
+		return nil, nil, err
+	}
+
+	lock := s.lock(id)
+
+	// Read it again, as a request we waited for may have moved the offset or
+	// finished the upload
+	upload, err := s.uploadRepo.GetByID(id, userID)
+	if err != nil {
+		// Upload IDs are never reused, so whoever else waits for the lock
+		// finds the upload gone too
+		if errors.Is(err, ErrUploadNotFound) {
+			s.unlock(id)
+		}
+		lock.Unlock()
+		return nil, nil, err
+	}
+
+	return upload, lock, nil
+}
+
+// lock serialises writes to a single upload
+func (s *TusService) lock(id string) *sync.Mutex {
+	s.locksMutex.Lock()
+	lock, ok := s.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[id] = lock
+	}
+	s.locksMutex.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// unlock forgets the lock of a finished upload; the caller still holds it
+func (s *TusService) unlock(id string) {
+	s.locksMutex.Lock()
+	delete(s.locks, id)
+	s.locksMutex.Unlock()
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma separated
+// "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, errors.New("invalid Upload-Metadata value for key " + parts[0])
+			}
+			metadata[parts[0]] = string(value)
+		default:
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+	}
+
+	return metadata, nil
+}
+
+// generateUploadID generates a random identifier for an upload
+func generateUploadID() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
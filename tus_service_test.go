@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,filetype YXBwbGljYXRpb24vcGRm,is_confidential")
+	require.NoError(t, err)
+	assert.Equal(t, "world_domination_plan.pdf", metadata["filename"])
+	assert.Equal(t, "application/pdf", metadata["filetype"])
+	assert.Contains(t, metadata, "is_confidential")
+
+	metadata, err = parseTusMetadata("")
+	require.NoError(t, err)
+	assert.Empty(t, metadata)
+
+	_, err = parseTusMetadata("filename not-base64!")
+	assert.Error(t, err)
+}
+
+func TestTusPurgeExpired(t *testing.T) {
+	var deleted []string
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT id FROM tus_uploads WHERE created_at < ?"):
+			assert.WithinDuration(t, time.Now().Add(-time.Hour), args[0].(time.Time), time.Minute)
+			return fakeReply{Columns: []string{"id"}, Rows: [][]driver.Value{{"stale"}}}, nil
+		case strings.HasPrefix(query, "DELETE FROM tus_uploads"):
+			deleted = append(deleted, args[0].(string))
+			return fakeReply{RowsAffected: 1}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+
+	dir := t.TempDir()
+	service, err := NewTusService(NewTusUploadRepository(db), nil, dir, 0, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stale"), []byte("partial"), 0644))
+
+	purged, err := service.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, []string{"stale"}, deleted)
+	assert.NoFileExists(t, filepath.Join(dir, "stale"))
+
+	upload := &TusUpload{CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	assert.Equal(t, upload.CreatedAt.Add(time.Hour), service.ExpiresAt(upload))
+}
+
+func TestQuotaCountsUnfinishedUploads(t *testing.T) {
+	t.Setenv("STORAGE_QUOTA_BYTES", "100")
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT used_bytes FROM users"):
+			return fakeRow("used_bytes", int64(50)), nil
+		case strings.Contains(query, "FROM tus_uploads WHERE user_id = ?"):
+			return fakeRow("pending", int64(40)), nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	fileService := NewFileService(db, NewUserRepository(db), nil, nil, nil, nil, nil, nil, nil, nil, UploadPolicy{})
+
+	assert.NoError(t, fileService.CheckQuota(1, 10))
+
+	var quotaErr *QuotaError
+	require.ErrorAs(t, fileService.CheckQuota(1, 11), &quotaErr)
+	assert.Equal(t, int64(90), quotaErr.Used)
+}
+
+// TestTusEmptyUploadRefused checks that an empty upload refused when it is
+// stored is reported to the client and leaves nothing behind
+func TestTusEmptyUploadRefused(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var row []driver.Value
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO tus_uploads"):
+			row = append(args[:len(args):len(args)], time.Now())
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "SELECT id, user_id, upload_length"):
+			if row == nil {
+				return fakeReply{}, nil
+			}
+			return fakeRow("id, user_id, upload_length, upload_offset, filename, mime_type, metadata, created_at", row...), nil
+		case strings.HasPrefix(query, "UPDATE tus_uploads SET upload_offset"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM tus_uploads"):
+			row = nil
+			return fakeReply{RowsAffected: 1}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+
+	// Empty contents sniff as plain text, which the policy refuses
+	fileService := NewFileService(db, nil, nil, nil, nil, nil, nil, nil, nil, nil, UploadPolicy{DeniedTypes: []string{"text/plain"}})
+	dir := t.TempDir()
+	tusService, err := NewTusService(NewTusUploadRepository(db), fileService, dir, 0, time.Hour)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/tus", func(ctx *gin.Context) { ctx.Set("user_id", 1) }, NewTusController(tusService, nil).CreateUpload)
+
+	req, _ := http.NewRequest("POST", "/tus", nil)
+	req.Header.Set("Upload-Length", "0")
+	req.Header.Set("Upload-Metadata", "filename ZW1wdHkudHh0")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Nil(t, row, "the upload row was left behind")
+
+	partials, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, partials)
+}
+
+func TestTusWriteChunkRefused(t *testing.T) {
+	createdAt := time.Now().Add(-2 * time.Hour)
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		if strings.HasPrefix(query, "SELECT id, user_id, upload_length") {
+			if args[0] != "stale" {
+				return fakeReply{}, nil
+			}
+			return fakeRow("id, user_id, upload_length, upload_offset, filename, mime_type, metadata, created_at",
+				"stale", int64(1), int64(10), int64(0), "a.txt", "", "", createdAt), nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	service, err := NewTusService(NewTusUploadRepository(db), nil, t.TempDir(), 0, time.Hour)
+	require.NoError(t, err)
+
+	// Unknown IDs must not leave a lock behind
+	_, _, err = service.WriteChunk("unknown", 1, 0, strings.NewReader("data"))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	assert.Empty(t, service.locks)
+
+	// Expired uploads take no more data even before the purger removes them
+	_, _, err = service.WriteChunk("stale", 1, 0, strings.NewReader("data"))
+	assert.ErrorIs(t, err, ErrUploadExpired)
+}
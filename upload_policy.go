@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrFileTooLarge       = errors.New("file exceeds the maximum upload size")
+	ErrFileTypeNotAllowed = errors.New("file type is not allowed")
+	ErrTooManyFiles       = errors.New("too many files in one upload")
+	ErrBatchTooLarge      = errors.New("upload exceeds the maximum batch size")
+)
+
+// sniffLen is how many leading bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// UploadPolicy limits which files may be uploaded. Empty allow lists permit
+// everything that is not denied; deny lists always win.
+type UploadPolicy struct {
+	MaxSize           int64    // Zero means no limit
+	AllowedTypes      []string // MIME types, "image/*" matches a whole family
+	DeniedTypes       []string
+	AllowedExtensions []string // Lower case, with the leading dot
+	DeniedExtensions  []string
+	MaxBatchFiles     int // Files per batch upload, zero means no limit
+}
+
+// defaultMaxBatchFiles is how many files a batch upload may hold unless
+// UPLOAD_MAX_BATCH_FILES says otherwise
+const defaultMaxBatchFiles = 20
+
+// UploadPolicyFromEnv reads the upload policy from UPLOAD_MAX_SIZE,
+// UPLOAD_MAX_BATCH_FILES and the comma separated UPLOAD_ALLOWED_TYPES,
+// UPLOAD_DENIED_TYPES, UPLOAD_ALLOWED_EXTENSIONS and UPLOAD_DENIED_EXTENSIONS
+func UploadPolicyFromEnv() (UploadPolicy, error) {
+	policy := UploadPolicy{
+		AllowedTypes:      parseList(os.Getenv("UPLOAD_ALLOWED_TYPES"), normalizeType),
+		DeniedTypes:       parseList(os.Getenv("UPLOAD_DENIED_TYPES"), normalizeType),
+		AllowedExtensions: parseList(os.Getenv("UPLOAD_ALLOWED_EXTENSIONS"), normalizeExtension),
+		DeniedExtensions:  parseList(os.Getenv("UPLOAD_DENIED_EXTENSIONS"), normalizeExtension),
+		MaxBatchFiles:     defaultMaxBatchFiles,
+	}
+
+	if value := os.Getenv("UPLOAD_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return UploadPolicy{}, errors.New("UPLOAD_MAX_SIZE must be a number of bytes")
+		}
+		policy.MaxSize = size
+	}
+
+	if value := os.Getenv("UPLOAD_MAX_BATCH_FILES"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return UploadPolicy{}, errors.New("UPLOAD_MAX_BATCH_FILES must be a number of files")
+		}
+		policy.MaxBatchFiles = count
+	}
+
+	return policy, nil
+}
+
+// MaxBatchSize returns the largest batch upload accepted, enough for the
+// most files of the largest size, or zero when unlimited
+func (p UploadPolicy) MaxBatchSize() int64 {
+	if p.MaxSize == 0 || p.MaxBatchFiles == 0 {
+		return 0
+	}
+	return p.MaxSize * int64(p.MaxBatchFiles)
+}
+
+// CheckBatch rejects batch uploads of more files than allowed
+func (p UploadPolicy) CheckBatch(count int) error {
+	if p.MaxBatchFiles > 0 && count > p.MaxBatchFiles {
+		return fmt.Errorf("%w, at most %d", ErrTooManyFiles, p.MaxBatchFiles)
+	}
+	return nil
+}
+
+// CheckSize rejects files larger than the maximum upload size
+func (p UploadPolicy) CheckSize(size int64) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return fmt.Errorf("%w of %d bytes", ErrFileTooLarge, p.MaxSize)
+	}
+	return nil
+}
+
+// CheckName rejects filenames whose extension is not allowed
+func (p UploadPolicy) CheckName(filename string) error {
+	ext := normalizeExtension(filepath.Ext(filename))
+
+	if contains(p.DeniedExtensions, ext) || (len(p.AllowedExtensions) > 0 && !contains(p.AllowedExtensions, ext)) {
+		if ext == "" {
+			return fmt.Errorf("%w: files without an extension", ErrFileTypeNotAllowed)
+		}
+		return fmt.Errorf("%w: %s", ErrFileTypeNotAllowed, ext)
+	}
+
+	return nil
+}
+
+// CheckType rejects MIME types that are not allowed
+func (p UploadPolicy) CheckType(mimeType string) error {
+	mediaType := normalizeType(mimeType)
+
+	if matchesType(p.DeniedTypes, mediaType) || (len(p.AllowedTypes) > 0 && !matchesType(p.AllowedTypes, mediaType)) {
+		return fmt.Errorf("%w: %s", ErrFileTypeNotAllowed, mediaType)
+	}
+
+	return nil
+}
+
+// sniffContentType determines the MIME type of r from its first bytes and
+// rewinds it
+func sniffContentType(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:n]), nil
+}
+
+// matchesType reports whether mediaType is in types, honouring "type/*"
+func matchesType(types []string, mediaType string) bool {
+	family, _, _ := strings.Cut(mediaType, "/")
+	for _, t := range types {
+		if t == mediaType || t == "*/*" || t == family+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseList splits a comma separated setting, normalizing each entry
+func parseList(value string, normalize func(string) string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = normalize(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// normalizeType lower-cases a MIME type and drops its parameters
+func normalizeType(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if mediaType, _, err := mime.ParseMediaType(value); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := strings.Cut(value, ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// normalizeExtension lower-cases an extension and adds its leading dot
+func normalizeExtension(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value != "" && !strings.HasPrefix(value, ".") {
+		value = "." + value
+	}
+	return value
+}
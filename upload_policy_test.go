@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadPolicy(t *testing.T) {
+	policy := UploadPolicy{
+		MaxSize:          100,
+		AllowedTypes:     []string{"image/*", "application/pdf"},
+		DeniedTypes:      []string{"image/svg+xml"},
+		DeniedExtensions: []string{".exe"},
+	}
+
+	assert.NoError(t, policy.CheckSize(100))
+	assert.ErrorIs(t, policy.CheckSize(101), ErrFileTooLarge)
+
+	assert.NoError(t, policy.CheckType("image/png"))
+	assert.NoError(t, policy.CheckType("application/pdf"))
+	assert.ErrorIs(t, policy.CheckType("image/svg+xml"), ErrFileTypeNotAllowed, "deny wins over a wildcard allow")
+	assert.ErrorIs(t, policy.CheckType("text/html; charset=utf-8"), ErrFileTypeNotAllowed)
+
+	assert.NoError(t, policy.CheckName("report.pdf"))
+	assert.ErrorIs(t, policy.CheckName("setup.EXE"), ErrFileTypeNotAllowed)
+
+	policy.AllowedExtensions = []string{".png"}
+	assert.NoError(t, policy.CheckName("photo.PNG"))
+	assert.ErrorIs(t, policy.CheckName("README"), ErrFileTypeNotAllowed)
+}
+
+func TestUploadPolicyFromEnv(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_SIZE", "1024")
+	t.Setenv("UPLOAD_ALLOWED_TYPES", " Image/* , application/pdf,")
+	t.Setenv("UPLOAD_DENIED_TYPES", "")
+	t.Setenv("UPLOAD_ALLOWED_EXTENSIONS", "")
+	t.Setenv("UPLOAD_DENIED_EXTENSIONS", "exe, .BAT")
+
+	policy, err := UploadPolicyFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), policy.MaxSize)
+	assert.Equal(t, []string{"image/*", "application/pdf"}, policy.AllowedTypes)
+	assert.Empty(t, policy.DeniedTypes)
+	assert.Equal(t, []string{".exe", ".bat"}, policy.DeniedExtensions)
+	assert.Equal(t, defaultMaxBatchFiles, policy.MaxBatchFiles)
+	assert.Equal(t, int64(1024*defaultMaxBatchFiles), policy.MaxBatchSize())
+
+	t.Setenv("UPLOAD_MAX_BATCH_FILES", "0")
+	policy, err = UploadPolicyFromEnv()
+	require.NoError(t, err)
+	assert.Zero(t, policy.MaxBatchSize(), "zero lifts the limit")
+	assert.NoError(t, policy.CheckBatch(1000))
+
+	t.Setenv("UPLOAD_MAX_SIZE", "1MB")
+	_, err = UploadPolicyFromEnv()
+	assert.Error(t, err)
+}
+
+func TestSniffContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+	r := strings.NewReader(png)
+
+	mimeType, err := sniffContentType(r)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", mimeType)
+
+	data, _ := io.ReadAll(r)
+	assert.Len(t, data, len(png), "the reader is rewound")
+}
+
+// TestUploadFileRejectedByPolicy checks that uploads breaking the policy are
+// refused before anything is stored
+func TestUploadFileRejectedByPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policy := UploadPolicy{
+		MaxSize:          16,
+		DeniedTypes:      []string{"text/html"},
+		DeniedExtensions: []string{".exe"},
+	}
+	fileController := NewFileController(NewFileService(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, policy), nil, nil)
+	router := gin.New()
+	router.POST("/upload", func(ctx *gin.Context) { ctx.Set("user_id", 1) }, fileController.UploadFile)
+
+	upload := func(filename, contentType, content string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		header := make(map[string][]string)
+		header["Content-Disposition"] = []string{`form-data; name="file"; filename="` + filename + `"`}
+		header["Content-Type"] = []string{contentType}
+		part, _ := writer.CreatePart(header)
+		part.Write([]byte(content))
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := upload("big.txt", "text/plain", strings.Repeat("a", 17))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Bodies far beyond the limit are cut off while streaming
+	w = upload("huge.txt", "text/plain", strings.Repeat("a", 2*multipartOverhead))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = upload("tool.exe", "application/octet-stream", "MZ")
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// The declared type is ignored in favour of the sniffed one
+	w = upload("page.txt", "text/plain", "<html>hi</html>")
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Contains(t, w.Body.String(), "text/html")
+}
+
+// TestUploadFilesLimitsBatch checks that batch uploads are capped before the
+// form is parsed
+func TestUploadFilesLimitsBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policy := UploadPolicy{MaxSize: 16, MaxBatchFiles: 2}
+	fileController := NewFileController(NewFileService(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, policy), nil, nil)
+	router := gin.New()
+	router.POST("/upload/batch", func(ctx *gin.Context) { ctx.Set("user_id", 1) }, fileController.UploadFiles)
+
+	upload := func(contents ...string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, content := range contents {
+			part, _ := writer.CreateFormFile("files", "notes.txt")
+			part.Write([]byte(content))
+		}
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", "/upload/batch", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := upload("a", "b", "c")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), ErrTooManyFiles.Error())
+
+	// Bodies far beyond the limit are cut off while streaming
+	w = upload(strings.Repeat("a", 2*multipartOverhead))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), ErrBatchTooLarge.Error())
+}
+
+// TestUploadFilesReportsEachFile checks that a batch stores the files it can
+// and reports the others, in the order they were sent
+func TestUploadFilesReportsEachFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case query == "BEGIN", query == "COMMIT":
+			return fakeReply{}, nil
+		case strings.HasPrefix(query, "SELECT used_bytes FROM users"):
+			return fakeRow("used_bytes", int64(0)), nil
+		case strings.HasPrefix(query, "UPDATE users SET used_bytes"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "INSERT INTO blobs"):
+			return fakeReply{RowsAffected: 1}, nil
+		case strings.HasPrefix(query, "INSERT INTO files"):
+			return fakeReply{LastInsertID: 11, RowsAffected: 1}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	storage, err := NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+
+	policy := UploadPolicy{DeniedExtensions: []string{".exe"}}
+	fileService := NewFileService(db, NewUserRepository(db), NewFileRepository(db), nil, NewBlobRepository(db), nil, nil, nil, nil, storage, policy)
+	router := gin.New()
+	router.POST("/upload/batch", func(ctx *gin.Context) { ctx.Set("user_id", 1) }, NewFileController(fileService, nil, nil).UploadFiles)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, name := range []string{"tool.exe", "notes.txt"} {
+		part, _ := writer.CreateFormFile("files", name)
+		part.Write([]byte("hello"))
+	}
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/upload/batch", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var response struct {
+		Files    []UploadResult `json:"files"`
+		Uploaded int            `json:"uploaded"`
+		Failed   int            `json:"failed"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Uploaded)
+	assert.Equal(t, 1, response.Failed)
+	require.Len(t, response.Files, 2)
+
+	assert.Equal(t, "tool.exe", response.Files[0].Filename)
+	assert.Contains(t, response.Files[0].Error, ErrFileTypeNotAllowed.Error())
+	assert.Zero(t, response.Files[0].ID)
+
+	assert.Equal(t, "notes.txt", response.Files[1].Filename)
+	assert.Empty(t, response.Files[1].Error)
+	assert.Equal(t, 11, response.Files[1].ID)
+	assert.Equal(t, int64(5), response.Files[1].Size)
+	assert.Equal(t, "/files/11", response.Files[1].URL)
+
+	_, err = storage.Stat(blobKey(response.Files[1].SHA256))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound     = errors.New("webhook not found")
+	ErrInvalidWebhookURL   = errors.New("url must be an absolute http or https URL of at most 2048 characters")
+	ErrInvalidWebhookEvent = errors.New("events must be file.uploaded, file.deleted, file.shared or file.downloaded")
+	ErrTooManyWebhooks     = errors.New("webhook limit reached; delete one first")
+
+	errWebhookAddressBlocked = errors.New("webhook address is not publicly routable")
+)
+
+// Webhook delivery statuses
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+const (
+	// maxWebhooksPerUser bounds how many webhooks each user may register
+	maxWebhooksPerUser = 10
+
+	// webhookBatchSize is how many due deliveries the worker reads at a time
+	webhookBatchSize = 50
+
+	// maxWebhookResponse is how much of a response body is read so the
+	// connection can be reused; the rest is ignored
+	maxWebhookResponse = 64 << 10
+)
+
+// WebhookSettings controls how deliveries are sent and retried
+type WebhookSettings struct {
+	MaxAttempts   int           // Attempts before a delivery is given up on
+	RetryDelay    time.Duration // Wait before the first retry, doubled for each one after
+	MaxRetryDelay time.Duration // Longest wait between attempts
+	Timeout       time.Duration // For each attempt
+	AllowPrivate  bool          // Whether loopback and private addresses may be called
+}
+
+// WebhookSettingsFromEnv reads WEBHOOK_MAX_ATTEMPTS (8), WEBHOOK_RETRY_DELAY
+// (30s), WEBHOOK_MAX_RETRY_DELAY (1h) and WEBHOOK_TIMEOUT (10s).
+// WEBHOOK_ALLOW_PRIVATE=true lets webhooks reach internal addresses, which is
+// otherwise refused so that users cannot probe the private network.
+func WebhookSettingsFromEnv() (WebhookSettings, error) {
+	maxAttempts, err := intFromEnv("WEBHOOK_MAX_ATTEMPTS", 8)
+	if err != nil {
+		return WebhookSettings{}, err
+	}
+
+	return WebhookSettings{
+		MaxAttempts:   maxAttempts,
+		RetryDelay:    durationFromEnv("WEBHOOK_RETRY_DELAY", 30*time.Second),
+		MaxRetryDelay: durationFromEnv("WEBHOOK_MAX_RETRY_DELAY", time.Hour),
+		Timeout:       durationFromEnv("WEBHOOK_TIMEOUT", 10*time.Second),
+		AllowPrivate:  os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true",
+	}, nil
+}
+
+// retryDelay returns how long to wait after a delivery's attempts-th failed
+// attempt
+func (s WebhookSettings) retryDelay(attempts int) time.Duration {
+	delay := s.RetryDelay
+	for i := 1; i < attempts && delay < s.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxRetryDelay {
+		delay = s.MaxRetryDelay
+	}
+	return delay
+}
+
+// WebhookService tells users' webhooks about events on their files. Events
+// on a team's file go to whoever added it, only while they are still in the
+// team. Events are queued as deliveries and sent by RunWorker, so a slow or
+// unreachable receiver never holds up the request that caused the event.
+//
+// Each delivery is a JSON POST carrying X-Webhook-Event, X-Webhook-Delivery
+// (unique per delivery, to recognise retries), X-Webhook-Timestamp (Unix
+// seconds) and X-Webhook-Signature: "sha256=" followed by the hex
+// HMAC-SHA256, keyed with the webhook's secret, of the timestamp, a dot and
+// the body.
+type WebhookService struct {
+	webhookRepo  *WebhookRepository
+	deliveryRepo *WebhookDeliveryRepository
+	teamRepo     *TeamRepository
+	settings     WebhookSettings
+	client       *http.Client
+	wake         chan struct{}
+	now          func() time.Time
+}
+
+func NewWebhookService(webhookRepo *WebhookRepository, deliveryRepo *WebhookDeliveryRepository, teamRepo *TeamRepository, settings WebhookSettings) *WebhookService {
+	dialer := &net.Dialer{Timeout: settings.Timeout}
+	if !settings.AllowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+
+	return &WebhookService{
+		webhookRepo:  webhookRepo,
+		deliveryRepo: deliveryRepo,
+		teamRepo:     teamRepo,
+		settings:     settings,
+		client: &http.Client{
+			Timeout: settings.Timeout,
+			// No proxy, so the dialer sees the receiver's real address
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			// Receivers must answer themselves rather than send us elsewhere
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, 1),
+		now:  time.Now,
+	}
+}
+
+// CreateWebhook registers a URL to be sent the given events and returns it
+// together with its signing secret, which is not retrievable later
+func (s *WebhookService) CreateWebhook(userID int, rawURL string, events []string) (*Webhook, string, error) {
+	if err := validateWebhookURL(rawURL); err != nil {
+		return nil, "", err
+	}
+
+	events, err := cleanWebhookEvents(events)
+	if err != nil {
+		return nil, "", err
+	}
+
+	count, err := s.webhookRepo.CountByUserID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if count >= maxWebhooksPerUser {
+		return nil, "", ErrTooManyWebhooks
+	}
+
+	secret, err := generateSecretToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	webhook := &Webhook{
+		UserID:    userID,
+		URL:       rawURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: s.now(),
+	}
+	webhook.ID, err = s.webhookRepo.Create(webhook)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return webhook, secret, nil
+}
+
+// GetWebhooks lists a user's webhooks without their secrets
+func (s *WebhookService) GetWebhooks(userID int) ([]*Webhook, error) {
+	return s.webhookRepo.GetByUserID(userID)
+}
+
+// DeleteWebhook removes one of the user's webhooks and its delivery log
+func (s *WebhookService) DeleteWebhook(id, userID int) error {
+	return s.webhookRepo.Delete(id, userID)
+}
+
+// GetDeliveries returns a page of the deliveries to one of the user's
+// webhooks, newest first
+func (s *WebhookService) GetDeliveries(webhookID, userID, limit, offset int) ([]*WebhookDelivery, error) {
+	webhook, err := s.webhookRepo.GetByID(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if webhook.UserID != userID {
+		return nil, ErrWebhookNotFound
+	}
+
+	return s.deliveryRepo.GetByWebhookID(webhookID, limit, offset)
+}
+
+// HandleFileEvent queues a delivery of event to each webhook of the file's
+// owner that wants it. It is meant for FileService.OnFileEvent, so failures
+// are logged rather than returned.
+func (s *WebhookService) HandleFileEvent(event FileEvent) {
+	// Members removed from a team no longer hear about its files
+	if event.File.TeamID != nil {
+		role, err := s.teamRepo.GetRole(*event.File.TeamID, event.File.UserID)
+		if err != nil {
+			log.Printf("Failed to look up team membership for %s: %v", event.Type, err)
+			return
+		}
+		if role == "" {
+			return
+		}
+	}
+
+	webhooks, err := s.webhookRepo.GetSubscribed(event.File.UserID, event.Type)
+	if err != nil {
+		log.Printf("Failed to look up webhooks for %s: %v", event.Type, err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(newWebhookPayload(event))
+	if err != nil {
+		log.Printf("Failed to encode %s webhook payload: %v", event.Type, err)
+		return
+	}
+
+	now := s.now()
+	for _, webhook := range webhooks {
+		delivery := &WebhookDelivery{
+			WebhookID:     webhook.ID,
+			Event:         event.Type,
+			Payload:       payload,
+			Status:        WebhookPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		if _, err := s.deliveryRepo.Create(delivery); err != nil {
+			log.Printf("Failed to queue %s delivery to webhook %d: %v", event.Type, webhook.ID, err)
+		}
+	}
+
+	// Let the worker know without waiting for it
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunWorker sends due deliveries every interval, and as soon as events are
+// queued, until stop is closed
+func (s *WebhookService) RunWorker(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.DeliverDue(); err != nil {
+			log.Printf("Failed to deliver webhooks: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// DeliverDue makes one attempt at every delivery that is due
+func (s *WebhookService) DeliverDue() error {
+	for {
+		deliveries, err := s.deliveryRepo.GetDue(s.now(), webhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			if err := s.deliver(delivery); err != nil {
+				return err
+			}
+		}
+
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// deliver claims a delivery, sends it and records the outcome, scheduling a
+// retry with exponential backoff when it fails
+func (s *WebhookService) deliver(delivery *WebhookDelivery) error {
+	// Another instance may have got to it first
+	now := s.now()
+	claimed, err := s.deliveryRepo.Claim(delivery.ID, now, now.Add(2*s.settings.Timeout))
+	if err != nil || !claimed {
+		return err
+	}
+
+	webhook, err := s.webhookRepo.GetByID(delivery.WebhookID)
+	if err != nil {
+		// Deleting the webhook deleted the delivery too
+		if errors.Is(err, ErrWebhookNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	status, err := s.send(webhook, delivery)
+
+	now = s.now()
+	delivery.Attempts++
+	delivery.ResponseStatus = nil
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("receiver answered %d", status)
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = WebhookDelivered
+		delivery.LastError = ""
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= s.settings.MaxAttempts:
+		delivery.Status = WebhookFailed
+		delivery.LastError = truncate(err.Error(), 255)
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(s.settings.retryDelay(delivery.Attempts))
+		delivery.LastError = truncate(err.Error(), 255)
+		delivery.NextAttemptAt = &next
+	}
+
+	return s.deliveryRepo.UpdateAttempt(delivery)
+}
+
+// send posts a delivery to its webhook and returns the response status, or
+// zero when no response came
+func (s *WebhookService) send(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := s.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "file-sharing-platform-webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of a delivery. Signing the
+// timestamp as well lets receivers refuse old deliveries replayed to them.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Event     string        `json:"event"`
+	CreatedAt time.Time     `json:"created_at"`
+	ActorID   *int          `json:"actor_id"` // Nil for share link visitors and administrators
+	File      *File         `json:"file"`
+	Share     *webhookShare `json:"share,omitempty"`
+	Grant     *FileGrant    `json:"grant,omitempty"`
+	Permanent bool          `json:"permanent,omitempty"`
+}
+
+// webhookShare describes a share link without its token, which would let
+// anyone who sees the payload download the file
+type webhookShare struct {
+	ID                int        `json:"id"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	MaxDownloads      *int       `json:"max_downloads"`
+	PasswordProtected bool       `json:"password_protected"`
+}
+
+func newWebhookPayload(event FileEvent) *webhookPayload {
+	payload := &webhookPayload{
+		Event:     event.Type,
+		CreatedAt: event.Time,
+		File:      event.File,
+		Grant:     event.Grant,
+		Permanent: event.Permanent,
+	}
+	if event.ActorID != 0 {
+		actorID := event.ActorID
+		payload.ActorID = &actorID
+	}
+	if event.Share != nil {
+		payload.Share = &webhookShare{
+			ID:                event.Share.ID,
+			ExpiresAt:         event.Share.ExpiresAt,
+			MaxDownloads:      event.Share.MaxDownloads,
+			PasswordProtected: event.Share.HasPassword(),
+		}
+	}
+	return payload
+}
+
+func validateWebhookURL(rawURL string) error {
+	if len(rawURL) > 2048 {
+		return ErrInvalidWebhookURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrInvalidWebhookURL
+	}
+
+	return nil
+}
+
+// cleanWebhookEvents validates events and removes duplicates
+func cleanWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return nil, ErrInvalidWebhookEvent
+	}
+
+	var cleaned []string
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		switch event {
+		case FileUploaded, FileDeleted, FileShared, FileDownloaded:
+		default:
+			return nil, ErrInvalidWebhookEvent
+		}
+		if !contains(cleaned, event) {
+			cleaned = append(cleaned, event)
+		}
+	}
+
+	return cleaned, nil
+}
+
+// refusePrivateAddress stops webhook connections to loopback, private and
+// link-local addresses. It runs after name resolution, so a public name
+// pointing at an internal address is caught too.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return errWebhookAddressBlocked
+	}
+
+	return nil
+}
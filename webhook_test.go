@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	settings := WebhookSettings{RetryDelay: 30 * time.Second, MaxRetryDelay: 10 * time.Minute}
+
+	assert.Equal(t, 30*time.Second, settings.retryDelay(1))
+	assert.Equal(t, time.Minute, settings.retryDelay(2))
+	assert.Equal(t, 8*time.Minute, settings.retryDelay(5))
+	assert.Equal(t, 10*time.Minute, settings.retryDelay(6), "delays are capped")
+	assert.Equal(t, 10*time.Minute, settings.retryDelay(100))
+}
+
+func TestWebhookValidation(t *testing.T) {
+	for _, rawURL := range []string{"", "example.com/hook", "ftp://example.com/hook", "https://", "/relative"} {
+		assert.ErrorIs(t, validateWebhookURL(rawURL), ErrInvalidWebhookURL, rawURL)
+	}
+	assert.NoError(t, validateWebhookURL("https://ingest.example.com/hooks?source=files"))
+
+	events, err := cleanWebhookEvents([]string{FileUploaded, " file.deleted ", FileUploaded})
+	require.NoError(t, err)
+	assert.Equal(t, []string{FileUploaded, FileDeleted}, events)
+
+	_, err = cleanWebhookEvents(nil)
+	assert.ErrorIs(t, err, ErrInvalidWebhookEvent)
+	_, err = cleanWebhookEvents([]string{"file.renamed"})
+	assert.ErrorIs(t, err, ErrInvalidWebhookEvent)
+}
+
+func TestWebhookSendSignsPayload(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	service := NewWebhookService(nil, nil, nil, WebhookSettings{Timeout: time.Second, AllowPrivate: true})
+	webhook := &Webhook{ID: 1, URL: server.URL, Secret: "secret"}
+	delivery := &WebhookDelivery{ID: 9, Event: FileUploaded, Payload: []byte(`{"event":"file.uploaded"}`)}
+
+	status, err := service.send(webhook, delivery)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, status)
+
+	assert.Equal(t, FileUploaded, received.Header.Get("X-Webhook-Event"))
+	assert.Equal(t, "9", received.Header.Get("X-Webhook-Delivery"))
+	assert.Equal(t, string(delivery.Payload), string(body))
+
+	// Receivers check the signature by recomputing it over timestamp.body
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(received.Header.Get("X-Webhook-Timestamp") + "." + string(body)))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), received.Header.Get("X-Webhook-Signature"))
+
+	timestamp, err := strconv.ParseInt(received.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(timestamp, 0), time.Minute)
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback address")
+	}))
+	defer server.Close()
+
+	service := NewWebhookService(nil, nil, nil, WebhookSettings{Timeout: time.Second})
+	_, err := service.send(&Webhook{URL: server.URL}, &WebhookDelivery{Payload: []byte(`{}`)})
+	assert.ErrorIs(t, err, errWebhookAddressBlocked)
+
+	for _, address := range []string{"127.0.0.1:80", "10.1.2.3:443", "169.254.169.254:80", "[::1]:443", "[fd00::1]:443"} {
+		assert.ErrorIs(t, refusePrivateAddress("tcp", address, nil), errWebhookAddressBlocked, address)
+	}
+	assert.NoError(t, refusePrivateAddress("tcp", "93.184.216.34:443", nil))
+}
+
+func TestWebhookPayloadHidesShareToken(t *testing.T) {
+	share := &Share{ID: 4, FileID: 2, Token: "bearer-token", PasswordHash: "hash"}
+	payload, err := json.Marshal(newWebhookPayload(FileEvent{
+		Type:    FileShared,
+		File:    &File{ID: 2, UserID: 1, OriginalFilename: "report.pdf"},
+		ActorID: 1,
+		Share:   share,
+		Time:    time.Now(),
+	}))
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(payload), "bearer-token")
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(payload, &decoded))
+	assert.Equal(t, FileShared, decoded["event"])
+	assert.Equal(t, float64(1), decoded["actor_id"])
+	assert.Equal(t, true, decoded["share"].(map[string]interface{})["password_protected"])
+}
+
+func TestWebhookTeamFileEventsNeedMembership(t *testing.T) {
+	members := map[int64]string{1: "member"}
+	var queued []int64
+	db := openFakeDB(t, func(query string, args []driver.Value) (fakeReply, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT role FROM team_members"):
+			role, ok := members[args[1].(int64)]
+			if !ok {
+				return fakeReply{}, nil
+			}
+			return fakeRow("role", role), nil
+		case strings.Contains(query, "FROM webhooks WHERE user_id = ?"):
+			userID := args[0].(int64)
+			return fakeRow(webhookColumns, userID*10, userID, "https://example.com/hook", FileUploaded, "secret", time.Now()), nil
+		case strings.HasPrefix(query, "INSERT INTO webhook_deliveries"):
+			queued = append(queued, args[0].(int64))
+			return fakeReply{LastInsertID: 1, RowsAffected: 1}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeReply{}, nil
+	})
+	service := NewWebhookService(NewWebhookRepository(db), NewWebhookDeliveryRepository(db), NewTeamRepository(db), WebhookSettings{})
+
+	teamID := 4
+	service.HandleFileEvent(FileEvent{Type: FileUploaded, File: &File{ID: 1, UserID: 1, TeamID: &teamID}, Time: time.Now()})
+	service.HandleFileEvent(FileEvent{Type: FileUploaded, File: &File{ID: 2, UserID: 2, TeamID: &teamID}, Time: time.Now()})
+	service.HandleFileEvent(FileEvent{Type: FileUploaded, File: &File{ID: 3, UserID: 2}, Time: time.Now()})
+
+	// The removed member still hears about their own files only
+	assert.Equal(t, []int64{10, 20}, queued)
+}